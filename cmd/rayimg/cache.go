@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+
+	"github.com/JarvyJ/rayimg/internal/arguments"
+	"github.com/JarvyJ/rayimg/internal/fileloader"
+	"github.com/JarvyJ/rayimg/internal/imageloader"
+	"github.com/davidbyttow/govips/v2/vips"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+var cacheCommands = []string{"build", "stats", "clean"}
+
+// isCacheCommand takes what's left after the flags. A folder called "cache" still works as a path,
+// as long as it isn't followed by one of cacheCommands
+func isCacheCommand(paths []string) bool {
+	return len(paths) >= 2 && paths[0] == "cache" && slices.Contains(cacheCommands, paths[1])
+}
+
+// `rayimg [flags] cache build|stats|clean [flags] [paths]` works on CACHE_DIR without ever opening a window,
+// so it can run over ssh or from a cron job. Errors are only printed, there's no screen to show them on.
+// commandArgs is everything after the command, flags set before "cache" are already parsed
+func runCacheCommand(command string, commandArgs []string) {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] cache build|stats|clean [flags] [directory, image files, playlists (.m3u/.toml), or http(s) index pages to cache]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "build resizes pictures into CACHE_DIR ahead of time, stats shows what's in it, and clean removes stale pictures and trims it to --cache-size")
+
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(commandArgs)
+	if args.Help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	args.Path = flag.Args()
+
+	cacheDirectory, ok := os.LookupEnv("CACHE_DIR")
+	if !ok {
+		exitWithError("rayimg cache needs the CACHE_DIR environment variable set to the folder to cache pictures in")
+	}
+
+	err := arguments.LoadIniFile(&args)
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	err = validateArguments()
+	if err != nil {
+		exitWithError(err.Error())
+	}
+	maxSize := int64(args.CacheSize * 1024 * 1024)
+
+	err = registerFileTypes()
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	// cached pictures are keyed by the screen resolution, so this has to run on the machine that shows them
+	screenWidth, screenHeight, err := getScreenResolution()
+	if err != nil {
+		exitWithError(err.Error())
+	}
+
+	switch command {
+	case "stats":
+		stats := imageloader.ReadCacheStats(cacheDirectory, screenWidth, screenHeight, args.OutputProfile, args.ToneMap)
+		fmt.Println("Cache folder:", stats.Directory)
+		fmt.Println("Pictures:", stats.Pictures, "("+megabytes(stats.Size)+" of "+megabytes(maxSize)+")")
+		fmt.Println("For a different screen resolution than "+strconv.Itoa(int(screenWidth))+"x"+strconv.Itoa(int(screenHeight))+":", stats.OtherResolution)
+		fmt.Println("Stale:", stats.Stale, "("+megabytes(stats.StaleSize)+")")
+
+	case "clean":
+		before := imageloader.ReadCacheStats(cacheDirectory, screenWidth, screenHeight, args.OutputProfile, args.ToneMap)
+		imageloader.CleanCache(cacheDirectory, maxSize, screenWidth, screenHeight, args.OutputProfile, args.ToneMap)
+		after := imageloader.ReadCacheStats(cacheDirectory, screenWidth, screenHeight, args.OutputProfile, args.ToneMap)
+		fmt.Println("Freed", megabytes(before.Size+before.StaleSize-after.Size), "-", after.Pictures, "pictures left ("+megabytes(after.Size)+")")
+
+	case "build":
+		fileOptions, err := fileloader.NewOptions(args, imageloader.FileExtensions(), imageloader.IsPicture)
+		if err != nil {
+			exitWithError(err.Error())
+		}
+		listOfFiles, playlistFiles, _, err := fileloader.LoadFiles(args, fileOptions)
+		if err != nil {
+			exitWithError(err.Error())
+		}
+
+		rl.SetTraceLogLevel(rl.LogWarning)
+		vips.LoggingSettings(nil, vips.LogLevelWarning)
+		vipsConfig := vips.Config{}
+		vipsConfig.MaxCacheSize = 0
+		vips.Startup(&vipsConfig)
+		// one picture per core, a Pi Zero doesn't have the memory for more than one big picture at a time anyways
+		imageloader.BuildCache(slices.Concat(listOfFiles, playlistFiles), cacheDirectory, maxSize, screenWidth, screenHeight, args.OutputProfile, args.ToneMap, int64(args.MaxPixels*1000*1000), int64(args.MaxFileSize*1024*1024), runtime.NumCPU())
+		vips.Shutdown()
+	}
+}
+
+func megabytes(size int64) string {
+	return strconv.FormatFloat(float64(size)/1024/1024, 'f', 1, 64) + " MB"
+}
+
+func exitWithError(errorMessage string) {
+	fmt.Println(errorMessage)
+	os.Exit(1)
+}
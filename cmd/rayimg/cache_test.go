@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestIsCacheCommand(t *testing.T) {
+	commandLines := []struct {
+		commandArgs []string
+		command     string
+	}{
+		{[]string{"cache", "build", "some-folder"}, "build"},
+		{[]string{"--recursive", "cache", "build", "--cache-size", "10", "some-folder"}, "build"},
+		{[]string{"--sort", "natural", "cache", "stats"}, "stats"},
+		// folders that happen to be called cache
+		{[]string{"cache"}, ""},
+		{[]string{"cache", "some-folder"}, ""},
+		{[]string{"some-folder", "cache", "build"}, ""},
+	}
+
+	for _, commandLine := range commandLines {
+		flagSet := flag.NewFlagSet("rayimg", flag.ContinueOnError)
+		flagSet.Bool("recursive", false, "")
+		flagSet.String("sort", "", "")
+		flagSet.Parse(commandLine.commandArgs)
+
+		command := ""
+		if isCacheCommand(flagSet.Args()) {
+			command = flagSet.Arg(1)
+		}
+		if command != commandLine.command {
+			t.Errorf("Expected %v to be the %q cache command, got %q", commandLine.commandArgs, commandLine.command, command)
+		}
+	}
+}
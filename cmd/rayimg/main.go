@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"image/color"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/JarvyJ/rayimg/internal/arguments"
 	"github.com/JarvyJ/rayimg/internal/fileloader"
@@ -21,22 +25,164 @@ var args arguments.Arguments
 
 func init() {
 	flag.BoolVar(&args.Recursive, "recursive", false, "recurse into subdirectories (default false)")
-	flag.StringVar(&args.Sort, "sort", "filename", "sort mode for pictures (`'filename'`, 'random', 'natural' - default 'filename')")
+	flag.IntVar(&args.MaxDepth, "max-depth", 0, "how many folders deep --recursive goes (`0` for no limit - default 0)")
+	flag.BoolVar(&args.FollowSymlinks, "follow-symlinks", false, "go into symlinked directories when recursing, and show pictures reached through more than one link only once (default false)")
+	flag.StringVar(&args.Sort, "sort", "filename", "sort mode for pictures (`'filename'`, 'random', 'shuffle', 'natural', 'date-taken', 'modified' - add '-reverse' to the last two for newest first - default 'filename')")
 	flag.StringVar(&args.Display, "display", "none", "text to overlay on image (`'filename'`, 'caption', 'none' - default 'none')")
+	flag.StringVar(&args.ShuffleState, "shuffle-state", "", "`file` to save the shuffle order to, so a restart continues the same cycle (only for --sort shuffle)")
+	flag.StringVar(&args.StateFile, "state-file", defaultStateFile(), "`file` to save the current picture to, so a restart picks up where it left off (defaults to under CACHE_DIR when set, '' to turn off)")
 	flag.BoolVar(&args.Help, "help", false, "show all arguments")
 	flag.Float64Var(&args.Duration, "duration", 0, "duration to display each image for a slideshow (`0` for always - default 0)")
 	flag.Float64Var(&args.TransitionDuration, "transition-duration", 0, "length of the transition in seconds during a slideshow")
+	flag.StringVar(&args.AnimationPolicy, "animation-policy", "cut", "what to do with an animation when --duration runs out (`'cut'` it off, play it through 'once' at least, or finish the current loop with 'loops' - default 'cut')")
+	flag.Float64Var(&args.AnimationMaxLength, "animation-max-length", 60, "most seconds an animation can stay on screen when --animation-policy holds it past --duration (default 60)")
 	flag.BoolVar(&args.ListFiles, "list", false, "display filepaths on terminal that will be displayed (mostly for debugging)")
+	flag.BoolVar(&args.Watch, "watch", false, "watch the paths for new, removed, or renamed pictures and update the slideshow while running (default false)")
+	flag.Var((*arguments.StringList)(&args.Include), "include", "only show pictures matching this gitignore style pattern, can be passed more than once (ex: `'*.jpg'`)")
+	flag.Var((*arguments.StringList)(&args.Exclude), "exclude", "skip pictures and folders matching this gitignore style pattern, can be passed more than once (ex: `'backup/'`)")
+	flag.Float64Var(&args.WatchInterval, "watch-interval", 30, "seconds between rescans when a path can't be watched directly, like network mounts (default 30)")
+	flag.IntVar(&args.Preload, "preload", 2, "how many pictures before and after the current one to decode in the background (default 2)")
+	flag.Float64Var(&args.PreloadMemory, "preload-memory", 256, "megabytes of decoded pictures to hold on to in the background, the current and next picture are always decoded (default 256)")
+	flag.Float64Var(&args.CacheSize, "cache-size", 1024, "megabytes of downsized pictures to keep under CACHE_DIR, the least recently shown are removed past this (default 1024)")
+	flag.StringVar(&args.OutputProfile, "output-profile", "", "ICC profile `file` for the screen, pictures with an embedded profile are colour managed to it (defaults to sRGB)")
+	flag.StringVar(&args.ToneMap, "tone-map", "reinhard", "how HDR pictures are fit to the screen (`'reinhard'`, 'hable', 'aces', or 'clip' - default 'reinhard')")
+	flag.Float64Var(&args.HttpCacheSize, "http-cache-size", 1024, "megabytes of pictures to download from http(s) paths, anything past this is skipped (default 1024)")
+	flag.BoolVar(&args.Extensionless, "extensionless", false, "also show files without an extension, if they start like a picture does (default false)")
+	flag.Float64Var(&args.MaxPixels, "max-pixels", 40, "megapixels a picture can have before it's shrunk while loading instead of decoded at full size, bigger ones are skipped if that can't be done (default 40)")
+	flag.Float64Var(&args.MaxFileSize, "max-file-size", 200, "megabytes a picture's file can be, bigger ones are skipped without reading them (default 200)")
+	flag.Float64Var(&args.MemoryLimit, "memory-limit", 0, "megabytes of memory rayimg can use before it drops the pictures decoded ahead of time (`0` for three quarters of the RAM - default 0)")
+	flag.Var((*arguments.StringList)(&args.ExtraExtensions), "extra-extension", "hand files with this extension to vips, for formats it can open that aren't picked up otherwise, can be passed more than once (ex: `'psd'`)")
+}
+
+// only pictures there's a decoder for get picked up, plus anything --extra-extension hands to vips
+func registerFileTypes() error {
+	for _, extension := range args.ExtraExtensions {
+		if strings.Trim(extension, ". ") == "" {
+			return errors.New("--extra-extension can't be empty\nExtraExtensions is currently: " + strings.Join(args.ExtraExtensions, ", "))
+		}
+	}
+	imageloader.AddVipsExtensions(args.ExtraExtensions)
+	return nil
+}
+
+// validateArguments checks the flags and ini settings the slideshow and `rayimg cache` share, the first problem is the error
+func validateArguments() error {
+	switch args.Display {
+	case "none":
+	case "filename":
+	case "caption":
+	default:
+		return errors.New("The only --display options are \"none\", \"filename\", or \"caption\".\nDisplay is currently: \"" + args.Display + "\"")
+	}
+
+	switch args.Sort {
+	case "filename":
+	case "natural":
+	case "random":
+	case "shuffle":
+	case "date-taken":
+	case "date-taken-reverse":
+	case "modified":
+	case "modified-reverse":
+	default:
+		return errors.New("The only --sort options are \"filename\", \"natural\", \"random\", \"shuffle\", \"date-taken\", \"date-taken-reverse\", \"modified\", and \"modified-reverse\"\nSort is currently: \"" + args.Sort + "\"")
+	}
+
+	if args.TransitionDuration < float64(0) {
+		return errors.New("--transition-duration must be positive\nTransitionDuration is currently: " + strconv.FormatFloat(args.TransitionDuration, 'g', -1, 64))
+	}
+
+	if args.TransitionDuration > float64(0) && args.Duration == 0 {
+		return errors.New("--transition-duration can only be used when --duration is also set for slideshow purposes")
+	}
+
+	if args.Duration < float64(0) {
+		return errors.New("--duration must be positive\nDuration is currently: " + strconv.FormatFloat(args.Duration, 'g', -1, 64))
+	}
+
+	switch args.AnimationPolicy {
+	case "cut":
+	case "once":
+	case "loops":
+	default:
+		return errors.New("The only --animation-policy options are \"cut\", \"once\", or \"loops\".\nAnimationPolicy is currently: \"" + args.AnimationPolicy + "\"")
+	}
+
+	if args.AnimationMaxLength <= float64(0) {
+		return errors.New("--animation-max-length must be positive\nAnimationMaxLength is currently: " + strconv.FormatFloat(args.AnimationMaxLength, 'g', -1, 64))
+	}
+
+	if args.OutputProfile != "" {
+		if _, err := os.Stat(args.OutputProfile); err != nil {
+			return errors.New("--output-profile " + args.OutputProfile + " is not found\n" + err.Error())
+		}
+	}
+
+	switch args.ToneMap {
+	case "reinhard":
+	case "hable":
+	case "aces":
+	case "clip":
+	default:
+		return errors.New("The only --tone-map options are \"reinhard\", \"hable\", \"aces\", or \"clip\".\nToneMap is currently: \"" + args.ToneMap + "\"")
+	}
+
+	if args.ShuffleState != "" && args.Sort != "shuffle" {
+		return errors.New("--shuffle-state can only be used with --sort shuffle")
+	}
+
+	if args.Preload < 0 {
+		return errors.New("--preload must be positive\nPreload is currently: " + strconv.Itoa(args.Preload))
+	}
+
+	if args.PreloadMemory <= float64(0) {
+		return errors.New("--preload-memory must be positive\nPreloadMemory is currently: " + strconv.FormatFloat(args.PreloadMemory, 'g', -1, 64))
+	}
+
+	if args.MaxDepth < 0 {
+		return errors.New("--max-depth must be positive\nMaxDepth is currently: " + strconv.Itoa(args.MaxDepth))
+	}
+
+	if args.WatchInterval <= float64(0) {
+		return errors.New("--watch-interval must be positive\nWatchInterval is currently: " + strconv.FormatFloat(args.WatchInterval, 'g', -1, 64))
+	}
+
+	if args.HttpCacheSize <= float64(0) {
+		return errors.New("--http-cache-size must be positive\nHttpCacheSize is currently: " + strconv.FormatFloat(args.HttpCacheSize, 'g', -1, 64))
+	}
+
+	if args.CacheSize <= float64(0) {
+		return errors.New("--cache-size must be positive\nCacheSize is currently: " + strconv.FormatFloat(args.CacheSize, 'g', -1, 64))
+	}
+
+	if args.MaxPixels <= float64(0) {
+		return errors.New("--max-pixels must be positive\nMaxPixels is currently: " + strconv.FormatFloat(args.MaxPixels, 'g', -1, 64))
+	}
+
+	if args.MaxFileSize <= float64(0) {
+		return errors.New("--max-file-size must be positive\nMaxFileSize is currently: " + strconv.FormatFloat(args.MaxFileSize, 'g', -1, 64))
+	}
+
+	if args.MemoryLimit < float64(0) {
+		return errors.New("--memory-limit must be positive\nMemoryLimit is currently: " + strconv.FormatFloat(args.MemoryLimit, 'g', -1, 64))
+	}
+	return nil
 }
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [directory or image files to display]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [directory, image files, playlists (.m3u/.toml), or http(s) index pages to display]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] cache build|stats|clean [flags] [paths] to work on the CACHE_DIR cache without a window\n", os.Args[0])
 
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
+	// flags can go before or after the cache command, the ones after it are parsed once it's found
+	if isCacheCommand(flag.Args()) {
+		runCacheCommand(flag.Arg(1), flag.Args()[2:])
+		return
+	}
 	if args.Help {
 		// gross that they don't care about order here...
 		flag.Usage()
@@ -50,32 +196,19 @@ func main() {
 		displayError(err.Error())
 	}
 
-	switch args.Display {
-	case "none":
-	case "filename":
-	case "caption":
-	default:
-		displayError("The only --display options are \"none\", \"filename\", or \"caption\".\nDisplay is currently: \"" + args.Display + "\"")
-	}
-
-	switch args.Sort {
-	case "filename":
-	case "natural":
-	case "random":
-	default:
-		displayError("The only --sort options are \"filename\", \"natural\", and \"random\"\nSort is currently: \"" + args.Sort + "\"")
-	}
-
-	if args.TransitionDuration < float64(0) {
-		displayError("--transition-duration must be positive\nTransitionDuration is currently: " + strconv.FormatFloat(args.TransitionDuration, 'g', -1, 64))
+	err = validateArguments()
+	if err != nil {
+		displayError(err.Error())
 	}
 
-	if args.TransitionDuration > float64(0) && args.Duration == 0 {
-		displayError("--transition-duration can only be used when --duration is also set for slideshow purposes")
+	// keeps --shuffle-state able to continue the same cycle on its own
+	if args.StateFile == "" && args.ShuffleState != "" {
+		args.StateFile = args.ShuffleState + ".position"
 	}
 
-	if args.Duration < float64(0) {
-		displayError("--duration must be positive\nDuration is currently: " + strconv.FormatFloat(args.Duration, 'g', -1, 64))
+	err = registerFileTypes()
+	if err != nil {
+		displayError(err.Error())
 	}
 
 	screenWidth, screenHeight, err := getScreenResolution()
@@ -83,19 +216,36 @@ func main() {
 		displayError(err.Error())
 	}
 
-	listOfFiles, err := fileloader.LoadFiles(args)
+	fileOptions, err := fileloader.NewOptions(args, imageloader.FileExtensions(), imageloader.IsPicture)
+	if err != nil {
+		displayError(err.Error())
+	}
+	listOfFiles, playlistFiles, slideOverrides, err := fileloader.LoadFiles(args, fileOptions)
 	if err != nil {
 		displayError(err.Error())
 	}
-	imageLoader := imageloader.New(listOfFiles, screenWidth, screenHeight)
 
 	vips.LoggingSettings(nil, vips.LogLevelWarning)
 	vipsConfig := vips.Config{}
 	// disable vips cache, we aren't doing/redoing many operations in a row
 	// Also, i've seen rayimg get OOM-killed, so less memory use is better
 	vipsConfig.MaxCacheSize = 0
+	// started before the image loader, it starts decoding in the background right away
 	vips.Startup(&vipsConfig)
 
+	imageLoader := imageloader.New(listOfFiles, playlistFiles, slideOverrides, fileOptions, args, screenWidth, screenHeight)
+
+	// stays nil when not watching, which ApplyFileChanges treats as "nothing changed"
+	var fileChanges <-chan fileloader.FileChange
+	if args.Watch {
+		watcher, err := fileloader.NewWatcher(args, fileOptions)
+		if err != nil {
+			displayError(err.Error())
+		}
+		defer watcher.Close()
+		fileChanges = watcher.Changes()
+	}
+
 	// i'm avoiding intializing the screen until now, so if there are any errors, you don't get a flash of a window
 	rl.SetTraceLogLevel(rl.LogWarning)
 	rl.SetConfigFlags(rl.FlagVsyncHint)
@@ -109,19 +259,34 @@ func main() {
 
 	img := imageLoader.GetCurrentImage()
 	position, scale := createTextureFromImage(img.ImageData)
+	settings := imageLoader.GetCurrentSettings()
 
 	var nextImg *imageloader.RayImgImage
 	nextPosition, nextScale := rl.Vector2{}, float32(0)
 
-	if args.TransitionDuration > 0 {
-		nextImg = imageLoader.PeekNextImage()
-		nextPosition, nextScale = createTextureFromImage(nextImg.ImageData)
+	// only hang on to the next image when the current one is going to crossfade into it
+	// and only once it's decoded, so the render loop never waits on it
+	var peekNextImage = func() {
+		if nextImg == nil && settings.Duration > 0 && settings.TransitionDuration > 0 && imageLoader.NextImageReady() {
+			nextImg = imageLoader.PeekNextImage()
+			nextPosition, nextScale = createTextureFromImage(nextImg.ImageData)
+		}
+	}
+
+	var unloadNextImage = func() {
+		if nextImg != nil {
+			rl.UnloadTexture(*nextImg.ImageData)
+			nextImg = nil
+		}
 	}
 
 	timerDuration := float32(0)
-	animationCurrentFrame := 0
+	// how many times the animation had played when the duration ran out, -1 until then
+	loopsAtDuration := -1
 	transitioning := false
 	transitionTime := 0.0
+	// the index already moved on, but the old picture stays up until the new one is decoded
+	waitingForImage := false
 
 	// helps so we only update the buffer when an image changes instead of every tick
 	var drawImage = func() {
@@ -130,20 +295,19 @@ func main() {
 	}
 
 	var drawText = func() {
-		if args.Display == "none" {
+		if settings.Display == "none" {
 			return
 		}
 
-		switch args.Display {
+		switch settings.Display {
 		case "filename":
 			rl.DrawRectangleGradientV(0, int32(fontPosition.Y)-int32(fontSize), screenWidth, int32(fontSize)*2+20, color.RGBA{0, 0, 0, 0}, color.RGBA{0, 0, 0, 192})
-			rl.DrawTextEx(font, imageLoader.GetCurrentFilename(), fontPosition, float32(font.BaseSize), 0, rl.RayWhite)
+			rl.DrawTextEx(font, imageLoader.GetFilename(img.Path), fontPosition, float32(font.BaseSize), 0, rl.RayWhite)
 
 		case "caption":
-			caption := imageLoader.GetCurrentCaption()
-			if len(caption) > 0 {
+			if len(img.Caption) > 0 {
 				rl.DrawRectangleGradientV(0, int32(fontPosition.Y)-int32(fontSize), screenWidth, int32(fontSize)*2+20, color.RGBA{0, 0, 0, 0}, color.RGBA{0, 0, 0, 192})
-				rl.DrawTextEx(font, imageLoader.GetCurrentCaption(), fontPosition, float32(font.BaseSize), 0, rl.RayWhite)
+				rl.DrawTextEx(font, img.Caption, fontPosition, float32(font.BaseSize), 0, rl.RayWhite)
 			}
 		}
 	}
@@ -161,17 +325,15 @@ func main() {
 		img = imageLoader.GetCurrentImage()
 		position, scale = createTextureFromImage(img.ImageData)
 
+		settings = imageLoader.GetCurrentSettings()
+		unloadNextImage()
+
 		transitionTime = 0
 		timerDuration = 0
+		loopsAtDuration = -1
 		transitioning = false
 
 		drawScene()
-
-		if img.ImageFormat == "gif" {
-			animationCurrentFrame = 0
-		} else {
-			rl.SetTargetFPS(40)
-		}
 	}
 
 	var unloadCurrentTextureAndDrawNewImage = func() {
@@ -181,8 +343,8 @@ func main() {
 		img = nextImg
 		position, scale = nextPosition, nextScale
 
-		nextImg = imageLoader.PeekNextImage()
-		nextPosition, nextScale = createTextureFromImage(nextImg.ImageData)
+		nextImg = nil
+		settings = imageLoader.GetCurrentSettings()
 
 		transitioning = false
 
@@ -190,28 +352,80 @@ func main() {
 
 		transitionTime = 0
 		timerDuration = 0
+		loopsAtDuration = -1
+	}
 
-		if img.ImageFormat == "gif" {
-			animationCurrentFrame = 0
-		} else {
-			rl.SetTargetFPS(40)
+	// only checked once the duration has run out, so the first time through is when it ran out
+	var animationCanEnd = func() bool {
+		if loopsAtDuration == -1 {
+			loopsAtDuration = img.AnimationLoops()
 		}
+		return imageloader.AnimationCanEnd(img, settings, float64(timerDuration), loopsAtDuration)
+	}
+
+	var showCurrentImageWhenReady = func() {
+		unloadNextImage()
+		transitioning = false
+		waitingForImage = true
 	}
 
 	for !rl.WindowShouldClose() {
+		// animations keep their own time, the refresh rate only changes how smooth they look
+		if img.Animation != nil || (transitioning && nextImg != nil && nextImg.Animation != nil) {
+			rl.SetTargetFPS(animatedRefreshRate)
+		} else {
+			rl.SetTargetFPS(stillRefreshRate)
+		}
+		now := time.Now()
+
+		// the peeked image could have been removed or no longer be next in line
+		if imageLoader.ApplyFileChanges(fileChanges) && nextImg != nil && !transitioning {
+			unloadNextImage()
+		}
+		if imageLoader.CurrentImageOverwritten() && !transitioning {
+			showCurrentImageWhenReady()
+		}
+
+		imageLoader.SaveStateIfDue()
+
+		// everything was removed, the last picture goes away until new ones show up
+		if imageLoader.Empty() {
+			showCurrentImageWhenReady()
+			rl.BeginDrawing()
+			rl.ClearBackground(rl.Black)
+			rl.DrawTextEx(font, "Waiting for pictures...", fontPosition, float32(font.BaseSize), 0, rl.RayWhite)
+			rl.EndDrawing()
+			continue
+		}
+
+		// past --memory-limit, the next picture's texture goes too unless it's already fading in
+		if imageLoader.FreeMemoryIfLow() && !transitioning {
+			unloadNextImage()
+		}
 
 		if rl.IsKeyPressed(rl.KeyRight) {
 			imageLoader.IncreaseCurrentIndex()
-			unloadSingleTextureAndDrawNewImage()
+			showCurrentImageWhenReady()
 		}
 
 		if rl.IsKeyPressed(rl.KeyLeft) {
 			imageLoader.DecreaseCurrentIndex()
+			showCurrentImageWhenReady()
+		}
+
+		if waitingForImage && imageLoader.CurrentImageReady() {
+			waitingForImage = false
 			unloadSingleTextureAndDrawNewImage()
 		}
 
-		if args.Duration > 0 {
-			if timerDuration >= float32(args.Duration) {
+		// while low on memory, not until it's time for the crossfade
+		if !waitingForImage && (!imageLoader.LowOnMemory() || timerDuration >= float32(settings.Duration)) {
+			peekNextImage()
+		}
+
+		// the crossfade can't start until the next image is decoded
+		if settings.Duration > 0 && !waitingForImage {
+			if timerDuration >= float32(settings.Duration) && animationCanEnd() && (settings.TransitionDuration == 0 || nextImg != nil) {
 				transitioning = true
 			}
 			timerDuration = timerDuration + rl.GetFrameTime()
@@ -219,52 +433,52 @@ func main() {
 
 		if transitioning {
 			transitionTime = transitionTime + float64(rl.GetFrameTime())
-			if args.TransitionDuration == 0 {
+			if settings.TransitionDuration == 0 {
 				imageLoader.IncreaseCurrentIndex()
-				unloadSingleTextureAndDrawNewImage()
+				showCurrentImageWhenReady()
 			} else {
-				opacity := 255.0 * (transitionTime / args.TransitionDuration)
+				opacity := 255.0 * (transitionTime / settings.TransitionDuration)
 				opacityint := uint8(min(opacity, 255))
+				// both keep playing through the crossfade, and the new one carries on from there once it's up
+				img.Animate(now)
+				nextImg.Animate(now)
 				rl.BeginDrawing()
 				rl.ClearBackground(rl.Black)
 				rl.DrawTextureEx(*img.ImageData, position, 0, scale, color.RGBA{255, 255, 255, 255 - opacityint})
 				rl.DrawTextureEx(*nextImg.ImageData, nextPosition, 0, nextScale, color.RGBA{255, 255, 255, opacityint})
 				drawText()
 				rl.EndDrawing()
-				if transitionTime >= args.TransitionDuration {
+				if transitionTime >= settings.TransitionDuration {
 					unloadCurrentTextureAndDrawNewImage()
 				}
 			}
-		} else if img.ImageFormat == "gif" {
-
-			// wildest/best/dumbest hack ever
-			// basically make raylib wait the right time each frame in the gif
-			rl.SetTargetFPS(int32(100 / img.GifData.Delay[animationCurrentFrame]))
-			rl.UpdateTexture(*img.ImageData, img.GifData.GetGifFrame(animationCurrentFrame))
-
-			animationCurrentFrame = animationCurrentFrame + 1
-			if animationCurrentFrame >= len(img.GifData.Delay) {
-				animationCurrentFrame = 0
-			}
-
-			drawScene()
-
 		} else {
+			img.Animate(now)
 			// need to redraw every frame otherwise the pi goes haywire (i think it's a multiple buffer thing)
 			drawScene()
 		}
 	}
 
 	rl.UnloadTexture(*img.ImageData)
-	if nextImg != nil {
-		rl.UnloadTexture(*nextImg.ImageData)
-	}
+	unloadNextImage()
+	imageLoader.Close()
 
 	rl.CloseWindow()
 
 	vips.Shutdown()
 }
 
+const stillRefreshRate = 40
+const animatedRefreshRate = 60
+
+func defaultStateFile() string {
+	cacheDirectory, ok := os.LookupEnv("CACHE_DIR")
+	if !ok {
+		return ""
+	}
+	return filepath.Join(cacheDirectory, "rayimg-state.json")
+}
+
 func createTextureFromImage(texture *rl.Texture2D) (rl.Vector2, float32) {
 	// Create rl.Image from Go image.Image and create texture
 	rl.SetTextureFilter(*texture, rl.FilterBilinear)
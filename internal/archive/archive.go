@@ -0,0 +1,372 @@
+// Package archive lets zip, cbz, and tar files act like read-only directories.
+// A picture inside an archive has a path like /photos/album.zip/2024/beach.jpg
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var archiveExtensions = []string{".zip", ".cbz", ".tar", ".tar.gz", ".tgz"}
+
+func IsArchive(filename string) bool {
+	lowerFilename := strings.ToLower(filename)
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(lowerFilename, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split breaks a path like /photos/album.zip/2024/beach.jpg into the archive and the entry inside of it.
+// ok is false for paths that aren't inside an archive
+func Split(filename string) (archivePath string, entry string, ok bool) {
+	parts := strings.Split(filename, string(filepath.Separator))
+	for i := 1; i < len(parts)-1; i++ {
+		if !IsArchive(parts[i]) {
+			continue
+		}
+		archivePath = strings.Join(parts[:i+1], string(filepath.Separator))
+		if archivePath == "" {
+			continue
+		}
+		fileInfo, err := os.Stat(archivePath)
+		if err == nil && fileInfo.Mode().IsRegular() {
+			return archivePath, strings.Join(parts[i+1:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+func isTar(archivePath string) bool {
+	return !strings.HasSuffix(strings.ToLower(archivePath), ".zip") && !strings.HasSuffix(strings.ToLower(archivePath), ".cbz")
+}
+
+func isGzip(archivePath string) bool {
+	lowerPath := strings.ToLower(archivePath)
+	return strings.HasSuffix(lowerPath, ".gz") || strings.HasSuffix(lowerPath, ".tgz")
+}
+
+// tar files can only be read start to finish, so this calls found for every file until it returns true
+func walkTar(archivePath string, found func(header *tar.Header, reader io.Reader) (bool, error)) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if isGzip(archivePath) {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		done, err := found(header, tarReader)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// where a file's data is in the tar, for a .tar.gz it's where it is once it's decompressed
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// tarIndex is made the first time a file is read out of a tar, so reading the rest of them can skip straight
+// to their data instead of going through the whole archive again every time
+type tarIndex struct {
+	path    string
+	modTime time.Time
+	size    int64
+	entries map[string]tarEntry
+
+	// there's no skipping ahead in gzip, so a .tar.gz is decompressed up to the entry that's wanted. The stream is kept
+	// open after that, and reading the entries in order (like a sorted slideshow does) only decompresses it once
+	mutex  sync.Mutex
+	stream *gzipStream
+}
+
+type gzipStream struct {
+	file   *os.File
+	reader *gzip.Reader
+	// how far into the decompressed tar it is
+	position int64
+}
+
+// countingReader keeps track of how far into a .tar.gz the tar reader is, since it can't ask the gzip reader
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.read += int64(n)
+	return n, err
+}
+
+var tarIndexes = map[string]*tarIndex{}
+var tarIndexesLock sync.Mutex
+
+// getTarIndex makes the index if it hasn't been made yet or the archive changed since
+func getTarIndex(archivePath string) (*tarIndex, error) {
+	fileInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tarIndexesLock.Lock()
+	defer tarIndexesLock.Unlock()
+
+	index, ok := tarIndexes[archivePath]
+	if ok && index.modTime.Equal(fileInfo.ModTime()) && index.size == fileInfo.Size() {
+		return index, nil
+	}
+	if ok {
+		index.close()
+		delete(tarIndexes, archivePath)
+	}
+
+	index, err = makeTarIndex(archivePath, fileInfo)
+	if err != nil {
+		return nil, err
+	}
+	tarIndexes[archivePath] = index
+	return index, nil
+}
+
+func makeTarIndex(archivePath string, fileInfo fs.FileInfo) (*tarIndex, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index := &tarIndex{path: archivePath, modTime: fileInfo.ModTime(), size: fileInfo.Size(), entries: map[string]tarEntry{}}
+	// the tar reader only reads the headers it needs, so after Next it's right at the start of the data
+	position := func() (int64, error) { return file.Seek(0, io.SeekCurrent) }
+	var reader io.Reader = file
+	if isGzip(archivePath) {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		counter := &countingReader{reader: gzipReader}
+		position = func() (int64, error) { return counter.read, nil }
+		reader = counter
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := position()
+		if err != nil {
+			return nil, err
+		}
+		entry := cleanEntry(header.Name)
+		if _, ok := index.entries[entry]; !ok {
+			index.entries[entry] = tarEntry{offset, header.Size}
+		}
+	}
+}
+
+func (index *tarIndex) read(entry tarEntry, maxSize int64) ([]byte, error) {
+	if !isGzip(index.path) {
+		file, err := os.Open(index.path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readUpTo(io.NewSectionReader(file, entry.offset, entry.size), maxSize)
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	// going backwards means starting over
+	if index.stream != nil && index.stream.position > entry.offset {
+		index.closeStream()
+	}
+	if index.stream == nil {
+		file, err := os.Open(index.path)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		index.stream = &gzipStream{file: file, reader: reader}
+	}
+
+	stream := index.stream
+	skipped, err := io.CopyN(io.Discard, stream.reader, entry.offset-stream.position)
+	stream.position += skipped
+	if err != nil {
+		index.closeStream()
+		return nil, err
+	}
+	counter := &countingReader{reader: io.LimitReader(stream.reader, entry.size)}
+	data, err := readUpTo(counter, maxSize)
+	stream.position += counter.read
+	if err != nil && !errors.Is(err, ErrTooBig) {
+		index.closeStream()
+	}
+	return data, err
+}
+
+func (index *tarIndex) closeStream() {
+	if index.stream != nil {
+		index.stream.reader.Close()
+		index.stream.file.Close()
+		index.stream = nil
+	}
+}
+
+func (index *tarIndex) close() {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.closeStream()
+}
+
+// Close closes any .tar.gz files that were left open to read the next picture from
+func Close() {
+	tarIndexesLock.Lock()
+	defer tarIndexesLock.Unlock()
+	for archivePath, index := range tarIndexes {
+		index.close()
+		delete(tarIndexes, archivePath)
+	}
+}
+
+func cleanEntry(entry string) string {
+	return strings.TrimPrefix(path.Clean("/"+entry), "/")
+}
+
+// List returns every file in the archive, using "/" no matter the platform
+func List(archivePath string) ([]string, error) {
+	entries := []string{}
+
+	if isTar(archivePath) {
+		err := walkTar(archivePath, func(header *tar.Header, reader io.Reader) (bool, error) {
+			entries = append(entries, cleanEntry(header.Name))
+			return false, nil
+		})
+		return entries, err
+	}
+
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	for _, file := range zipReader.File {
+		if file.Mode().IsRegular() {
+			entries = append(entries, cleanEntry(file.Name))
+		}
+	}
+	return entries, nil
+}
+
+// ErrTooBig is from ReadFileUpTo, for an entry that's bigger than it's allowed to read
+var ErrTooBig = errors.New("it is bigger than the size limit")
+
+// ReadFile reads a single entry into memory, the decoders take it straight from there
+func ReadFile(archivePath string, entry string) ([]byte, error) {
+	return ReadFileUpTo(archivePath, entry, 0)
+}
+
+// ReadFileUpTo is ReadFile, but an entry bigger than maxSize (0 for no limit) is ErrTooBig instead.
+// It stops reading at maxSize even when the size in the archive is wrong, so a zip bomb can't fill up the memory
+func ReadFileUpTo(archivePath string, entry string, maxSize int64) ([]byte, error) {
+	entry = cleanEntry(entry)
+
+	if isTar(archivePath) {
+		index, err := getTarIndex(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		tarEntry, ok := index.entries[entry]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		if maxSize > 0 && tarEntry.size > maxSize {
+			return nil, ErrTooBig
+		}
+		return index.read(tarEntry, maxSize)
+	}
+
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	for _, file := range zipReader.File {
+		if cleanEntry(file.Name) != entry {
+			continue
+		}
+		if maxSize > 0 && file.UncompressedSize64 > uint64(maxSize) {
+			return nil, ErrTooBig
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return readUpTo(reader, maxSize)
+	}
+	return nil, fs.ErrNotExist
+}
+
+func readUpTo(reader io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(reader)
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err == nil && int64(len(data)) > maxSize {
+		return nil, ErrTooBig
+	}
+	return data, err
+}
@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFiles = map[string]string{
+	"cover.jpg":          "cover",
+	"2024/beach.jpg":     "beach",
+	"2024/beach.jpg.txt": "At the beach",
+}
+
+func writeZip(t *testing.T, filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zipWriter := zip.NewWriter(file)
+	zipWriter.Create("2024/")
+	for name, contents := range testFiles {
+		writer, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(contents))
+	}
+	zipWriter.Close()
+}
+
+// writeTar gzips it too when the filename ends in .gz
+func writeTar(t *testing.T, filename string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var writer io.Writer = file
+	gzipWriter := gzip.NewWriter(file)
+	if strings.HasSuffix(filename, ".gz") {
+		writer = gzipWriter
+	}
+	tarWriter := tar.NewWriter(writer)
+	tarWriter.WriteHeader(&tar.Header{Name: "2024/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, contents := range testFiles {
+		tarWriter.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+		tarWriter.Write([]byte(contents))
+	}
+	tarWriter.Close()
+	if writer == gzipWriter {
+		gzipWriter.Close()
+	}
+}
+
+func TestArchives(t *testing.T) {
+	directory := t.TempDir()
+	archives := map[string]func(*testing.T, string){
+		filepath.Join(directory, "album.cbz"):    writeZip,
+		filepath.Join(directory, "album.tar"):    writeTar,
+		filepath.Join(directory, "album.tar.gz"): writeTar,
+	}
+
+	for archivePath, write := range archives {
+		write(t, archivePath)
+
+		entries, err := List(archivePath)
+		if err != nil {
+			t.Fatalf("Not able to list %s: %s", archivePath, err.Error())
+		}
+		slices.Sort(entries)
+		expected := []string{"2024/beach.jpg", "2024/beach.jpg.txt", "cover.jpg"}
+		if !slices.Equal(entries, expected) {
+			t.Errorf("Expected %s to list %v, got %v", archivePath, expected, entries)
+		}
+
+		for name, contents := range testFiles {
+			data, err := ReadFile(archivePath, name)
+			if err != nil || string(data) != contents {
+				t.Errorf("Expected %s in %s to be %q, got %q (%v)", name, archivePath, contents, data, err)
+			}
+		}
+		if _, err := ReadFile(archivePath, "missing.jpg"); err == nil {
+			t.Errorf("Expected an error reading a missing file from %s", archivePath)
+		}
+		if _, err := ReadFileUpTo(archivePath, "2024/beach.jpg", 2); !errors.Is(err, ErrTooBig) {
+			t.Errorf("Expected beach.jpg in %s to be too big to read, got %v", archivePath, err)
+		}
+
+		gotArchive, entry, ok := Split(filepath.Join(archivePath, "2024", "beach.jpg"))
+		if !ok || gotArchive != archivePath || entry != "2024/beach.jpg" {
+			t.Errorf("Expected to split %s into 2024/beach.jpg, got %s %s %t", archivePath, gotArchive, entry, ok)
+		}
+	}
+
+	if _, _, ok := Split(filepath.Join(directory, "album.zip", "cover.jpg")); ok {
+		t.Error("Expected no split when the archive doesn't exist")
+	}
+	os.Mkdir(filepath.Join(directory, "folder.zip"), 0755)
+	if _, _, ok := Split(filepath.Join(directory, "folder.zip", "cover.jpg")); ok {
+		t.Error("Expected no split for a directory named like an archive")
+	}
+}
+
+func TestTarIndex(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "album.tar.gz")
+	writeTar(t, archivePath)
+	defer Close()
+
+	names := []string{}
+	for name := range testFiles {
+		names = append(names, name)
+	}
+	index, err := getTarIndex(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in the order they're in the archive, then backwards
+	slices.SortFunc(names, func(a string, b string) int { return int(index.entries[a].offset - index.entries[b].offset) })
+	for _, name := range append(slices.Clone(names), names[0]) {
+		data, err := ReadFile(archivePath, name)
+		if err != nil || string(data) != testFiles[name] {
+			t.Errorf("Expected %s to be %q, got %q (%v)", name, testFiles[name], data, err)
+		}
+		if tarIndexes[archivePath] != index {
+			t.Fatal("Expected the same index for every read")
+		}
+	}
+
+	// going forward carries on from the stream that's already open
+	ReadFile(archivePath, names[0])
+	stream := index.stream
+	ReadFile(archivePath, names[1])
+	if stream == nil || index.stream != stream {
+		t.Error("Expected reading the next entry to keep going with the same stream")
+	}
+
+	// a changed archive gets a new index
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(archivePath, later, later)
+	ReadFile(archivePath, names[0])
+	if tarIndexes[archivePath] == index || index.stream != nil {
+		t.Error("Expected a new index after the archive changed, and the old stream closed")
+	}
+
+	index = tarIndexes[archivePath]
+	Close()
+	if index.stream != nil || len(tarIndexes) != 0 {
+		t.Error("Expected Close to close the open streams")
+	}
+}
@@ -26,11 +26,90 @@ type IniSettings struct {
 	Sort               string
 	Display            string
 	TransitionDuration float64
+	Watch              bool
+	WatchInterval      float64
+	Include            []string
+	Exclude            []string
+	ShuffleState       string
+	StateFile          string
+	HttpCacheSize      float64
+	FollowSymlinks     bool
+	MaxDepth           int
+	Preload            int
+	PreloadMemory      float64
+	CacheSize          float64
+	AnimationPolicy    string
+	AnimationMaxLength float64
+	OutputProfile      string
+	ToneMap            string
+	Extensionless      bool
+	ExtraExtensions    []string
+	MaxPixels          float64
+	MaxFileSize        float64
+	MemoryLimit        float64
+}
+
+// FolderSettings are the settings a slide_settings.ini in a sub folder can change for the pictures underneath it.
+// Anything left out (nil) comes from the folder above
+type FolderSettings struct {
+	Duration           *float64
+	TransitionDuration *float64
+	Display            *string
+}
+
+// LoadFolderSettings reads the slide_settings.ini in directory, if there is one
+func LoadFolderSettings(directory string) (FolderSettings, error) {
+	folderSettings := FolderSettings{}
+	iniLocation := filepath.Join(directory, slideSettingsFile)
+	if _, err := os.Stat(iniLocation); err != nil {
+		return folderSettings, nil
+	}
+
+	_, err := toml.DecodeFile(iniLocation, &folderSettings)
+	if err != nil {
+		return FolderSettings{}, errors.New("Error loading " + iniLocation + ". Ensure strings are double quoted.\n" + err.Error())
+	}
+	if folderSettings.Duration != nil && *folderSettings.Duration < 0 {
+		return FolderSettings{}, errors.New("Duration must be positive in " + iniLocation)
+	}
+	if folderSettings.TransitionDuration != nil && *folderSettings.TransitionDuration < 0 {
+		return FolderSettings{}, errors.New("TransitionDuration must be positive in " + iniLocation)
+	}
+	if folderSettings.Display != nil {
+		switch *folderSettings.Display {
+		case "none":
+		case "filename":
+		case "caption":
+		default:
+			return FolderSettings{}, errors.New("The only Display options are \"none\", \"filename\", or \"caption\" in " + iniLocation)
+		}
+	}
+	return folderSettings, nil
+}
+
+// IsUrl is for paths that are an index page or JSON list on a web server instead of something on disk
+func IsUrl(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// StringList lets a flag be passed more than once, ex: --exclude "*.tmp" --exclude "backup/"
+type StringList []string
+
+func (list *StringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *StringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
 }
 
 func LoadIniFile(args *Arguments) error {
 	if len(args.Path) > 1 {
 		for _, path := range args.Path {
+			if IsUrl(path) {
+				continue
+			}
 			fileInfo, err := os.Stat(path)
 			if err != nil {
 				return errors.New("The path " + path + " is not found\n" + err.Error())
@@ -38,7 +117,7 @@ func LoadIniFile(args *Arguments) error {
 			if fileInfo.IsDir() {
 				iniLocation := filepath.Join(path, slideSettingsFile)
 				if _, err := os.Stat(iniLocation); err == nil {
-					fmt.Println("WARNING: Can't load slide_settings.ini when multiple directories passed in")
+					fmt.Println("Multiple directories passed in, each slide_settings.ini will only set Duration, TransitionDuration, and Display for the pictures in its own folder")
 					return nil
 				}
 			}
@@ -60,7 +139,7 @@ func LoadIniFile(args *Arguments) error {
 		iniSettings := &IniSettings{}
 		// using toml to decode ini, probably not the best look.
 		// but an ini file will just open on Windows/Linux for easy editing
-		// also, there's only 5 settings here. I think we'll be fine (for now)
+		// also, there's only a handful of settings here. I think we'll be fine (for now)
 		_, err = toml.DecodeFile(iniLocation, &iniSettings)
 		if err != nil {
 			return errors.New("Error loading " + iniLocation + ". Ensure strings are double quoted.\n" + err.Error())
@@ -90,6 +169,90 @@ func LoadIniFile(args *Arguments) error {
 		if !flagset["transition-duration"] {
 			args.TransitionDuration = iniSettings.TransitionDuration
 		}
+
+		if !flagset["watch"] {
+			args.Watch = iniSettings.Watch
+		}
+
+		if !flagset["watch-interval"] && iniSettings.WatchInterval != 0 {
+			args.WatchInterval = iniSettings.WatchInterval
+		}
+
+		if !flagset["include"] && len(iniSettings.Include) > 0 {
+			args.Include = iniSettings.Include
+		}
+
+		if !flagset["exclude"] && len(iniSettings.Exclude) > 0 {
+			args.Exclude = iniSettings.Exclude
+		}
+
+		if !flagset["shuffle-state"] && iniSettings.ShuffleState != "" {
+			args.ShuffleState = iniSettings.ShuffleState
+		}
+
+		if !flagset["state-file"] && iniSettings.StateFile != "" {
+			args.StateFile = iniSettings.StateFile
+		}
+
+		if !flagset["http-cache-size"] && iniSettings.HttpCacheSize != 0 {
+			args.HttpCacheSize = iniSettings.HttpCacheSize
+		}
+
+		if !flagset["follow-symlinks"] {
+			args.FollowSymlinks = iniSettings.FollowSymlinks
+		}
+
+		if !flagset["max-depth"] && iniSettings.MaxDepth != 0 {
+			args.MaxDepth = iniSettings.MaxDepth
+		}
+
+		if !flagset["preload"] && iniSettings.Preload != 0 {
+			args.Preload = iniSettings.Preload
+		}
+
+		if !flagset["preload-memory"] && iniSettings.PreloadMemory != 0 {
+			args.PreloadMemory = iniSettings.PreloadMemory
+		}
+
+		if !flagset["cache-size"] && iniSettings.CacheSize != 0 {
+			args.CacheSize = iniSettings.CacheSize
+		}
+
+		if !flagset["animation-policy"] && iniSettings.AnimationPolicy != "" {
+			args.AnimationPolicy = iniSettings.AnimationPolicy
+		}
+
+		if !flagset["animation-max-length"] && iniSettings.AnimationMaxLength != 0 {
+			args.AnimationMaxLength = iniSettings.AnimationMaxLength
+		}
+
+		if !flagset["output-profile"] && iniSettings.OutputProfile != "" {
+			args.OutputProfile = iniSettings.OutputProfile
+		}
+
+		if !flagset["tone-map"] && iniSettings.ToneMap != "" {
+			args.ToneMap = iniSettings.ToneMap
+		}
+
+		if !flagset["extensionless"] {
+			args.Extensionless = iniSettings.Extensionless
+		}
+
+		if !flagset["extra-extension"] && len(iniSettings.ExtraExtensions) > 0 {
+			args.ExtraExtensions = iniSettings.ExtraExtensions
+		}
+
+		if !flagset["max-pixels"] && iniSettings.MaxPixels != 0 {
+			args.MaxPixels = iniSettings.MaxPixels
+		}
+
+		if !flagset["max-file-size"] && iniSettings.MaxFileSize != 0 {
+			args.MaxFileSize = iniSettings.MaxFileSize
+		}
+
+		if !flagset["memory-limit"] && iniSettings.MemoryLimit != 0 {
+			args.MemoryLimit = iniSettings.MemoryLimit
+		}
 	}
 	return nil
 }
@@ -0,0 +1,174 @@
+// Package exif pulls the little bit of metadata rayimg cares about out of a picture
+// without decoding it. It's not a full EXIF reader, just enough to find the tags below
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// metadata is almost always near the start of the file, no need to read all of it
+const searchLimit = 128 * 1024
+
+const (
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+const exifDateLayout = "2006:01:02 15:04:05"
+
+type Exif struct {
+	// zero if the picture doesn't say when it was taken
+	DateTaken time.Time
+	// 1-8 like the EXIF tag, 0 if missing
+	Orientation int
+}
+
+// Read looks for EXIF (and falls back to XMP for the date) in jpg, png, webp, heif/avif, jxl, and tiff files.
+// Missing metadata isn't an error, it just leaves the fields empty
+func Read(path string) (Exif, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Exif{}, err
+	}
+	defer file.Close()
+
+	data := make([]byte, searchLimit)
+	n, err := io.ReadFull(file, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return Exif{}, err
+	}
+	return Parse(data[:n]), nil
+}
+
+func Parse(data []byte) Exif {
+	exif := Exif{}
+	tiff := findTiff(data)
+	if tiff != nil {
+		exif = parseTiff(tiff)
+	}
+	if exif.DateTaken.IsZero() {
+		exif.DateTaken = parseXmpDate(data)
+	}
+	return exif
+}
+
+func isTiffHeader(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// every container puts the EXIF block (which is just a tiny TIFF file) a little differently:
+// jpg "Exif\0\0", heif/jxl "Exif" + an offset, png "eXIf" chunk, webp "EXIF" chunk + size.
+// so find the marker and look a few bytes past it for the TIFF header
+func findTiff(data []byte) []byte {
+	if isTiffHeader(data) {
+		return data
+	}
+
+	for _, marker := range []string{"Exif", "eXIf", "EXIF"} {
+		searchFrom := 0
+		for {
+			index := bytes.Index(data[searchFrom:], []byte(marker))
+			if index == -1 {
+				break
+			}
+			start := searchFrom + index + len(marker)
+			for offset := start; offset < start+16 && offset+8 <= len(data); offset++ {
+				if isTiffHeader(data[offset:]) {
+					return data[offset:]
+				}
+			}
+			searchFrom = start
+		}
+	}
+	return nil
+}
+
+type ifdEntry struct {
+	dataType uint16
+	count    uint32
+	value    []byte
+}
+
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]ifdEntry {
+	entries := make(map[uint16]ifdEntry)
+	// in uint64, an offset past 2^31 would go negative as an int on a 32 bit pi
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return entries
+	}
+
+	numberOfEntries := uint64(order.Uint16(tiff[offset:]))
+	for i := uint64(0); i < numberOfEntries; i++ {
+		start := uint64(offset) + 2 + i*12
+		if start+12 > uint64(len(tiff)) {
+			break
+		}
+		entry := tiff[start : start+12]
+		tag := order.Uint16(entry[0:])
+		entries[tag] = ifdEntry{
+			dataType: order.Uint16(entry[2:]),
+			count:    order.Uint32(entry[4:]),
+			value:    entry[8:12],
+		}
+	}
+	return entries
+}
+
+func (entry ifdEntry) ascii(tiff []byte, order binary.ByteOrder) string {
+	data := entry.value
+	if entry.count > 4 {
+		offset := order.Uint32(entry.value)
+		end := uint64(offset) + uint64(entry.count)
+		if end > uint64(len(tiff)) {
+			return ""
+		}
+		data = tiff[offset:end]
+	}
+	return strings.TrimRight(string(data[:min(uint64(entry.count), uint64(len(data)))]), "\x00 ")
+}
+
+func (entry ifdEntry) short(order binary.ByteOrder) int {
+	return int(order.Uint16(entry.value))
+}
+
+func (entry ifdEntry) long(order binary.ByteOrder) uint32 {
+	return order.Uint32(entry.value)
+}
+
+func parseTiff(tiff []byte) Exif {
+	exif := Exif{}
+	if len(tiff) < 8 {
+		return exif
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if tiff[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if orientation, ok := ifd0[tagOrientation]; ok {
+		value := orientation.short(order)
+		if value >= 1 && value <= 8 {
+			exif.Orientation = value
+		}
+	}
+
+	if exifPointer, ok := ifd0[tagExifIFD]; ok {
+		exifIFD := readIFD(tiff, order, exifPointer.long(order))
+		if dateTimeOriginal, ok := exifIFD[tagDateTimeOriginal]; ok {
+			dateTaken, err := time.Parse(exifDateLayout, dateTimeOriginal.ascii(tiff, order))
+			if err == nil {
+				exif.DateTaken = dateTaken
+			}
+		}
+	}
+
+	return exif
+}
@@ -0,0 +1,93 @@
+package exif
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// builds a little endian TIFF block with IFD0 (orientation + exif pointer) and an exif IFD with DateTimeOriginal
+func buildTiff(orientation uint16, dateTaken string) []byte {
+	order := binary.LittleEndian
+	tiff := []byte("II*\x00")
+	tiff = order.AppendUint32(tiff, 8)
+
+	// IFD0 at 8: 2 entries, then next IFD offset
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = order.AppendUint16(tiff, tagOrientation)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = order.AppendUint16(tiff, 0)
+	tiff = order.AppendUint16(tiff, tagExifIFD)
+	tiff = order.AppendUint16(tiff, 4)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint32(tiff, 38)
+	tiff = order.AppendUint32(tiff, 0)
+
+	// exif IFD at 38: 1 entry pointing at the string right after it
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, tagDateTimeOriginal)
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = order.AppendUint32(tiff, uint32(len(dateTaken)+1))
+	tiff = order.AppendUint32(tiff, 56)
+	tiff = order.AppendUint32(tiff, 0)
+
+	return append(tiff, append([]byte(dateTaken), 0)...)
+}
+
+func TestParseJpegExif(t *testing.T) {
+	tiff := buildTiff(6, "2023:07:04 18:30:00")
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe1}
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(len(tiff)+8))
+	jpeg = append(jpeg, []byte("Exif\x00\x00")...)
+	jpeg = append(jpeg, tiff...)
+
+	exif := Parse(jpeg)
+	expectedDate := time.Date(2023, 7, 4, 18, 30, 0, 0, time.UTC)
+	if !exif.DateTaken.Equal(expectedDate) {
+		t.Errorf("Expected date taken '%s', but got '%s'", expectedDate, exif.DateTaken)
+	}
+	if exif.Orientation != 6 {
+		t.Errorf("Expected orientation '6', but got '%d'", exif.Orientation)
+	}
+}
+
+// the offsets are uint32s, past 2^31 they go negative as an int on a 32 bit pi
+func TestHugeOffsets(t *testing.T) {
+	order := binary.LittleEndian
+	for _, offset := range []uint32{0x80000000, 0xFFFFFFF0, 0xFFFFFFFF} {
+		tiff := []byte("II*\x00")
+		tiff = order.AppendUint32(tiff, offset)
+		if exif := parseTiff(tiff); exif.Orientation != 0 {
+			t.Errorf("Expected nothing from an IFD at %x, got %+v", offset, exif)
+		}
+
+		// a good IFD0 pointing at a bad exif IFD
+		tiff = buildTiff(3, "2023:07:04 18:30:00")
+		order.PutUint32(tiff[30:], offset)
+		if exif := parseTiff(tiff); exif.Orientation != 3 || !exif.DateTaken.IsZero() {
+			t.Errorf("Expected only the orientation with an exif IFD at %x, got %+v", offset, exif)
+		}
+
+		// and a string that says it's longer than the whole file
+		tiff = buildTiff(3, "2023:07:04 18:30:00")
+		order.PutUint32(tiff[44:], offset)
+		if exif := parseTiff(tiff); !exif.DateTaken.IsZero() {
+			t.Errorf("Expected no date from a string %x long, got %+v", offset, exif)
+		}
+	}
+}
+
+func TestParseXmpDate(t *testing.T) {
+	xmp := []byte(`junk<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:Description xmp:CreateDate="2021-03-04T05:06:07+02:00"/></x:xmpmeta>`)
+
+	exif := Parse(xmp)
+	expectedDate := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if !exif.DateTaken.Equal(expectedDate) {
+		t.Errorf("Expected date taken '%s', but got '%s'", expectedDate, exif.DateTaken)
+	}
+	if exif.Orientation != 0 {
+		t.Errorf("Expected no orientation, but got '%d'", exif.Orientation)
+	}
+}
@@ -0,0 +1,49 @@
+package exif
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+)
+
+// XMP is just XML sitting in the file, and the date can be an attribute or an element depending on who wrote it:
+// exif:DateTimeOriginal="2024-01-02T10:00:00" or <xmp:CreateDate>2024-01-02T10:00:00</xmp:CreateDate>
+var xmpDateTags = []*regexp.Regexp{
+	regexp.MustCompile(`exif:DateTimeOriginal(?:="|>)([^"<]+)`),
+	regexp.MustCompile(`photoshop:DateCreated(?:="|>)([^"<]+)`),
+	regexp.MustCompile(`xmp:CreateDate(?:="|>)([^"<]+)`),
+}
+
+var xmpDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseXmpDate(data []byte) time.Time {
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start == -1 {
+		return time.Time{}
+	}
+	xmp := data[start:]
+	if end := bytes.Index(xmp, []byte("</x:xmpmeta>")); end != -1 {
+		xmp = xmp[:end]
+	}
+
+	for _, tag := range xmpDateTags {
+		match := tag.FindSubmatch(xmp)
+		if match == nil {
+			continue
+		}
+		for _, layout := range xmpDateLayouts {
+			date, err := time.Parse(layout, string(bytes.TrimSpace(match[1])))
+			if err == nil {
+				// EXIF dates don't have a timezone, so keep the wall clock time to compare them evenly
+				return time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), time.UTC)
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package fileloader
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// no inodes here, so fall back to where the links end up
+type fileID struct {
+	path string
+}
+
+func getFileID(fileInfo fs.FileInfo, path string) fileID {
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fileID{path: path}
+	}
+	return fileID{path: resolvedPath}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package fileloader
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// device and inode, so the same file reached through different links is only counted once
+type fileID struct {
+	device uint64
+	inode  uint64
+	path   string
+}
+
+func getFileID(fileInfo fs.FileInfo, path string) fileID {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{path: path}
+	}
+	return fileID{device: uint64(stat.Dev), inode: uint64(stat.Ino)}
+}
@@ -3,30 +3,163 @@ package fileloader
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/JarvyJ/rayimg/internal/archive"
 	"github.com/JarvyJ/rayimg/internal/arguments"
 )
 
-var validFileExtensions = []string{".jpg", ".png", ".jpeg", ".webp", ".avif", ".jxl", ".heif", ".heic", ".svg", ".bmp", ".tiff", ".tif", ".qoi"}
-var validFileExtensionsSet = make(map[string]bool)
+// longer than any signature in a picture, and enough to get past the xml declaration and comments an svg can start with
+const headerSize = 512
 
-func validFileByExtension(path string) bool {
+// Options are the flags that decide which files are found. LoadFiles and NewWatcher get the same ones,
+// so the watcher finds the same pictures LoadFiles would have
+type Options struct {
+	followSymlinks bool
+	maxDepth       int
+	extensionless  bool
+	// --include/--exclude
+	includePatterns []string
+	excludePatterns []string
+	// every extension (with the dot) that there's a decoder for, they come from the decoders registered in imageloader
+	// so finding pictures and decoding them never disagree
+	extensions   []string
+	extensionSet map[string]bool
+	// how files without an extension are checked with --extensionless, it gets the first headerSize bytes of the file
+	isPicture func(header []byte) bool
+	// where slide_settings.ini files are looked for, see FolderSettings
+	settingsRoots       []settingsRoot
+	folderSettingsCache folderSettingsCache
+	// by URL, LoadFiles and the watcher share them so they don't download into the same folder at the same time
+	httpSources map[string]*httpSource
+}
+
+// NewOptions checks the --include/--exclude patterns, and works out the settings roots from the paths.
+// extensions and isPicture come from imageloader, it checks the start of a file against the decoders' signatures
+func NewOptions(arguments arguments.Arguments, extensions []string, isPicture func(header []byte) bool) (Options, error) {
+	if err := validatePatterns("--include", arguments.Include); err != nil {
+		return Options{}, err
+	}
+	if err := validatePatterns("--exclude", arguments.Exclude); err != nil {
+		return Options{}, err
+	}
+	return Options{
+		followSymlinks:      arguments.FollowSymlinks,
+		maxDepth:            arguments.MaxDepth,
+		extensionless:       arguments.Extensionless,
+		includePatterns:     arguments.Include,
+		excludePatterns:     arguments.Exclude,
+		extensions:          extensions,
+		extensionSet:        newExtensionSet(extensions),
+		isPicture:           isPicture,
+		settingsRoots:       getSettingsRoots(arguments.Path),
+		folderSettingsCache: make(folderSettingsCache),
+		httpSources:         make(map[string]*httpSource),
+	}, nil
+}
+
+func newExtensionSet(extensions []string) map[string]bool {
+	extensionSet := make(map[string]bool)
+	for _, extension := range extensions {
+		extensionSet[extension] = true
+	}
+	return extensionSet
+}
+
+func (options Options) httpSource(indexURL string, arguments arguments.Arguments) (*httpSource, error) {
+	if source, ok := options.httpSources[indexURL]; ok {
+		return source, nil
+	}
+	source, err := newHttpSource(indexURL, arguments, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.httpSources != nil {
+		options.httpSources[indexURL] = source
+	}
+	return source, nil
+}
+
+// depth of a directory under root, root itself is 0
+func directoryDepth(root string, directory string) int {
+	relative, err := filepath.Rel(root, directory)
+	if err != nil || relative == "." {
+		return 0
+	}
+	return strings.Count(relative, string(filepath.Separator)) + 1
+}
+
+func (options Options) tooDeep(root string, directory string) bool {
+	return options.maxDepth > 0 && directoryDepth(root, directory) > options.maxDepth
+}
+
+func (options Options) validFileByExtension(path string) bool {
 	extensionIndex := strings.LastIndex(path, ".")
 	if extensionIndex > 0 {
 		extension := strings.ToLower(path[extensionIndex:])
-		return validFileExtensionsSet[extension]
+		return options.extensionSet[extension]
 	}
 	return false
 }
 
-func getListOfFiles(unknownPath string, recursive bool) ([]string, error) {
+// validFile is validFileByExtension, plus files without any extension that look like a picture with --extensionless.
+// Files with some other extension aren't opened, that would mean reading every video and document in the folder
+func (options Options) validFile(path string) bool {
+	if options.validFileByExtension(path) {
+		return true
+	}
+	if !options.extensionless || options.isPicture == nil || filepath.Ext(path) != "" {
+		return false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, headerSize)
+	read, _ := io.ReadFull(file, header)
+	return options.isPicture(header[:read])
+}
+
+// walkLink walks a symlinked directory as if it was at linkPath, WalkDir won't go through links on its own
+func walkLink(linkPath string, walk fs.WalkDirFunc) error {
+	target, err := filepath.EvalSymlinks(linkPath)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(target, func(path string, d fs.DirEntry, err error) error {
+		return walk(linkPath+path[len(target):], d, err)
+	})
+}
+
+// a symlink whose target is gone is worth hearing about, it's usually a moved or unplugged drive
+func resolveSymlink(path string) (fs.FileInfo, bool) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		fmt.Println("WARNING: Broken symlink", path, ". Skipping for now - error: ", err.Error())
+		return nil, false
+	}
+	return fileInfo, true
+}
+
+func getListOfFiles(unknownPath string, recursive bool, options Options) ([]string, error) {
 	path, _ := filepath.Abs(unknownPath)
+	return getListOfFilesUnder(path, path, recursive, options)
+}
+
+// getListOfFilesUnder lists path as if it was reached by walking from rootPath, so --max-depth, --include/--exclude,
+// and the .rayimgignore files in between all count from rootPath. The watcher uses it for directories that show up
+// while it's running
+func getListOfFilesUnder(rootPath string, path string, recursive bool, options Options) ([]string, error) {
 	var listOfFiles = []string{}
 
 	fileInfo, err := os.Stat(path)
@@ -34,8 +167,74 @@ func getListOfFiles(unknownPath string, recursive bool) ([]string, error) {
 		return nil, errors.New("Unable to open path: " + path + "\n" + err.Error())
 	}
 
-	customwalk := func(path string, d fs.DirEntry, err error) error {
-		if !d.IsDir() && validFileByExtension(path) {
+	// the rules for what's in the directory path is in, path's own .rayimgignore gets added on top
+	startPath := path
+	startFilter := options.newFileFilter(rootPath)
+	if startPath != rootPath {
+		startFilter = options.filterFor(rootPath, filepath.Dir(startPath))
+		if startFilter == nil {
+			return listOfFiles, nil
+		}
+	}
+	// each directory gets its parent's rules plus whatever is in its own .rayimgignore
+	filters := make(map[string]*fileFilter)
+	// with --follow-symlinks, the same directory or file can be reached more than once (or forever, for a link to a parent)
+	seen := make(map[fileID]bool)
+	alreadySeen := func(fileInfo fs.FileInfo, path string) bool {
+		if !options.followSymlinks {
+			return false
+		}
+		id := getFileID(fileInfo, path)
+		if seen[id] {
+			return true
+		}
+		seen[id] = true
+		return false
+	}
+
+	var customwalk fs.WalkDirFunc
+	customwalk = func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if options.followSymlinks && d.Type()&fs.ModeSymlink != 0 {
+			fileInfo, ok := resolveSymlink(path)
+			if !ok {
+				return nil
+			}
+			if fileInfo.IsDir() {
+				if !filters[filepath.Dir(path)].skip(path, true) {
+					walkLink(path, customwalk)
+				}
+				return nil
+			}
+		}
+		if d.IsDir() {
+			parentFilter := startFilter
+			if path != startPath {
+				parentFilter = filters[filepath.Dir(path)]
+				if parentFilter.skip(path, true) || options.tooDeep(rootPath, path) {
+					return filepath.SkipDir
+				}
+			}
+			if fileInfo, err := os.Stat(path); err == nil && alreadySeen(fileInfo, path) {
+				return filepath.SkipDir
+			}
+			filters[path] = parentFilter.withIgnoreFile(path)
+			return nil
+		}
+		filter := filters[filepath.Dir(path)]
+		// archives found along the way are walked into like any other directory
+		if archive.IsArchive(path) {
+			if !filter.skip(path, true) {
+				listOfFiles = append(listOfFiles, getListOfArchiveFiles(path, filter, options)...)
+			}
+			return nil
+		}
+		if options.validFile(path) && !filter.skip(path, false) {
+			if fileInfo, err := os.Stat(path); err == nil && alreadySeen(fileInfo, path) {
+				return nil
+			}
 			listOfFiles = append(listOfFiles, path)
 		}
 		return nil
@@ -49,19 +248,32 @@ func getListOfFiles(unknownPath string, recursive bool) ([]string, error) {
 			if err != nil {
 				return nil, errors.New("Can't read the directory: " + path + "\n" + err.Error())
 			}
+			filter := startFilter.withIgnoreFile(path)
 			for _, file := range files {
-				if !file.IsDir() && validFileByExtension(file.Name()) {
-					listOfFiles = append(listOfFiles, filepath.Join(path, file.Name()))
+				filePath := filepath.Join(path, file.Name())
+				if file.IsDir() || !options.validFile(filePath) || filter.skip(filePath, false) {
+					continue
 				}
+				if options.followSymlinks {
+					fileInfo, ok := resolveSymlink(filePath)
+					if !ok || fileInfo.IsDir() || alreadySeen(fileInfo, filePath) {
+						continue
+					}
+				}
+				listOfFiles = append(listOfFiles, filePath)
 			}
 		}
+	} else if archive.IsArchive(path) {
+		listOfFiles = getListOfArchiveFiles(path, startFilter, options)
+		if len(listOfFiles) == 0 {
+			fmt.Println("WARNING: No pictures found in archive", path)
+		}
 	} else {
 		if recursive {
-			return nil, errors.New("Can only use --recursive when the path is a directory")
+			return nil, errors.New("Can only use --recursive when the path is a directory or an archive")
 		}
 
-		validFileExtension := validFileByExtension(path)
-		if validFileExtension {
+		if options.validFile(path) {
 			listOfFiles = append(listOfFiles, path)
 		}
 	}
@@ -69,6 +281,25 @@ func getListOfFiles(unknownPath string, recursive bool) ([]string, error) {
 	return listOfFiles, nil
 }
 
+// archive entries get paths as if the archive was a directory, ie: /photos/album.zip/2024/beach.jpg
+// archives are always read all the way through, and .rayimgignore files inside of them aren't looked at
+func getListOfArchiveFiles(archivePath string, filter *fileFilter, options Options) []string {
+	listOfFiles := []string{}
+	entries, err := archive.List(archivePath)
+	if err != nil {
+		fmt.Println("WARNING: Unable to read archive", archivePath, ". Skipping for now - error: ", err.Error())
+		return listOfFiles
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(archivePath, filepath.FromSlash(entry))
+		if options.validFileByExtension(path) && !filter.skipArchiveEntry(archivePath, path) {
+			listOfFiles = append(listOfFiles, path)
+		}
+	}
+	return listOfFiles
+}
+
 func sortListOfFiles(sortBy string, files []string) {
 	switch sortBy {
 
@@ -80,53 +311,128 @@ func sortListOfFiles(sortBy string, files []string) {
 	case "natural":
 		Sort(files)
 
-	case "random":
+	case "random", "shuffle":
 		for i := range files {
 			j := rand.Intn(i + 1)
 			files[i], files[j] = files[j], files[i]
 		}
+
+	case "date-taken", "date-taken-reverse", "modified", "modified-reverse":
+		start := time.Now()
+		loadFileTimes(sortBy, files)
+		fmt.Println("Time to read file dates: ", time.Now().Sub(start))
+		less := lessByTime(sortBy)
+		sort.SliceStable(files, func(i, j int) bool {
+			return less(files[i], files[j])
+		})
 	}
 
 }
 
-func LoadFiles(arguments arguments.Arguments) ([]string, error) {
-	for _, fileExtension := range validFileExtensions {
-		validFileExtensionsSet[fileExtension] = true
+// NeighbourIndex is where path would go in an already sorted list, for finding what came after a file that's gone.
+// Only the sorts that can place a file from its name alone can answer this
+func NeighbourIndex(sortBy string, files []string, path string) (int, bool) {
+	switch sortBy {
+
+	case "filename":
+		return sort.SearchStrings(files, path), true
+
+	case "natural":
+		return sort.Search(len(files), func(i int) bool {
+			return Compare(path, files[i])
+		}), true
+	}
+
+	return 0, false
+}
+
+// InsertSorted adds a file that showed up after startup to an already sorted list
+// returns the new list and where the file ended up
+func InsertSorted(sortBy string, files []string, path string) ([]string, int) {
+	var index int
+	switch sortBy {
+
+	case "filename", "natural":
+		index, _ = NeighbourIndex(sortBy, files, path)
+
+	case "random", "shuffle":
+		index = rand.Intn(len(files) + 1)
+
+	case "date-taken", "date-taken-reverse", "modified", "modified-reverse":
+		less := lessByTime(sortBy)
+		index = sort.Search(len(files), func(i int) bool {
+			return less(path, files[i])
+		})
 	}
 
+	return slices.Insert(files, index, path), index
+}
+
+// LoadFiles returns the pictures sorted by --sort, then the pictures from any playlists that were passed in (already in the
+// order they should be shown) and their per picture settings. They're kept apart since only the sorted ones can be searched
+func LoadFiles(arguments arguments.Arguments, options Options) ([]string, []string, map[string]SlideOverrides, error) {
 	listOfFiles := []string{}
+	playlistFiles := []string{}
+	slideOverrides := make(map[string]SlideOverrides)
 	if len(arguments.Path) == 0 {
 		workingDirectory, err := os.Getwd()
 		if err != nil {
-			return nil, errors.New("Unable to get the current working directory. You should specify a working directory at the end of your cli arguments. See rayimg -h for more info. Error: " + err.Error())
+			return nil, nil, nil, errors.New("Unable to get the current working directory. You should specify a working directory at the end of your cli arguments. See rayimg -h for more info. Error: " + err.Error())
 		}
-		listOfFiles, err = getListOfFiles(workingDirectory, arguments.Recursive)
+		listOfFiles, err = getListOfFiles(workingDirectory, arguments.Recursive, options)
 		if err != nil {
-			return nil, errors.New(err.Error())
+			return nil, nil, nil, errors.New(err.Error())
 		}
 	} else {
 		for _, path := range arguments.Path {
-			moreFiles, err := getListOfFiles(path, arguments.Recursive)
+			if isHttpSource(path) {
+				source, err := options.httpSource(path, arguments)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				moreFiles, err := source.load()
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				listOfFiles = append(listOfFiles, moreFiles...)
+				continue
+			}
+
+			if isPlaylist(path) {
+				moreFiles, moreOverrides, err := loadPlaylist(path, options)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				playlistFiles = append(playlistFiles, moreFiles...)
+				for file, overrides := range moreOverrides {
+					if _, exists := slideOverrides[file]; !exists {
+						slideOverrides[file] = overrides
+					}
+				}
+				continue
+			}
+
+			moreFiles, err := getListOfFiles(path, arguments.Recursive, options)
 			if err != nil {
-				return nil, errors.New(err.Error())
+				return nil, nil, nil, errors.New(err.Error())
 			}
 			listOfFiles = append(listOfFiles, moreFiles...)
 		}
 	}
 
-	if len(listOfFiles) == 0 {
-		return nil, errors.New("Could not find any files with the following formats: " + strings.Join(validFileExtensions, ", "))
+	if len(listOfFiles) == 0 && len(playlistFiles) == 0 {
+		return nil, nil, nil, errors.New("Could not find any files with the following formats: " + strings.Join(options.extensions, ", "))
 	}
 
-	fmt.Println("Found pictures to display: ", len(listOfFiles))
+	fmt.Println("Found pictures to display: ", len(listOfFiles)+len(playlistFiles))
 
 	sortListOfFiles(arguments.Sort, listOfFiles)
 
 	if arguments.ListFiles {
-		for _, filepath := range listOfFiles {
+		for _, filepath := range slices.Concat(listOfFiles, playlistFiles) {
 			fmt.Println(filepath)
 		}
 	}
 
-	return listOfFiles, nil
+	return listOfFiles, playlistFiles, slideOverrides, nil
 }
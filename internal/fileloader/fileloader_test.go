@@ -0,0 +1,139 @@
+package fileloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// imageloader's decoders decide these in rayimg, it can't be imported here without cgo
+var testExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic", ".tif"}
+
+func testOptions() Options {
+	return Options{extensions: testExtensions, extensionSet: newExtensionSet(testExtensions)}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	options := testOptions()
+	options.followSymlinks = true
+
+	directory := t.TempDir()
+	archiveDirectory := filepath.Join(directory, "archive", "2024-06-01")
+	library := filepath.Join(directory, "library")
+	os.MkdirAll(archiveDirectory, 0755)
+	os.MkdirAll(library, 0755)
+	os.WriteFile(filepath.Join(archiveDirectory, "beach.jpg"), []byte("picture"), 0644)
+	os.WriteFile(filepath.Join(library, "cat.jpg"), []byte("picture"), 0644)
+
+	// the same folder twice, a link back up to the library, a link to a single file, and a broken link
+	os.Symlink(archiveDirectory, filepath.Join(library, "holiday"))
+	os.Symlink(archiveDirectory, filepath.Join(library, "summer"))
+	os.Symlink(library, filepath.Join(library, "holiday-loop"))
+	os.Symlink(filepath.Join(library, "cat.jpg"), filepath.Join(library, "favourite.jpg"))
+	os.Symlink(filepath.Join(directory, "gone"), filepath.Join(library, "unplugged"))
+
+	listOfFiles, err := getListOfFiles(library, true, options)
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+	expected := []string{
+		filepath.Join(library, "cat.jpg"),
+		filepath.Join(library, "holiday", "beach.jpg"),
+	}
+	if !slices.Equal(listOfFiles, expected) {
+		t.Errorf("Expected %v, got %v", expected, listOfFiles)
+	}
+
+	listOfFiles, err = getListOfFiles(library, false, options)
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+	if !slices.Equal(listOfFiles, []string{filepath.Join(library, "cat.jpg")}) {
+		t.Errorf("Expected only cat.jpg without recursing, got %v", listOfFiles)
+	}
+}
+
+func TestFolderSettings(t *testing.T) {
+	directory := t.TempDir()
+	art := filepath.Join(directory, "Art")
+	sketches := filepath.Join(art, "sketches")
+	os.MkdirAll(sketches, 0755)
+	os.WriteFile(filepath.Join(directory, "slide_settings.ini"), []byte("Duration = 5\nSort = \"natural\"\n"), 0644)
+	os.WriteFile(filepath.Join(art, "slide_settings.ini"), []byte("Duration = 30\nDisplay = \"caption\"\n"), 0644)
+	os.WriteFile(filepath.Join(sketches, "slide_settings.ini"), []byte("TransitionDuration = 2\n"), 0644)
+
+	options := testOptions()
+	options.settingsRoots = getSettingsRoots([]string{directory})
+	options.folderSettingsCache = make(folderSettingsCache)
+
+	// the top level ini is already loaded for everything by arguments.LoadIniFile
+	if settings := options.FolderSettings(filepath.Join(directory, "cat.jpg")); settings.Duration != nil || settings.Display != nil {
+		t.Errorf("Expected no folder settings at the top, got %+v", settings)
+	}
+
+	settings := options.FolderSettings(filepath.Join(sketches, "owl.jpg"))
+	if settings.Duration == nil || *settings.Duration != 30 || settings.Display == nil || *settings.Display != "caption" || settings.TransitionDuration == nil || *settings.TransitionDuration != 2 {
+		t.Errorf("Expected Duration 30, Display caption, and TransitionDuration 2 for sketches, got %+v", settings)
+	}
+	// each ini is only read once
+	os.WriteFile(filepath.Join(sketches, "slide_settings.ini"), []byte("TransitionDuration = 7\n"), 0644)
+	if settings := options.FolderSettings(filepath.Join(sketches, "owl.jpg")); settings.TransitionDuration == nil || *settings.TransitionDuration != 2 {
+		t.Errorf("Expected the folder settings to be read once, got %+v", settings)
+	}
+
+	// with more than one directory, their own ini files only apply to what's in them
+	options.settingsRoots = getSettingsRoots([]string{directory, t.TempDir()})
+	settings = options.FolderSettings(filepath.Join(directory, "cat.jpg"))
+	if settings.Duration == nil || *settings.Duration != 5 {
+		t.Errorf("Expected Duration 5 from the top level ini, got %+v", settings)
+	}
+
+	options.maxDepth = 1
+	if !options.skipPath(directory, filepath.Join(sketches, "owl.jpg"), false) || options.skipPath(directory, filepath.Join(art, "painting.jpg"), false) {
+		t.Error("Expected only pictures more than one folder deep to be skipped with a max depth of 1")
+	}
+}
+
+func TestFindsGifs(t *testing.T) {
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "dancing.gif"), []byte("picture"), 0644)
+	os.WriteFile(filepath.Join(directory, "notes.txt"), []byte("not a picture"), 0644)
+
+	listOfFiles, err := getListOfFiles(directory, false, testOptions())
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+	if !slices.Equal(listOfFiles, []string{filepath.Join(directory, "dancing.gif")}) {
+		t.Errorf("Expected only dancing.gif, got %v", listOfFiles)
+	}
+}
+
+func TestExtensionless(t *testing.T) {
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "IMG_0001"), []byte("\xFF\xD8\xFFpicture"), 0644)
+	os.WriteFile(filepath.Join(directory, "README"), []byte("not a picture"), 0644)
+	os.WriteFile(filepath.Join(directory, "backup.bak"), []byte("\xFF\xD8\xFFpicture"), 0644)
+
+	listOfFiles, err := getListOfFiles(directory, false, testOptions())
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+	if len(listOfFiles) != 0 {
+		t.Errorf("Expected files without an extension to be skipped by default, got %v", listOfFiles)
+	}
+
+	options := testOptions()
+	options.extensionless = true
+	options.isPicture = func(header []byte) bool {
+		return bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF})
+	}
+	listOfFiles, err = getListOfFiles(directory, false, options)
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+	if !slices.Equal(listOfFiles, []string{filepath.Join(directory, "IMG_0001")}) {
+		t.Errorf("Expected only IMG_0001, got %v", listOfFiles)
+	}
+}
@@ -0,0 +1,102 @@
+package fileloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JarvyJ/rayimg/internal/arguments"
+)
+
+// a directory passed in on the commandline (or the working directory)
+type settingsRoot struct {
+	path string
+	// a single directory's own slide_settings.ini is already loaded for everything by arguments.LoadIniFile
+	includeOwnSettings bool
+}
+
+// by directory, every slide_settings.ini only gets read once
+type folderSettingsCache map[string]arguments.FolderSettings
+
+func getSettingsRoots(paths []string) []settingsRoot {
+	settingsRoots := []settingsRoot{}
+	if len(paths) == 0 {
+		if workingDirectory, err := os.Getwd(); err == nil {
+			settingsRoots = append(settingsRoots, settingsRoot{path: workingDirectory})
+		}
+		return settingsRoots
+	}
+
+	for _, path := range paths {
+		if isHttpSource(path) {
+			continue
+		}
+		absPath, _ := filepath.Abs(path)
+		if fileInfo, err := os.Stat(absPath); err == nil && fileInfo.IsDir() {
+			settingsRoots = append(settingsRoots, settingsRoot{path: absPath, includeOwnSettings: len(paths) > 1})
+		}
+	}
+	return settingsRoots
+}
+
+func (options Options) loadFolderSettings(directory string) arguments.FolderSettings {
+	if folderSettings, ok := options.folderSettingsCache[directory]; ok {
+		return folderSettings
+	}
+	folderSettings, err := arguments.LoadFolderSettings(directory)
+	if err != nil {
+		fmt.Println("WARNING: Ignoring folder settings - error: ", err.Error())
+	}
+	if options.folderSettingsCache != nil {
+		options.folderSettingsCache[directory] = folderSettings
+	}
+	return folderSettings
+}
+
+// FolderSettings layers the slide_settings.ini files from the top directory down to the one path is in,
+// so a sub folder only has to set what's different from the folder above it
+func (options Options) FolderSettings(path string) arguments.FolderSettings {
+	effectiveSettings := arguments.FolderSettings{}
+
+	root := settingsRoot{}
+	for _, settingsRoot := range options.settingsRoots {
+		if strings.HasPrefix(path, settingsRoot.path+string(filepath.Separator)) && len(settingsRoot.path) > len(root.path) {
+			root = settingsRoot
+		}
+	}
+	if root.path == "" {
+		return effectiveSettings
+	}
+
+	directories := []string{}
+	if root.includeOwnSettings {
+		directories = append(directories, root.path)
+	}
+	relative, err := filepath.Rel(root.path, filepath.Dir(path))
+	if err != nil {
+		return effectiveSettings
+	}
+	directory := root.path
+	for _, part := range strings.Split(relative, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		directory = filepath.Join(directory, part)
+		directories = append(directories, directory)
+	}
+
+	for _, directory := range directories {
+		folderSettings := options.loadFolderSettings(directory)
+		if folderSettings.Duration != nil {
+			effectiveSettings.Duration = folderSettings.Duration
+		}
+		if folderSettings.TransitionDuration != nil {
+			effectiveSettings.TransitionDuration = folderSettings.TransitionDuration
+		}
+		if folderSettings.Display != nil {
+			effectiveSettings.Display = folderSettings.Display
+		}
+	}
+	return effectiveSettings
+}
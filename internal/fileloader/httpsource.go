@@ -0,0 +1,466 @@
+package fileloader
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/arguments"
+)
+
+// downloads are mostly waiting on the network, a few at once keeps a NAS busy without hammering it
+const downloadWorkers = 4
+
+// a big picture on a slow connection can take longer than any fixed timeout, so it's how long the server can go
+// without sending anything instead
+const httpTimeout = 30 * time.Second
+
+// the last index that was read successfully, so the cached pictures can still be shown when the server is down
+const httpIndexFile = "index.json"
+
+var hrefRegex = regexp.MustCompile(`(?i)href\s*=\s*["']([^"']+)["']`)
+
+// httpSource mirrors the pictures listed at an index URL into a local folder, and everything else
+// (sorting, captions, the image cache) works off of the local copies.
+// The index can be an nginx/Apache autoindex page or a JSON list of picture URLs.
+// Only one sync runs at a time, LoadFiles and the watcher share the source and can both start one
+type httpSource struct {
+	indexURL       *url.URL
+	cacheDirectory string
+	maxCacheBytes  int64
+	maxFileSize    int64
+	recursive      bool
+	options        Options
+	client         *http.Client
+	syncMutex      sync.Mutex
+	// what load handed back, until the watcher picks it up as its starting point
+	shown  []string
+	loaded bool
+}
+
+func isHttpSource(path string) bool {
+	return arguments.IsUrl(path)
+}
+
+func newHttpSource(indexURL string, arguments arguments.Arguments, options Options) (*httpSource, error) {
+	parsedURL, err := url.Parse(indexURL)
+	if err != nil {
+		return nil, errors.New("Invalid URL: " + indexURL + "\n" + err.Error())
+	}
+
+	cacheDirectory, ok := os.LookupEnv("CACHE_DIR")
+	if !ok {
+		userCacheDirectory, err := os.UserCacheDir()
+		if err != nil {
+			return nil, errors.New("Unable to find a directory to download pictures from " + indexURL + " into. Try setting CACHE_DIR\n" + err.Error())
+		}
+		cacheDirectory = filepath.Join(userCacheDirectory, "rayimg")
+	}
+	hash := sha1.Sum([]byte(indexURL))
+
+	return &httpSource{
+		indexURL:       parsedURL,
+		cacheDirectory: filepath.Join(cacheDirectory, "downloads", hex.EncodeToString(hash[:6])),
+		maxCacheBytes:  int64(arguments.HttpCacheSize * 1024 * 1024),
+		maxFileSize:    int64(arguments.MaxFileSize * 1024 * 1024),
+		recursive:      arguments.Recursive,
+		options:        options,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: httpTimeout}).DialContext,
+			TLSHandshakeTimeout:   httpTimeout,
+			ResponseHeaderTimeout: httpTimeout,
+			IdleConnTimeout:       90 * time.Second,
+		}},
+	}, nil
+}
+
+// localPath mirrors the URL, so filenames (and sorting by them) look the same as on the server
+func (source *httpSource) localPath(pictureURL *url.URL) string {
+	host := strings.ReplaceAll(pictureURL.Host, ":", "_")
+	return filepath.Join(source.cacheDirectory, host, filepath.FromSlash(path.Clean("/"+pictureURL.Path)))
+}
+
+// --include/--exclude patterns are relative to the index, same as they would be for a local directory
+func (source *httpSource) skip(localPath string) bool {
+	rootURL := *source.indexURL
+	if !strings.HasSuffix(rootURL.Path, "/") {
+		rootURL.Path = path.Dir(rootURL.Path)
+	}
+	return source.options.skipPath(source.localPath(&rootURL), localPath, false)
+}
+
+// idleTimeoutBody cancels the request once the server hasn't sent anything for httpTimeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+func (body *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.timer.Reset(httpTimeout)
+	return n, err
+}
+
+func (body *idleTimeoutBody) Close() error {
+	body.timer.Stop()
+	body.cancel()
+	return body.ReadCloser.Close()
+}
+
+func (source *httpSource) get(pageURL *url.URL) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response, err := source.client.Do(request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		cancel()
+		return nil, errors.New("Server responded with " + response.Status + " for " + pageURL.String())
+	}
+	response.Body = &idleTimeoutBody{ReadCloser: response.Body, timer: time.AfterFunc(httpTimeout, cancel), cancel: cancel}
+	return response, nil
+}
+
+// parseIndex pulls the links out of an index page. directories only come from autoindex pages
+func parseIndex(pageURL *url.URL, contentType string, body []byte) (links []*url.URL, directories []*url.URL, err error) {
+	trimmedBody := strings.TrimSpace(string(body))
+	if strings.Contains(contentType, "json") || strings.HasPrefix(trimmedBody, "[") {
+		entries := []string{}
+		err := json.Unmarshal(body, &entries)
+		if err != nil {
+			return nil, nil, errors.New("Unable to parse the JSON list at " + pageURL.String() + ". It should be a list of URLs\n" + err.Error())
+		}
+		for _, entry := range entries {
+			link, err := pageURL.Parse(entry)
+			if err != nil {
+				fmt.Println("WARNING: Invalid URL in", pageURL.String(), ". Skipping for now: ", entry)
+				continue
+			}
+			links = append(links, link)
+		}
+		return links, nil, nil
+	}
+
+	for _, match := range hrefRegex.FindAllStringSubmatch(trimmedBody, -1) {
+		link, err := pageURL.Parse(match[1])
+		// only follow what's underneath the page, autoindex pages also link to the parent directory and column sorting
+		if err != nil || link.RawQuery != "" || link.Host != pageURL.Host || !strings.HasPrefix(link.Path, pageURL.Path) || link.Path == pageURL.Path {
+			continue
+		}
+		link.Fragment = ""
+		if strings.HasSuffix(link.Path, "/") {
+			directories = append(directories, link)
+		} else {
+			links = append(links, link)
+		}
+	}
+	return links, directories, nil
+}
+
+func (source *httpSource) readIndex() ([]*url.URL, error) {
+	links := []*url.URL{}
+	pages := []*url.URL{source.indexURL}
+	visited := make(map[string]bool)
+
+	for len(pages) > 0 {
+		page := pages[0]
+		pages = pages[1:]
+		if visited[page.String()] {
+			continue
+		}
+		visited[page.String()] = true
+
+		response, err := source.get(page)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		pageLinks, directories, err := parseIndex(page, response.Header.Get("Content-Type"), body)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, pageLinks...)
+		if source.recursive {
+			pages = append(pages, directories...)
+		}
+	}
+	return links, nil
+}
+
+func (source *httpSource) tooBig(pictureURL *url.URL, size int64) error {
+	return errors.New(pictureURL.String() + " is " + strconv.FormatInt(size, 10) + " bytes or more, which is over --max-file-size")
+}
+
+// download writes to a temporary file first, so a dropped connection never leaves half a picture in the cache.
+// Anything over --max-file-size is stopped, going off of Content-Length when the server sends it
+func (source *httpSource) download(pictureURL *url.URL, localPath string) (int64, error) {
+	response, err := source.get(pictureURL)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if source.maxFileSize > 0 && response.ContentLength > source.maxFileSize {
+		return 0, source.tooBig(pictureURL, response.ContentLength)
+	}
+	body := io.Reader(response.Body)
+	if source.maxFileSize > 0 {
+		body = io.LimitReader(response.Body, source.maxFileSize+1)
+	}
+
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return 0, err
+	}
+	temporaryFile := localPath + ".download"
+	file, err := os.Create(temporaryFile)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(file, body)
+	file.Close()
+	if err == nil && source.maxFileSize > 0 && size > source.maxFileSize {
+		err = source.tooBig(pictureURL, size)
+	}
+	if err != nil {
+		os.Remove(temporaryFile)
+		return 0, err
+	}
+
+	// keeps --sort modified meaning when it was modified on the server
+	if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(temporaryFile, lastModified, lastModified)
+	}
+	return size, os.Rename(temporaryFile, localPath)
+}
+
+func (source *httpSource) pictureFiles(links []string) []string {
+	listOfFiles := []string{}
+	for _, link := range links {
+		pictureURL, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		localPath := source.localPath(pictureURL)
+		if !source.options.validFileByExtension(localPath) || source.skip(localPath) {
+			continue
+		}
+		if _, err := os.Stat(localPath); err == nil {
+			listOfFiles = append(listOfFiles, localPath)
+		}
+	}
+	return listOfFiles
+}
+
+// offline, whatever was downloaded from the last index that was read keeps getting shown
+func (source *httpSource) cachedFiles() ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(source.cacheDirectory, httpIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	links := []string{}
+	err = json.Unmarshal(data, &links)
+	if err != nil {
+		return nil, err
+	}
+	return source.pictureFiles(links), nil
+}
+
+// load returns what was downloaded before right away, and checks the index for anything new in the background.
+// With --watch those show up once they're downloaded, otherwise the next time rayimg starts.
+// The first time there's nothing to show yet, so that waits on the downloads
+func (source *httpSource) load() ([]string, error) {
+	listOfFiles, err := source.cachedFiles()
+	if err != nil || len(listOfFiles) == 0 {
+		listOfFiles, err = source.sync()
+	} else {
+		fmt.Println("Showing the", len(listOfFiles), "pictures downloaded before from", source.indexURL.String(), "while checking for new ones")
+		go func() {
+			if _, err := source.sync(); err != nil {
+				fmt.Println("WARNING:", err.Error())
+			}
+		}()
+	}
+	if err != nil {
+		return nil, err
+	}
+	source.shown = listOfFiles
+	source.loaded = true
+	return listOfFiles, nil
+}
+
+// list is what the watcher polls. The first time it's what load returned, so whatever was still downloading
+// gets added to the slideshow once it's done
+func (source *httpSource) list() ([]string, error) {
+	if source.loaded {
+		source.loaded = false
+		shown := source.shown
+		source.shown = nil
+		return shown, nil
+	}
+	return source.sync()
+}
+
+// sync downloads anything new from the index (up to the cache size, in index order), removes anything the server
+// no longer lists, and returns the local copies of the pictures
+func (source *httpSource) sync() ([]string, error) {
+	source.syncMutex.Lock()
+	defer source.syncMutex.Unlock()
+
+	links, err := source.readIndex()
+	if err != nil {
+		listOfFiles, cacheErr := source.cachedFiles()
+		if cacheErr != nil {
+			return nil, errors.New("Unable to load pictures from " + source.indexURL.String() + "\n" + err.Error())
+		}
+		fmt.Println("WARNING: Unable to reach", source.indexURL.String(), ". Showing the", len(listOfFiles), "pictures downloaded before - error: ", err.Error())
+		return listOfFiles, nil
+	}
+
+	// pictures and their captions are downloaded, anything else on the page isn't
+	wanted := []*url.URL{}
+	wantedPaths := make(map[string]bool)
+	for _, link := range links {
+		localPath := source.localPath(link)
+		picturePath := strings.TrimSuffix(localPath, ".txt")
+		if wantedPaths[localPath] || !source.options.validFileByExtension(picturePath) || source.skip(picturePath) {
+			continue
+		}
+		wanted = append(wanted, link)
+		wantedPaths[localPath] = true
+	}
+
+	source.removeUnlisted(wantedPaths)
+
+	var used int64
+	cacheFull := false
+	missing := []*url.URL{}
+	for _, link := range wanted {
+		fileInfo, err := os.Stat(source.localPath(link))
+		if err != nil {
+			missing = append(missing, link)
+			continue
+		}
+		// the cache size went down since the last run
+		if used+fileInfo.Size() > source.maxCacheBytes {
+			os.Remove(source.localPath(link))
+			cacheFull = true
+			continue
+		}
+		used += fileInfo.Size()
+	}
+
+	source.downloadMissing(missing, used, cacheFull)
+
+	wantedLinks := []string{}
+	for _, link := range wanted {
+		wantedLinks = append(wantedLinks, link.String())
+	}
+	data, err := json.Marshal(wantedLinks)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(source.cacheDirectory, httpIndexFile), data, 0644)
+	}
+	if err != nil {
+		fmt.Println("WARNING: Unable to save the index for", source.indexURL.String(), "- error: ", err.Error())
+	}
+
+	return source.pictureFiles(wantedLinks), nil
+}
+
+func (source *httpSource) removeUnlisted(wantedPaths map[string]bool) {
+	filepath.WalkDir(source.cacheDirectory, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Dir(path) == source.cacheDirectory {
+			return nil
+		}
+		if !wantedPaths[path] {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func (source *httpSource) downloadMissing(missing []*url.URL, used int64, cacheFull bool) {
+	if len(missing) == 0 {
+		return
+	}
+	if !cacheFull {
+		fmt.Println("Downloading", len(missing), "files from", source.indexURL.String())
+	}
+
+	var mutex sync.Mutex
+	skipped := 0
+
+	jobs := make(chan *url.URL)
+	var waitGroup sync.WaitGroup
+	for range downloadWorkers {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for link := range jobs {
+				mutex.Lock()
+				full := cacheFull
+				if full {
+					skipped++
+				}
+				mutex.Unlock()
+				if full {
+					continue
+				}
+
+				localPath := source.localPath(link)
+				size, err := source.download(link, localPath)
+				if err != nil {
+					fmt.Println("WARNING: Unable to download", link.String(), ". Skipping for now - error: ", err.Error())
+					continue
+				}
+
+				mutex.Lock()
+				if used+size > source.maxCacheBytes {
+					os.Remove(localPath)
+					cacheFull = true
+					skipped++
+				} else {
+					used += size
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, link := range missing {
+		jobs <- link
+	}
+	close(jobs)
+	waitGroup.Wait()
+
+	if skipped > 0 {
+		fmt.Println("WARNING: Download cache for", source.indexURL.String(), "is full, skipped", skipped, "files. It can be raised with --http-cache-size (currently "+strconv.FormatFloat(float64(source.maxCacheBytes)/1024/1024, 'g', -1, 64)+" MB)")
+	}
+}
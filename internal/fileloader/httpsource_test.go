@@ -0,0 +1,127 @@
+package fileloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/JarvyJ/rayimg/internal/arguments"
+)
+
+func TestHttpSource(t *testing.T) {
+	t.Setenv("CACHE_DIR", t.TempDir())
+
+	pages := map[string]string{
+		"/photos/": `<html><body><h1>Index of /photos/</h1>
+			<a href="../">../</a>
+			<a href="?C=M;O=A">Last modified</a>
+			<a href="beach.jpg">beach.jpg</a>
+			<a href="beach.jpg.txt">beach.jpg.txt</a>
+			<a href="notes.pdf">notes.pdf</a>
+			<a href="huge.jpg">huge.jpg</a>
+			<a href="2024/">2024/</a>
+			</body></html>`,
+		"/photos/2024/":             `<a href="../">../</a><a href="/photos/2024/mountain.png">mountain.png</a>`,
+		"/photos/beach.jpg":         strings.Repeat("b", 600),
+		"/photos/beach.jpg.txt":     "At the beach",
+		"/photos/notes.pdf":         "not a picture",
+		"/photos/huge.jpg":          strings.Repeat("h", 2*1024*1024),
+		"/photos/2024/mountain.png": strings.Repeat("m", 600),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".json") {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	settings := arguments.Arguments{IniSettings: arguments.IniSettings{HttpCacheSize: 1, MaxFileSize: 1, Recursive: true}}
+	source, err := newHttpSource(server.URL+"/photos/", settings, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listOfFiles, err := source.sync()
+	if err != nil {
+		t.Fatalf("Not able to sync: %s", err.Error())
+	}
+	names := []string{}
+	for _, file := range listOfFiles {
+		names = append(names, filepath.Base(file))
+	}
+	if !slices.Equal(names, []string{"beach.jpg", "mountain.png"}) {
+		t.Errorf("Expected beach.jpg and mountain.png to be downloaded, and huge.jpg to be over --max-file-size, got %v", listOfFiles)
+	}
+	if caption, err := os.ReadFile(listOfFiles[0] + ".txt"); err != nil || string(caption) != "At the beach" {
+		t.Errorf("Expected the caption to be downloaded next to the picture, got %q (%v)", caption, err)
+	}
+
+	// only one picture fits
+	source.maxCacheBytes = 700
+	listOfFiles, err = source.sync()
+	if err != nil || len(listOfFiles) != 1 {
+		t.Errorf("Expected only one picture to fit in the cache, got %v (%v)", listOfFiles, err)
+	}
+
+	// removed from the server, removed from the cache
+	delete(pages, "/photos/beach.jpg")
+	pages["/photos/"] = `<a href="2024/">2024/</a>`
+	source.maxCacheBytes = 1024 * 1024
+	listOfFiles, err = source.sync()
+	if err != nil || len(listOfFiles) != 1 || filepath.Base(listOfFiles[0]) != "mountain.png" {
+		t.Errorf("Expected only mountain.png after beach.jpg was removed, got %v (%v)", listOfFiles, err)
+	}
+
+	// the pictures from before are shown right away, and the new one gets picked up by the watcher once it's downloaded
+	pages["/photos/"] = `<a href="2024/">2024/</a><a href="sunset.jpg">sunset.jpg</a>`
+	pages["/photos/sunset.jpg"] = strings.Repeat("s", 600)
+	restarted, _ := newHttpSource(server.URL+"/photos/", settings, testOptions())
+	shown, err := restarted.load()
+	if err != nil || !slices.Equal(shown, listOfFiles) {
+		t.Errorf("Expected %v to be shown while checking for new pictures, got %v (%v)", listOfFiles, shown, err)
+	}
+	if watched, _ := restarted.list(); !slices.Equal(watched, shown) {
+		t.Errorf("Expected the watcher to start from %v, got %v", shown, watched)
+	}
+	listOfFiles, err = restarted.list()
+	if err != nil || len(listOfFiles) != 2 || filepath.Base(listOfFiles[0]) != "sunset.jpg" {
+		t.Errorf("Expected sunset.jpg to be downloaded in the background, got %v (%v)", listOfFiles, err)
+	}
+
+	// server is gone, but the downloaded pictures are still there
+	server.Close()
+	offlineFiles, err := source.sync()
+	if err != nil || !slices.Equal(offlineFiles, listOfFiles) {
+		t.Errorf("Expected %v while the server is down, got %v (%v)", listOfFiles, offlineFiles, err)
+	}
+}
+
+func TestParseJsonIndex(t *testing.T) {
+	source, _ := newHttpSource("http://nas.local/lists/feed.json", arguments.Arguments{}, testOptions())
+	links, directories, err := parseIndex(source.indexURL, "application/json", []byte(`["a.jpg", "/photos/b.png", "https://cdn.example.com/c.webp"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"http://nas.local/lists/a.jpg", "http://nas.local/photos/b.png", "https://cdn.example.com/c.webp"}
+	for i, link := range links {
+		if link.String() != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], link.String())
+		}
+	}
+	if len(links) != len(expected) || len(directories) != 0 {
+		t.Errorf("Expected %d links and no directories, got %v and %v", len(expected), links, directories)
+	}
+
+	if _, _, err := parseIndex(source.indexURL, "application/json", []byte(`{"not": "a list"}`)); err == nil {
+		t.Error("Expected an error for JSON that isn't a list")
+	}
+}
@@ -0,0 +1,233 @@
+package fileloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const ignoreFilename = ".rayimgignore"
+
+// junk that ends up on USB sticks and in zip files: macOS resource forks, Synology thumbnails and Lightroom previews
+// a .rayimgignore can still bring any of them back with a "!" pattern. Hidden folders are left alone, --exclude '.*/' skips them
+var defaultExcludePatterns = []string{"._*", "@eaDir/", "*.lrdata/", "__MACOSX/"}
+
+// a single gitignore style pattern
+type ignoreRule struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// patterns with a "/" in them are relative to base, otherwise they match the name at any depth
+	anchored bool
+	base     string
+}
+
+func globToRegex(glob string) string {
+	var builder strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			builder.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "/**":
+			builder.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			builder.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			builder.WriteString("[^/]*")
+		case glob[i] == '?':
+			builder.WriteString("[^/]")
+		case glob[i] == '[' && strings.Contains(glob[i+1:], "]"):
+			end := i + 1 + strings.Index(glob[i+1:], "]")
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			builder.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i = end
+		case glob[i] == '\\' && i+1 < len(glob):
+			builder.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+		default:
+			builder.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return builder.String()
+}
+
+// returns false for blank lines and comments
+func parseIgnoreRule(pattern string, base string) (ignoreRule, bool, error) {
+	pattern = strings.TrimRight(pattern, " \r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		rule.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+
+	regex, err := regexp.Compile("^" + globToRegex(pattern) + "$")
+	if err != nil {
+		return ignoreRule{}, false, err
+	}
+	rule.regex = regex
+	return rule, true, nil
+}
+
+func (rule ignoreRule) matches(path string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if !rule.anchored {
+		return rule.regex.MatchString(filepath.Base(path))
+	}
+
+	relative, err := filepath.Rel(rule.base, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return rule.regex.MatchString(filepath.ToSlash(relative))
+}
+
+func validatePatterns(flagName string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, _, err := parseIgnoreRule(pattern, ""); err != nil {
+			return errors.New("Invalid " + flagName + " pattern: " + pattern + "\n" + err.Error())
+		}
+	}
+	return nil
+}
+
+type fileFilter struct {
+	include []ignoreRule
+	// later rules win, so a .rayimgignore deeper down can undo one from further up
+	exclude []ignoreRule
+}
+
+func compileRules(patterns []string, base string) []ignoreRule {
+	rules := []ignoreRule{}
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnoreRule(pattern, base)
+		if err != nil {
+			fmt.Println("WARNING: Invalid pattern", pattern, "- error: ", err.Error())
+			continue
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// the --include/--exclude patterns are relative to each path passed in
+func (options Options) newFileFilter(root string) *fileFilter {
+	return &fileFilter{
+		include: compileRules(options.includePatterns, root),
+		exclude: compileRules(append(slices.Clone(defaultExcludePatterns), options.excludePatterns...), root),
+	}
+}
+
+func (filter *fileFilter) withIgnoreFile(directory string) *fileFilter {
+	data, err := os.ReadFile(filepath.Join(directory, ignoreFilename))
+	if err != nil {
+		return filter
+	}
+
+	rules := compileRules(strings.Split(string(data), "\n"), directory)
+	return &fileFilter{
+		include: filter.include,
+		exclude: append(slices.Clip(filter.exclude), rules...),
+	}
+}
+
+func (filter *fileFilter) skip(path string, isDir bool) bool {
+	excluded := false
+	for _, rule := range filter.exclude {
+		if rule.matches(path, isDir) {
+			excluded = !rule.negate
+		}
+	}
+	if excluded || isDir || len(filter.include) == 0 {
+		return excluded
+	}
+
+	for _, rule := range filter.include {
+		if rule.matches(path, isDir) {
+			return rule.negate
+		}
+	}
+	return true
+}
+
+// archives don't have directory entries to walk through, so each directory in between gets checked here instead
+func (filter *fileFilter) skipArchiveEntry(archivePath string, path string) bool {
+	relative, err := filepath.Rel(archivePath, path)
+	if err != nil {
+		return false
+	}
+
+	directory := archivePath
+	for _, part := range strings.Split(filepath.Dir(relative), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		directory = filepath.Join(directory, part)
+		if filter.skip(directory, true) {
+			return true
+		}
+	}
+	return filter.skip(path, false)
+}
+
+// skipPath works out the rules for one path without a walk to build them up along the way,
+// any excluded directory between root and path means path is skipped too (as does being past --max-depth)
+func (options Options) skipPath(root string, path string, isDir bool) bool {
+	relative, err := filepath.Rel(root, path)
+	if err != nil || relative == "." {
+		return false
+	}
+	if (isDir && options.tooDeep(root, path)) || (!isDir && options.tooDeep(root, filepath.Dir(path))) {
+		return true
+	}
+
+	filter := options.filterFor(root, filepath.Dir(path))
+	return filter == nil || filter.skip(path, isDir)
+}
+
+// filterFor builds up the rules for what's directly in directory, the same way a walk from root would.
+// It's nil when directory (or one between it and root) is excluded
+func (options Options) filterFor(root string, directory string) *fileFilter {
+	relative, err := filepath.Rel(root, directory)
+	if err != nil {
+		return nil
+	}
+	filter := options.newFileFilter(root).withIgnoreFile(root)
+	current := root
+	for _, part := range strings.Split(relative, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		if filter.skip(current, true) {
+			return nil
+		}
+		filter = filter.withIgnoreFile(current)
+	}
+	return filter
+}
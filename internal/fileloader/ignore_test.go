@@ -0,0 +1,78 @@
+package fileloader
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	options := testOptions()
+	options.excludePatterns = []string{"*-preview.jpg"}
+
+	directory := t.TempDir()
+	files := []string{
+		"keep.jpg",
+		"._keep.jpg",
+		"keep-preview.jpg",
+		".hidden/secret.jpg",
+		"@eaDir/keep.jpg/SYNOPHOTO_THUMB_XL.jpg",
+		"album/one.jpg",
+		"album/two.png",
+		"album/drafts/draft.jpg",
+		"album/drafts/final.jpg",
+	}
+	for _, file := range files {
+		os.MkdirAll(filepath.Join(directory, filepath.Dir(file)), 0755)
+		os.WriteFile(filepath.Join(directory, file), []byte("picture"), 0644)
+	}
+	os.WriteFile(filepath.Join(directory, "album", ignoreFilename), []byte("# no pngs in here\n*.png\n/drafts/*\n!drafts/final.jpg\n"), 0644)
+
+	listOfFiles, err := getListOfFiles(directory, true, options)
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+
+	// hidden folders aren't skipped unless they're excluded
+	expected := []string{
+		filepath.Join(directory, ".hidden", "secret.jpg"),
+		filepath.Join(directory, "album", "drafts", "final.jpg"),
+		filepath.Join(directory, "album", "one.jpg"),
+		filepath.Join(directory, "keep.jpg"),
+	}
+	slices.Sort(listOfFiles)
+	if !slices.Equal(expected, listOfFiles) {
+		t.Errorf("Expected files %v, but got %v", expected, listOfFiles)
+	}
+
+	if !options.skipPath(directory, filepath.Join(directory, "album", "drafts", "draft.jpg"), false) {
+		t.Errorf("Expected album/drafts/draft.jpg to be skipped")
+	}
+	if options.skipPath(directory, filepath.Join(directory, "album", "drafts", "final.jpg"), false) {
+		t.Errorf("Expected album/drafts/final.jpg to be kept")
+	}
+}
+
+func TestListNewDirectory(t *testing.T) {
+	options := testOptions()
+	options.maxDepth = 2
+	options.excludePatterns = []string{"2024/june/skip.jpg"}
+
+	directory := t.TempDir()
+	for _, file := range []string{"2024/june/beach.jpg", "2024/june/skip.jpg", "2024/june/raw/beach.jpg", "2024/private/secret.jpg"} {
+		os.MkdirAll(filepath.Join(directory, filepath.Dir(file)), 0755)
+		os.WriteFile(filepath.Join(directory, file), []byte("picture"), 0644)
+	}
+	os.WriteFile(filepath.Join(directory, ignoreFilename), []byte("private/\n"), 0644)
+
+	// a directory that shows up while watching counts its depth and rules from the root, not from itself
+	listOfFiles, err := getListOfFilesUnder(directory, filepath.Join(directory, "2024"), true, options)
+	if err != nil {
+		t.Fatalf("Not able to list files: %s", err.Error())
+	}
+	expected := []string{filepath.Join(directory, "2024", "june", "beach.jpg")}
+	if !slices.Equal(expected, listOfFiles) {
+		t.Errorf("Expected files %v, but got %v", expected, listOfFiles)
+	}
+}
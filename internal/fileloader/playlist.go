@@ -0,0 +1,176 @@
+package fileloader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JarvyJ/rayimg/internal/archive"
+)
+
+// SlideOverrides are per picture settings from a playlist that win over the commandline/ini ones
+type SlideOverrides struct {
+	Duration           *float64
+	TransitionDuration *float64
+	Caption            *string
+}
+
+type manifest struct {
+	// defaults for every slide in the manifest
+	Duration           *float64
+	TransitionDuration *float64
+	Slide              []manifestSlide
+}
+
+type manifestSlide struct {
+	Path               string
+	Duration           *float64
+	TransitionDuration *float64
+	Caption            *string
+}
+
+func isPlaylist(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".m3u" || extension == ".m3u8" || extension == ".toml"
+}
+
+func loadPlaylist(path string, options Options) ([]string, map[string]SlideOverrides, error) {
+	absPath, _ := filepath.Abs(path)
+	if strings.ToLower(filepath.Ext(absPath)) == ".toml" {
+		return loadManifest(absPath, options)
+	}
+	return loadM3u(absPath, options)
+}
+
+// relative paths are relative to wherever the playlist lives, not where rayimg was started
+func resolvePlaylistEntry(playlistPath string, entry string, options Options) (string, bool) {
+	if !filepath.IsAbs(entry) {
+		entry = filepath.Join(filepath.Dir(playlistPath), entry)
+	}
+	entry = filepath.Clean(entry)
+
+	if !options.validFile(entry) {
+		fmt.Println("WARNING: Unsupported file in playlist", playlistPath, ". Skipping for now: ", entry)
+		return "", false
+	}
+	// pictures inside of an archive get checked when they're loaded, finding them here would mean reading the whole archive
+	if _, _, ok := archive.Split(entry); ok {
+		return entry, true
+	}
+	if _, err := os.Stat(entry); err != nil {
+		fmt.Println("WARNING: Unable to find file from playlist", playlistPath, ". Skipping for now - error: ", err.Error())
+		return "", false
+	}
+	return entry, true
+}
+
+// plain list of paths, one per line. #EXTINF:<seconds>,<title> sets the duration and caption of the path after it
+func loadM3u(path string, options Options) ([]string, map[string]SlideOverrides, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.New("Unable to open playlist: " + path + "\n" + err.Error())
+	}
+	defer file.Close()
+
+	listOfFiles := []string{}
+	overrides := make(map[string]SlideOverrides)
+	entryOverrides := SlideOverrides{}
+	hasOverrides := false
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#EXTINF:") {
+			info := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)
+			// -1 (or anything unparseable) means unknown, so just use the normal duration
+			duration, err := strconv.ParseFloat(strings.TrimSpace(info[0]), 64)
+			if err == nil && duration > 0 {
+				entryOverrides.Duration = &duration
+				hasOverrides = true
+			}
+			if len(info) == 2 && strings.TrimSpace(info[1]) != "" {
+				caption := strings.TrimSpace(info[1])
+				entryOverrides.Caption = &caption
+				hasOverrides = true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, ok := resolvePlaylistEntry(path, line, options)
+		if ok {
+			listOfFiles = append(listOfFiles, entry)
+			if _, exists := overrides[entry]; hasOverrides && !exists {
+				overrides[entry] = entryOverrides
+			}
+		}
+		entryOverrides = SlideOverrides{}
+		hasOverrides = false
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.New("Unable to read playlist: " + path + "\n" + err.Error())
+	}
+	return listOfFiles, overrides, nil
+}
+
+func loadManifest(path string, options Options) ([]string, map[string]SlideOverrides, error) {
+	manifest := manifest{}
+	_, err := toml.DecodeFile(path, &manifest)
+	if err != nil {
+		return nil, nil, errors.New("Error loading " + path + ". Ensure strings are double quoted.\n" + err.Error())
+	}
+
+	if (manifest.Duration != nil && *manifest.Duration < 0) || (manifest.TransitionDuration != nil && *manifest.TransitionDuration < 0) {
+		return nil, nil, errors.New("Duration and TransitionDuration must be positive in playlist " + path)
+	}
+
+	listOfFiles := []string{}
+	overrides := make(map[string]SlideOverrides)
+	for _, slide := range manifest.Slide {
+		if slide.Path == "" {
+			fmt.Println("WARNING: Slide without a Path in playlist", path, ". Skipping for now")
+			continue
+		}
+
+		entry, ok := resolvePlaylistEntry(path, slide.Path, options)
+		if !ok {
+			continue
+		}
+		listOfFiles = append(listOfFiles, entry)
+
+		// a picture can show up more than once, but only the first one gets to pick its settings
+		if _, exists := overrides[entry]; exists {
+			continue
+		}
+		if (slide.Duration != nil && *slide.Duration < 0) || (slide.TransitionDuration != nil && *slide.TransitionDuration < 0) {
+			return nil, nil, errors.New("Duration and TransitionDuration must be positive in playlist " + path + " for " + slide.Path)
+		}
+		entryOverrides := SlideOverrides{
+			Duration:           manifest.Duration,
+			TransitionDuration: manifest.TransitionDuration,
+			Caption:            slide.Caption,
+		}
+		if slide.Duration != nil {
+			entryOverrides.Duration = slide.Duration
+		}
+		if slide.TransitionDuration != nil {
+			entryOverrides.TransitionDuration = slide.TransitionDuration
+		}
+		overrides[entry] = entryOverrides
+	}
+
+	return listOfFiles, overrides, nil
+}
@@ -0,0 +1,77 @@
+package fileloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadM3u(t *testing.T) {
+	directory := t.TempDir()
+	os.Mkdir(filepath.Join(directory, "photos"), 0755)
+	os.WriteFile(filepath.Join(directory, "photos", "b.jpg"), []byte("picture"), 0644)
+	os.WriteFile(filepath.Join(directory, "a.png"), []byte("picture"), 0644)
+
+	playlist := filepath.Join(directory, "show.m3u")
+	os.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:12,Grandma's 90th\nphotos/b.jpg\nmissing.jpg\n\na.png\n"), 0644)
+
+	files, overrides, err := loadPlaylist(playlist, testOptions())
+	if err != nil {
+		t.Fatalf("Not able to load playlist: %s", err.Error())
+	}
+
+	expectedFiles := []string{filepath.Join(directory, "photos", "b.jpg"), filepath.Join(directory, "a.png")}
+	if len(files) != len(expectedFiles) || files[0] != expectedFiles[0] || files[1] != expectedFiles[1] {
+		t.Errorf("Expected files %v, but got %v", expectedFiles, files)
+	}
+
+	slide := overrides[expectedFiles[0]]
+	if slide.Duration == nil || *slide.Duration != 12 {
+		t.Errorf("Expected a duration of 12 for '%s'", expectedFiles[0])
+	}
+	if slide.Caption == nil || *slide.Caption != "Grandma's 90th" {
+		t.Errorf("Expected a caption for '%s'", expectedFiles[0])
+	}
+	if _, ok := overrides[expectedFiles[1]]; ok {
+		t.Errorf("Expected no overrides for '%s'", expectedFiles[1])
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "a.jpg"), []byte("picture"), 0644)
+	os.WriteFile(filepath.Join(directory, "b.jpg"), []byte("picture"), 0644)
+
+	manifest := filepath.Join(directory, "show.toml")
+	os.WriteFile(manifest, []byte(`
+Duration = 5
+
+[[Slide]]
+Path = "b.jpg"
+Caption = "first"
+TransitionDuration = 0
+
+[[Slide]]
+Path = "a.jpg"
+Duration = 10
+`), 0644)
+
+	files, overrides, err := loadPlaylist(manifest, testOptions())
+	if err != nil {
+		t.Fatalf("Not able to load manifest: %s", err.Error())
+	}
+
+	if len(files) != 2 || files[0] != filepath.Join(directory, "b.jpg") {
+		t.Errorf("Expected b.jpg to be first, but got %v", files)
+	}
+
+	first := overrides[files[0]]
+	if *first.Duration != 5 || *first.TransitionDuration != 0 || *first.Caption != "first" {
+		t.Errorf("Unexpected overrides for b.jpg: %v %v %v", *first.Duration, *first.TransitionDuration, *first.Caption)
+	}
+
+	second := overrides[files[1]]
+	if *second.Duration != 10 || second.TransitionDuration != nil || second.Caption != nil {
+		t.Errorf("Unexpected overrides for a.jpg: %+v", second)
+	}
+}
@@ -0,0 +1,123 @@
+package fileloader
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/archive"
+	"github.com/JarvyJ/rayimg/internal/exif"
+)
+
+// reading metadata is mostly waiting on the disk, so this can be more than the number of cores
+const metadataWorkers = 8
+
+type fileTimeKey struct {
+	sortBy string
+	path   string
+}
+
+// cached so pictures added by the watcher can be placed without rereading everything
+var fileTimes = make(map[fileTimeKey]time.Time)
+var fileTimesMutex sync.Mutex
+
+// wall clock time like EXIF dates, so mtimes and capture dates can be compared against each other
+func wallClock(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// pictures in an archive all get the archive's mtime
+func modifiedTime(path string) time.Time {
+	if archivePath, _, ok := archive.Split(path); ok {
+		path = archivePath
+	}
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return wallClock(fileInfo.ModTime())
+}
+
+// EXIF DateTimeOriginal, then XMP, then mtime
+func dateTaken(path string) time.Time {
+	var metadata exif.Exif
+	var err error
+	if archivePath, entry, ok := archive.Split(path); ok {
+		var data []byte
+		data, err = archive.ReadFile(archivePath, entry)
+		metadata = exif.Parse(data)
+	} else {
+		metadata, err = exif.Read(path)
+	}
+	if err != nil {
+		fmt.Println("WARNING: Unable to read metadata from", path, "- error: ", err.Error())
+	}
+	if !metadata.DateTaken.IsZero() {
+		return metadata.DateTaken
+	}
+	return modifiedTime(path)
+}
+
+func fileTime(sortBy string, path string) time.Time {
+	key := fileTimeKey{sortBy: strings.TrimSuffix(sortBy, "-reverse"), path: path}
+	fileTimesMutex.Lock()
+	cached, ok := fileTimes[key]
+	fileTimesMutex.Unlock()
+	if ok {
+		return cached
+	}
+
+	var t time.Time
+	if key.sortBy == "date-taken" {
+		t = dateTaken(path)
+	} else {
+		t = modifiedTime(path)
+	}
+
+	fileTimesMutex.Lock()
+	fileTimes[key] = t
+	fileTimesMutex.Unlock()
+	return t
+}
+
+// fills the cache in parallel, thousands of files one at a time on a Pi Zero takes a while
+func loadFileTimes(sortBy string, files []string) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < metadataWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				fileTime(sortBy, path)
+			}
+		}()
+	}
+
+	for _, path := range files {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// oldest first, or newest first for the -reverse sorts. Same times fall back to the filename
+func lessByTime(sortBy string) func(a string, b string) bool {
+	less := func(a string, b string) bool {
+		timeA, timeB := fileTime(sortBy, a), fileTime(sortBy, b)
+		if timeA.Equal(timeB) {
+			return a < b
+		}
+		return timeA.Before(timeB)
+	}
+
+	if strings.HasSuffix(sortBy, "-reverse") {
+		return func(a string, b string) bool {
+			return less(b, a)
+		}
+	}
+	return less
+}
@@ -0,0 +1,217 @@
+package fileloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/arguments"
+)
+
+type ChangeType int
+
+const (
+	FileAdded ChangeType = iota
+	FileRemoved
+	// a whole directory got moved away, every file underneath it is gone
+	DirectoryRemoved
+)
+
+type FileChange struct {
+	Path string
+	Type ChangeType
+}
+
+// a path that was passed in on the commandline (or the working directory)
+type watchRoot struct {
+	path  string
+	isDir bool
+	// for http(s) paths, path is where the pictures get downloaded to
+	source *httpSource
+}
+
+func (root watchRoot) contains(path string, recursive bool) bool {
+	if !root.isDir {
+		return path == root.path
+	}
+	if recursive || root.source != nil {
+		return strings.HasPrefix(path, root.path+string(filepath.Separator))
+	}
+	return filepath.Dir(path) == root.path
+}
+
+func (root watchRoot) listFiles(recursive bool, options Options) ([]string, error) {
+	if root.source != nil {
+		return root.source.list()
+	}
+	if !root.isDir {
+		if _, err := os.Stat(root.path); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	return getListOfFiles(root.path, recursive && root.isDir, options)
+}
+
+type watchBackend interface {
+	run(changes chan<- FileChange, done <-chan struct{})
+	close()
+}
+
+type Watcher struct {
+	changes  chan FileChange
+	done     chan struct{}
+	backends []watchBackend
+}
+
+// NewWatcher watches the same paths LoadFiles loaded from, with the same options. inotify is used where it can be,
+// anything else (network mounts, non-linux, too many watches) gets rescanned every WatchInterval
+func NewWatcher(arguments arguments.Arguments, options Options) (*Watcher, error) {
+	paths := arguments.Path
+	if len(paths) == 0 {
+		workingDirectory, err := os.Getwd()
+		if err != nil {
+			return nil, errors.New("Unable to get the current working directory to watch for changes. Error: " + err.Error())
+		}
+		paths = []string{workingDirectory}
+	}
+
+	roots := []watchRoot{}
+	// there's nothing for inotify to watch on a web server, so those always get polled
+	httpRoots := []watchRoot{}
+	for _, path := range paths {
+		if isHttpSource(path) {
+			source, err := options.httpSource(path, arguments)
+			if err != nil {
+				return nil, err
+			}
+			httpRoots = append(httpRoots, watchRoot{path: source.cacheDirectory, isDir: true, source: source})
+			continue
+		}
+
+		absPath, _ := filepath.Abs(path)
+		fileInfo, err := os.Stat(absPath)
+		if err != nil {
+			return nil, errors.New("Unable to watch path: " + absPath + "\n" + err.Error())
+		}
+		roots = append(roots, watchRoot{path: absPath, isDir: fileInfo.IsDir()})
+	}
+
+	watcher := &Watcher{
+		changes: make(chan FileChange, 256),
+		done:    make(chan struct{}),
+	}
+
+	native, unwatched, err := newNativeWatcher(roots, arguments.Recursive, options)
+	if err != nil {
+		fmt.Println("WARNING: Unable to use inotify, polling for changes instead - error: ", err.Error())
+		unwatched = roots
+	}
+	unwatched = append(unwatched, httpRoots...)
+	if native != nil {
+		watcher.backends = append(watcher.backends, native)
+	}
+	if len(unwatched) > 0 {
+		interval := time.Duration(arguments.WatchInterval * float64(time.Second))
+		watcher.backends = append(watcher.backends, newPollWatcher(unwatched, arguments.Recursive, options, interval))
+	}
+
+	for _, backend := range watcher.backends {
+		go backend.run(watcher.changes, watcher.done)
+	}
+
+	return watcher, nil
+}
+
+func (watcher *Watcher) Changes() <-chan FileChange {
+	return watcher.changes
+}
+
+func (watcher *Watcher) Close() {
+	close(watcher.done)
+	for _, backend := range watcher.backends {
+		backend.close()
+	}
+}
+
+// rescans everything every interval and diffs it against the last scan
+// slow, but it's the only thing that works for NFS/SMB where the changes happen on another machine
+type pollWatcher struct {
+	roots     []watchRoot
+	recursive bool
+	options   Options
+	interval  time.Duration
+	known     map[string]bool
+}
+
+func newPollWatcher(roots []watchRoot, recursive bool, options Options, interval time.Duration) *pollWatcher {
+	pollWatcher := &pollWatcher{
+		roots:     roots,
+		recursive: recursive,
+		options:   options,
+		interval:  interval,
+		known:     make(map[string]bool),
+	}
+	pollWatcher.known = pollWatcher.scan()
+	return pollWatcher
+}
+
+func (pollWatcher *pollWatcher) scan() map[string]bool {
+	found := make(map[string]bool)
+	for _, root := range pollWatcher.roots {
+		files, err := root.listFiles(pollWatcher.recursive, pollWatcher.options)
+		if err != nil {
+			// most likely the mount went away for a bit, keep showing what we had rather than emptying the slideshow
+			fmt.Println("WARNING: Unable to rescan", root.path, ". Keeping the previous list of files - error: ", err.Error())
+			for path := range pollWatcher.known {
+				if root.contains(path, pollWatcher.recursive) {
+					found[path] = true
+				}
+			}
+			continue
+		}
+		for _, file := range files {
+			found[file] = true
+		}
+	}
+	return found
+}
+
+func (pollWatcher *pollWatcher) run(changes chan<- FileChange, done <-chan struct{}) {
+	ticker := time.NewTicker(pollWatcher.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		found := pollWatcher.scan()
+		fileChanges := []FileChange{}
+		for path := range found {
+			if !pollWatcher.known[path] {
+				fileChanges = append(fileChanges, FileChange{Path: path, Type: FileAdded})
+			}
+		}
+		for path := range pollWatcher.known {
+			if !found[path] {
+				fileChanges = append(fileChanges, FileChange{Path: path, Type: FileRemoved})
+			}
+		}
+		pollWatcher.known = found
+
+		for _, change := range fileChanges {
+			select {
+			case changes <- change:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func (pollWatcher *pollWatcher) close() {}
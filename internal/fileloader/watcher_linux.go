@@ -0,0 +1,349 @@
+//go:build linux
+
+package fileloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/JarvyJ/rayimg/internal/archive"
+)
+
+// IN_CREATE is only used for directories, files get picked up once they're done being written (IN_CLOSE_WRITE)
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_CREATE
+
+// filesystem magic numbers from statfs(2)
+// inotify never hears about changes made to these from another machine
+var networkFilesystems = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x65735546: true, // FUSE (sshfs, rclone, etc)
+}
+
+func isNetworkFilesystem(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+	return networkFilesystems[uint32(stat.Type)]
+}
+
+type inotifyWatcher struct {
+	file      *os.File
+	fd        int
+	watches   map[int32]string
+	roots     []watchRoot
+	recursive bool
+	options   Options
+}
+
+func newNativeWatcher(roots []watchRoot, recursive bool, options Options) (watchBackend, []watchRoot, error) {
+	// non-blocking so the go runtime poller owns reads, and closing the file stops run()
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, roots, err
+	}
+
+	inotifyWatcher := &inotifyWatcher{
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		watches:   make(map[int32]string),
+		recursive: recursive,
+		options:   options,
+	}
+
+	unwatched := []watchRoot{}
+	for _, root := range roots {
+		directory := root.path
+		if !root.isDir {
+			directory = filepath.Dir(root.path)
+		}
+
+		if isNetworkFilesystem(directory) {
+			fmt.Println("Polling for changes on network path: ", root.path)
+			unwatched = append(unwatched, root)
+			continue
+		}
+
+		err := inotifyWatcher.watchDirectory(directory, root.isDir && recursive)
+		if err != nil {
+			fmt.Println("WARNING: Unable to watch", root.path, ". Polling for changes instead - error: ", err.Error())
+			unwatched = append(unwatched, root)
+			continue
+		}
+		inotifyWatcher.roots = append(inotifyWatcher.roots, root)
+	}
+
+	if len(inotifyWatcher.roots) == 0 {
+		inotifyWatcher.file.Close()
+		return nil, unwatched, nil
+	}
+	return inotifyWatcher, unwatched, nil
+}
+
+func (inotifyWatcher *inotifyWatcher) addWatch(directory string) error {
+	wd, err := syscall.InotifyAddWatch(inotifyWatcher.fd, directory, inotifyMask)
+	// inotify gives back the same watch for the same directory, so it was already reached through another link
+	if _, watched := inotifyWatcher.watches[int32(wd)]; err == nil && watched {
+		return filepath.SkipDir
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return errors.New("Ran out of inotify watches on " + directory + ". The limit can be raised with the sysctl fs.inotify.max_user_watches")
+	}
+	if err != nil {
+		return errors.New("Unable to watch directory: " + directory + "\n" + err.Error())
+	}
+	inotifyWatcher.watches[int32(wd)] = directory
+	return nil
+}
+
+func (inotifyWatcher *inotifyWatcher) watchDirectory(directory string, recursive bool) error {
+	if !recursive {
+		err := inotifyWatcher.addWatch(directory)
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+
+	var walk fs.WalkDirFunc
+	walk = func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == directory {
+				return err
+			}
+			fmt.Println("WARNING: Unable to watch", path, ". Skipping for now - error: ", err.Error())
+			return nil
+		}
+		if inotifyWatcher.options.followSymlinks && d.Type()&fs.ModeSymlink != 0 {
+			if fileInfo, err := os.Stat(path); err == nil && fileInfo.IsDir() {
+				walkLink(path, walk)
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return inotifyWatcher.addWatch(path)
+		}
+		return nil
+	}
+	err := filepath.WalkDir(directory, walk)
+	if errors.Is(err, filepath.SkipDir) {
+		return nil
+	}
+	return err
+}
+
+// a directory that moved away keeps its watches (they follow the inode), so drop them before the paths go stale
+func (inotifyWatcher *inotifyWatcher) unwatchDirectory(directory string) {
+	for wd, path := range inotifyWatcher.watches {
+		if path == directory || strings.HasPrefix(path, directory+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(inotifyWatcher.fd, uint32(wd))
+			delete(inotifyWatcher.watches, wd)
+		}
+	}
+}
+
+func (inotifyWatcher *inotifyWatcher) containsFile(path string) bool {
+	for _, root := range inotifyWatcher.roots {
+		if root.contains(path, inotifyWatcher.recursive) {
+			return true
+		}
+	}
+	return false
+}
+
+func (inotifyWatcher *inotifyWatcher) containsDirectory(path string) bool {
+	if !inotifyWatcher.recursive {
+		return false
+	}
+	for _, root := range inotifyWatcher.roots {
+		if root.isDir && root.contains(path, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// the root a directory found while running is under, containsDirectory has to be true for it
+func (inotifyWatcher *inotifyWatcher) directoryRoot(path string) string {
+	for _, root := range inotifyWatcher.roots {
+		if root.isDir && root.contains(path, true) {
+			return root.path
+		}
+	}
+	return path
+}
+
+// archives are only opened up when they were passed in directly, or found while recursing
+func (inotifyWatcher *inotifyWatcher) containsArchive(path string) bool {
+	for _, root := range inotifyWatcher.roots {
+		if !root.isDir && root.path == path {
+			return true
+		}
+	}
+	return inotifyWatcher.containsDirectory(path)
+}
+
+// files passed in directly are always shown, everything else goes through --include/--exclude and .rayimgignore
+func (inotifyWatcher *inotifyWatcher) skip(path string, isDir bool) bool {
+	for _, root := range inotifyWatcher.roots {
+		if root.isDir && root.contains(path, inotifyWatcher.recursive) {
+			return inotifyWatcher.options.skipPath(root.path, path, isDir)
+		}
+	}
+	return false
+}
+
+func (inotifyWatcher *inotifyWatcher) run(changes chan<- FileChange, done <-chan struct{}) {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := inotifyWatcher.file.Read(buffer)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				fmt.Println("WARNING: Stopped watching for file changes - error: ", err.Error())
+			}
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buffer[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+
+			for _, change := range inotifyWatcher.handleEvent(event.Wd, event.Mask, name) {
+				select {
+				case changes <- change:
+				case <-done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (inotifyWatcher *inotifyWatcher) handleEvent(wd int32, mask uint32, name string) []FileChange {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		fmt.Println("WARNING: Too many file changes at once, rescanning for new files")
+		return inotifyWatcher.rescan()
+	}
+
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(inotifyWatcher.watches, wd)
+		return nil
+	}
+
+	directory, ok := inotifyWatcher.watches[wd]
+	if !ok || name == "" {
+		return nil
+	}
+	path := filepath.Join(directory, name)
+
+	if mask&syscall.IN_ISDIR != 0 {
+		if !inotifyWatcher.containsDirectory(path) || inotifyWatcher.skip(path, true) {
+			return nil
+		}
+
+		switch {
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			err := inotifyWatcher.watchDirectory(path, true)
+			if err != nil {
+				fmt.Println("WARNING: Unable to watch new directory", path, "- error: ", err.Error())
+			}
+			// files can land in the directory before the watch is set up, so pick up whatever is already there.
+			// It's listed from the root it's under, that's where --max-depth and --include/--exclude count from
+			files, err := getListOfFilesUnder(inotifyWatcher.directoryRoot(path), path, true, inotifyWatcher.options)
+			if err != nil {
+				fmt.Println("WARNING: Unable to read new directory", path, "- error: ", err.Error())
+				return nil
+			}
+			fileChanges := []FileChange{}
+			for _, file := range files {
+				fileChanges = append(fileChanges, FileChange{Path: file, Type: FileAdded})
+			}
+			return fileChanges
+
+		case mask&syscall.IN_MOVED_FROM != 0:
+			inotifyWatcher.unwatchDirectory(path)
+			return []FileChange{{Path: path, Type: DirectoryRemoved}}
+		}
+
+		// IN_DELETE on a directory only happens once it's empty, so its files were already removed one by one
+		return nil
+	}
+
+	if archive.IsArchive(path) {
+		return inotifyWatcher.handleArchiveEvent(mask, path)
+	}
+
+	if !inotifyWatcher.containsFile(path) || inotifyWatcher.skip(path, false) {
+		return nil
+	}
+
+	switch {
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0 && inotifyWatcher.options.validFile(path):
+		return []FileChange{{Path: path, Type: FileAdded}}
+	// a file that's gone can't be sniffed anymore, and removing one that was never shown doesn't hurt anything
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 && (inotifyWatcher.options.validFileByExtension(path) || (inotifyWatcher.options.extensionless && filepath.Ext(path) == "")):
+		return []FileChange{{Path: path, Type: FileRemoved}}
+	}
+	return nil
+}
+
+// an archive acts like a directory, but it gets rewritten as a whole. So everything from the old one
+// is dropped and whatever is in the new one gets added back
+func (inotifyWatcher *inotifyWatcher) handleArchiveEvent(mask uint32, path string) []FileChange {
+	if !inotifyWatcher.containsArchive(path) || inotifyWatcher.skip(path, true) {
+		return nil
+	}
+
+	switch {
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		fileChanges := []FileChange{{Path: path, Type: DirectoryRemoved}}
+		files, err := getListOfFiles(path, false, inotifyWatcher.options)
+		if err != nil {
+			fmt.Println("WARNING: Unable to read new archive", path, "- error: ", err.Error())
+			return fileChanges
+		}
+		for _, file := range files {
+			if !inotifyWatcher.skip(file, false) {
+				fileChanges = append(fileChanges, FileChange{Path: file, Type: FileAdded})
+			}
+		}
+		return fileChanges
+
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		return []FileChange{{Path: path, Type: DirectoryRemoved}}
+	}
+	return nil
+}
+
+// inotify dropped events, so we don't know what was removed. But anything new can still be found
+func (inotifyWatcher *inotifyWatcher) rescan() []FileChange {
+	fileChanges := []FileChange{}
+	for _, root := range inotifyWatcher.roots {
+		files, err := root.listFiles(inotifyWatcher.recursive, inotifyWatcher.options)
+		if err != nil {
+			fmt.Println("WARNING: Unable to rescan", root.path, "- error: ", err.Error())
+			continue
+		}
+		for _, file := range files {
+			fileChanges = append(fileChanges, FileChange{Path: file, Type: FileAdded})
+		}
+	}
+	return fileChanges
+}
+
+func (inotifyWatcher *inotifyWatcher) close() {
+	inotifyWatcher.file.Close()
+}
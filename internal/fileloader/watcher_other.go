@@ -0,0 +1,8 @@
+//go:build !linux
+
+package fileloader
+
+// no inotify outside of linux, everything gets polled
+func newNativeWatcher(roots []watchRoot, recursive bool, options Options) (watchBackend, []watchRoot, error) {
+	return nil, roots, nil
+}
@@ -0,0 +1,85 @@
+package fileloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/arguments"
+)
+
+func TestInsertSorted(t *testing.T) {
+	files := []string{"f-1.jpg", "f-2.jpg", "f-10.jpg"}
+	files, index := InsertSorted("natural", files, "f-3.jpg")
+	if index != 2 {
+		t.Errorf("Expected 'f-3.jpg' at index 2, but got %d: %v", index, files)
+	}
+
+	files = []string{"f-1.jpg", "f-10.jpg", "f-2.jpg"}
+	files, index = InsertSorted("filename", files, "f-11.jpg")
+	if index != 2 {
+		t.Errorf("Expected 'f-11.jpg' at index 2, but got %d: %v", index, files)
+	}
+}
+
+func waitForChange(t *testing.T, changes <-chan FileChange) FileChange {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a file change")
+	}
+	return FileChange{}
+}
+
+func TestWatcher(t *testing.T) {
+	directory := t.TempDir()
+	args := arguments.Arguments{Path: []string{directory}}
+	args.WatchInterval = 0.05
+	watcher, err := NewWatcher(args, testOptions())
+	if err != nil {
+		t.Fatalf("Not able to watch directory: %s", err.Error())
+	}
+	defer watcher.Close()
+
+	picture := filepath.Join(directory, "new.jpg")
+	os.WriteFile(filepath.Join(directory, "notes.doc"), []byte("not a picture"), 0644)
+	os.WriteFile(picture, []byte("picture"), 0644)
+
+	change := waitForChange(t, watcher.Changes())
+	if change.Path != picture || change.Type != FileAdded {
+		t.Errorf("Expected '%s' to be added, but got %+v", picture, change)
+	}
+
+	os.Remove(picture)
+	change = waitForChange(t, watcher.Changes())
+	if change.Path != picture || change.Type != FileRemoved {
+		t.Errorf("Expected '%s' to be removed, but got %+v", picture, change)
+	}
+}
+
+func TestPollWatcher(t *testing.T) {
+	directory := t.TempDir()
+	existing := filepath.Join(directory, "existing.png")
+	os.WriteFile(existing, []byte("picture"), 0644)
+
+	pollWatcher := newPollWatcher([]watchRoot{{path: directory, isDir: true}}, false, testOptions(), 10*time.Millisecond)
+	changes := make(chan FileChange)
+	done := make(chan struct{})
+	defer close(done)
+	go pollWatcher.run(changes, done)
+
+	picture := filepath.Join(directory, "new.jpg")
+	os.WriteFile(picture, []byte("picture"), 0644)
+	change := waitForChange(t, changes)
+	if change.Path != picture || change.Type != FileAdded {
+		t.Errorf("Expected '%s' to be added, but got %+v", picture, change)
+	}
+
+	os.Remove(existing)
+	change = waitForChange(t, changes)
+	if change.Path != existing || change.Type != FileRemoved {
+		t.Errorf("Expected '%s' to be removed, but got %+v", existing, change)
+	}
+}
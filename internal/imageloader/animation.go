@@ -0,0 +1,102 @@
+package imageloader
+
+import (
+	"image/color"
+	"time"
+	"unsafe"
+)
+
+// Animation is a picture with more than one frame, no matter what format it came from.
+// Every frame is the whole picture (already put together with the frames before it), ready for rl.UpdateTexture
+type Animation struct {
+	Delays []time.Duration
+	// how many times to play it through, 0 for forever
+	LoopCount int
+	frame     func(frame int) []color.RGBA
+}
+
+func newAnimation(frames [][]color.RGBA, delays []time.Duration, loopCount int) *Animation {
+	return &Animation{
+		Delays:    delays,
+		LoopCount: loopCount,
+		frame: func(frame int) []color.RGBA {
+			return frames[frame]
+		},
+	}
+}
+
+func (animation *Animation) Frame(frame int) []color.RGBA {
+	return animation.frame(frame)
+}
+
+func (animation *Animation) FrameCount() int {
+	return len(animation.Delays)
+}
+
+// browsers all do this for frames with (almost) no delay, a lot of old gifs count on it
+const minimumFrameDelay = 10 * time.Millisecond
+const defaultFrameDelay = 100 * time.Millisecond
+
+func (animation *Animation) frameDelay(frame int) time.Duration {
+	delay := animation.Delays[frame]
+	if delay <= minimumFrameDelay {
+		return defaultFrameDelay
+	}
+	return delay
+}
+
+// animationClock keeps track of which frame should be on screen, going off of a monotonic clock
+// instead of how many times the screen has been drawn
+type animationClock struct {
+	animation *Animation
+	frame     int
+	loops     int
+	// when the current frame went up, zero until the picture is first on screen
+	frameStart time.Time
+}
+
+func (clock *animationClock) finished() bool {
+	return clock.animation.LoopCount != 0 && clock.loops >= clock.animation.LoopCount
+}
+
+// advance moves the clock up to now, and returns true if a different frame should be on screen
+func (clock *animationClock) advance(now time.Time) bool {
+	if clock.frameStart.IsZero() {
+		clock.frameStart = now
+		return false
+	}
+
+	changed := false
+	for !clock.finished() {
+		delay := clock.animation.frameDelay(clock.frame)
+		if now.Sub(clock.frameStart) < delay {
+			break
+		}
+		clock.frameStart = clock.frameStart.Add(delay)
+		// way behind (the pi was busy, or it was paused), no point in catching up on every frame
+		if now.Sub(clock.frameStart) > time.Second {
+			clock.frameStart = now
+		}
+
+		changed = true
+		clock.frame++
+		if clock.frame >= clock.animation.FrameCount() {
+			clock.loops++
+			if clock.finished() {
+				// stays on the last frame
+				clock.frame = clock.animation.FrameCount() - 1
+			} else {
+				clock.frame = 0
+			}
+		}
+	}
+	return changed
+}
+
+// no copying, the pixels are already laid out as RGBA
+func rgbaPixels(pix []byte) []color.RGBA {
+	if len(pix) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*color.RGBA)(unsafe.Pointer(&pix[0])), len(pix)/4)
+}
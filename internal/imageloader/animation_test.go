@@ -0,0 +1,80 @@
+package imageloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnimationClock(t *testing.T) {
+	// the middle frame has no delay, so it gets the same 100ms browsers give it
+	animation := newAnimation(nil, []time.Duration{50 * time.Millisecond, 0, 200 * time.Millisecond}, 2)
+	clock := animationClock{animation: animation}
+
+	start := time.Now()
+	expected := []struct {
+		after  time.Duration
+		frame  int
+		loops  int
+		change bool
+	}{
+		{0, 0, 0, false},
+		{40 * time.Millisecond, 0, 0, false},
+		{50 * time.Millisecond, 1, 0, true},
+		{149 * time.Millisecond, 1, 0, false},
+		{150 * time.Millisecond, 2, 0, true},
+		// a slow frame skips ahead instead of playing everything late
+		{400 * time.Millisecond, 1, 1, true},
+		{650 * time.Millisecond, 2, 1, true},
+		// done after the second time through, and stays on the last frame
+		{10 * time.Second, 2, 2, true},
+		{20 * time.Second, 2, 2, false},
+	}
+	for _, step := range expected {
+		changed := clock.advance(start.Add(step.after))
+		if clock.frame != step.frame || clock.loops != step.loops || changed != step.change {
+			t.Errorf("After %v expected frame %d, loop %d, changed %t, got frame %d, loop %d, changed %t",
+				step.after, step.frame, step.loops, step.change, clock.frame, clock.loops, changed)
+		}
+	}
+	if !clock.finished() {
+		t.Error("Expected the animation to be finished")
+	}
+}
+
+func TestAnimationCanEnd(t *testing.T) {
+	// loops forever, and one that stops after playing twice
+	forever := newAnimation(nil, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, 0)
+	twice := newAnimation(nil, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, 2)
+
+	expected := []struct {
+		name            string
+		animation       *Animation
+		policy          string
+		loops           int
+		loopsAtDuration int
+		shownFor        float64
+		canEnd          bool
+	}{
+		{"still picture", nil, "loops", 0, 0, 5, true},
+		{"cut", forever, "cut", 0, 0, 5, true},
+		{"once before the first loop", forever, "once", 0, 0, 5, false},
+		{"once after the first loop", forever, "once", 1, 0, 5, true},
+		{"once already played before the duration", forever, "once", 3, 3, 5, true},
+		{"loops in the middle of a loop", forever, "loops", 2, 2, 5, false},
+		{"loops once that loop is done", forever, "loops", 3, 2, 5, true},
+		{"past the max length", forever, "loops", 2, 2, 60, true},
+		{"just under the max length", forever, "once", 0, 0, 59.9, false},
+		{"stopped on its last frame", twice, "loops", 2, 2, 5, true},
+		{"not stopped yet", twice, "loops", 1, 1, 5, false},
+	}
+	for _, test := range expected {
+		img := &RayImgImage{Animation: test.animation}
+		if test.animation != nil {
+			img.clock = &animationClock{animation: test.animation, loops: test.loops}
+		}
+		settings := SlideSettings{Duration: 5, AnimationPolicy: test.policy, AnimationMaxLength: 60}
+		if canEnd := AnimationCanEnd(img, settings, test.shownFor, test.loopsAtDuration); canEnd != test.canEnd {
+			t.Errorf("%s: expected AnimationCanEnd to be %t, got %t", test.name, test.canEnd, canEnd)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package imageloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"time"
+)
+
+// APNG is a regular PNG with the extra frames in chunks that raylib and image/png skip over, so only the
+// first frame would ever show up. Each frame gets split back out into a PNG of its own for image/png to decode,
+// and then they're put together following https://wiki.mozilla.org/APNG_Specification
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+const (
+	apngDisposeNone       = 0
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendOver         = 1
+)
+
+type pngChunk struct {
+	chunkType string
+	data      []byte
+}
+
+type apngFrame struct {
+	bounds    image.Rectangle
+	delay     time.Duration
+	disposeOp byte
+	blendOp   byte
+	// the IDAT (or fdAT without its sequence number) contents
+	data [][]byte
+}
+
+func readPngChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+	chunks := []pngChunk{}
+	offset := len(pngSignature)
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + 8 + length
+		if length < 0 || end+4 > len(data) {
+			return nil, errors.New("png chunk runs past the end of the file")
+		}
+		chunk := pngChunk{chunkType: string(data[offset+4 : offset+8]), data: data[offset+8 : end]}
+		chunks = append(chunks, chunk)
+		if chunk.chunkType == "IEND" {
+			break
+		}
+		offset = end + 4
+	}
+	return chunks, nil
+}
+
+// an APNG has an acTL chunk somewhere before the first IDAT
+func isApng(data []byte) bool {
+	chunks, err := readPngChunks(data)
+	if err != nil {
+		return false
+	}
+	for _, chunk := range chunks {
+		switch chunk.chunkType {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+	}
+	return false
+}
+
+func parseFrameControl(data []byte, canvas image.Rectangle) (*apngFrame, error) {
+	if len(data) < 26 {
+		return nil, errors.New("fcTL chunk is too short")
+	}
+	width := int(binary.BigEndian.Uint32(data[4:]))
+	height := int(binary.BigEndian.Uint32(data[8:]))
+	x := int(binary.BigEndian.Uint32(data[12:]))
+	y := int(binary.BigEndian.Uint32(data[16:]))
+	bounds := image.Rect(x, y, x+width, y+height)
+	if width <= 0 || height <= 0 || !bounds.In(canvas) {
+		return nil, errors.New("frame " + strconv.Itoa(width) + "x" + strconv.Itoa(height) + " at " + strconv.Itoa(x) + "," + strconv.Itoa(y) + " is outside of the picture")
+	}
+
+	delayNumerator := time.Duration(binary.BigEndian.Uint16(data[20:]))
+	delayDenominator := time.Duration(binary.BigEndian.Uint16(data[22:]))
+	// a denominator of 0 means hundredths of a second
+	if delayDenominator == 0 {
+		delayDenominator = 100
+	}
+
+	return &apngFrame{
+		bounds:    bounds,
+		delay:     delayNumerator * time.Second / delayDenominator,
+		disposeOp: data[24],
+		blendOp:   data[25],
+	}, nil
+}
+
+func writePngChunk(buffer *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	buffer.WriteString(chunkType)
+	buffer.Write(data)
+	binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunkType), data...)))
+}
+
+// frameToPng makes a PNG out of a single frame, with the same palette/transparency/etc chunks as the full picture
+func frameToPng(header []byte, sharedChunks []pngChunk, frame *apngFrame) []byte {
+	buffer := bytes.Buffer{}
+	buffer.Write(pngSignature)
+
+	frameHeader := bytes.Clone(header)
+	binary.BigEndian.PutUint32(frameHeader[0:], uint32(frame.bounds.Dx()))
+	binary.BigEndian.PutUint32(frameHeader[4:], uint32(frame.bounds.Dy()))
+	writePngChunk(&buffer, "IHDR", frameHeader)
+
+	for _, chunk := range sharedChunks {
+		writePngChunk(&buffer, chunk.chunkType, chunk.data)
+	}
+	for _, data := range frame.data {
+		writePngChunk(&buffer, "IDAT", data)
+	}
+	writePngChunk(&buffer, "IEND", nil)
+	return buffer.Bytes()
+}
+
+// loadApng returns the first frame, the same as a still picture, along with every frame in the animation.
+// Everything is put together without premultiplying the alpha, that's what raylib expects. Like decodeGif,
+// the animation is nil when there's only one frame or all of them would be past maxPixels
+func loadApng(data []byte, maxPixels int64) (*image.NRGBA, *Animation, error) {
+	chunks, err := readPngChunks(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var header []byte
+	var canvas image.Rectangle
+	loopCount := 0
+	sharedChunks := []pngChunk{}
+	frames := []*apngFrame{}
+	var currentFrame *apngFrame
+	seenImageData := false
+
+	for _, chunk := range chunks {
+		switch chunk.chunkType {
+		case "IHDR":
+			if len(chunk.data) < 13 {
+				return nil, nil, errors.New("IHDR chunk is too short")
+			}
+			header = chunk.data
+			canvas = image.Rect(0, 0, int(binary.BigEndian.Uint32(chunk.data[0:])), int(binary.BigEndian.Uint32(chunk.data[4:])))
+		case "acTL":
+			if len(chunk.data) < 8 {
+				return nil, nil, errors.New("acTL chunk is too short")
+			}
+			loopCount = int(binary.BigEndian.Uint32(chunk.data[4:]))
+		case "fcTL":
+			currentFrame, err = parseFrameControl(chunk.data, canvas)
+			if err != nil {
+				return nil, nil, err
+			}
+			frames = append(frames, currentFrame)
+		case "IDAT":
+			seenImageData = true
+			// without an fcTL first, the IDAT image is only for viewers that don't know about APNG
+			if currentFrame != nil {
+				currentFrame.data = append(currentFrame.data, chunk.data)
+			}
+		case "fdAT":
+			if currentFrame != nil && len(chunk.data) > 4 {
+				currentFrame.data = append(currentFrame.data, chunk.data[4:])
+			}
+		case "IEND":
+		default:
+			if !seenImageData {
+				sharedChunks = append(sharedChunks, chunk)
+			}
+		}
+	}
+	if header == nil || len(frames) == 0 {
+		return nil, nil, errors.New("no frames found in the apng")
+	}
+
+	if animationTooBig(len(frames), canvas.Dx(), canvas.Dy(), maxPixels) {
+		fmt.Println("WARNING: An apng with", len(frames), "frames at", strconv.Itoa(canvas.Dx())+"x"+strconv.Itoa(canvas.Dy()), "is past --max-pixels, only showing the first frame")
+		frames = frames[:1]
+	}
+
+	picture := image.NewNRGBA(canvas)
+	var firstFrame *image.NRGBA
+	animationFrames := [][]color.RGBA{}
+	delays := []time.Duration{}
+	for i, frame := range frames {
+		frameImage, err := png.Decode(bytes.NewReader(frameToPng(header, sharedChunks, frame)))
+		if err != nil {
+			return nil, nil, errors.New("frame " + strconv.Itoa(i) + ": " + err.Error())
+		}
+
+		disposeOp := frame.disposeOp
+		// there's nothing before the first frame to go back to
+		if i == 0 && disposeOp == apngDisposePrevious {
+			disposeOp = apngDisposeBackground
+		}
+		var previous *image.NRGBA
+		if disposeOp == apngDisposePrevious {
+			previous = image.NewNRGBA(frame.bounds)
+			draw.Draw(previous, frame.bounds, picture, frame.bounds.Min, draw.Src)
+		}
+
+		operation := draw.Src
+		if frame.blendOp == apngBlendOver {
+			operation = draw.Over
+		}
+		draw.Draw(picture, frame.bounds, frameImage, frameImage.Bounds().Min, operation)
+
+		framePixels := bytes.Clone(picture.Pix)
+		if i == 0 {
+			firstFrame = &image.NRGBA{Pix: framePixels, Stride: picture.Stride, Rect: canvas}
+		}
+		animationFrames = append(animationFrames, rgbaPixels(framePixels))
+		delays = append(delays, frame.delay)
+
+		switch disposeOp {
+		case apngDisposeBackground:
+			draw.Draw(picture, frame.bounds, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			draw.Draw(picture, frame.bounds, previous, frame.bounds.Min, draw.Src)
+		}
+	}
+
+	if len(frames) == 1 {
+		return firstFrame, nil, nil
+	}
+	return firstFrame, newAnimation(animationFrames, delays, loopCount), nil
+}
@@ -0,0 +1,144 @@
+package imageloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// the IDAT contents of a picture filled with one colour, the alpha isn't premultiplied
+func solidImageData(t *testing.T, width int, height int, fill color.RGBA) []byte {
+	picture := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(picture.Pix); i += 4 {
+		picture.Pix[i], picture.Pix[i+1], picture.Pix[i+2], picture.Pix[i+3] = fill.R, fill.G, fill.B, fill.A
+	}
+	buffer := bytes.Buffer{}
+	err := png.Encode(&buffer, picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := readPngChunks(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if chunk.chunkType == "IDAT" {
+			return chunk.data
+		}
+	}
+	t.Fatal("No IDAT chunk")
+	return nil
+}
+
+func frameControl(sequence uint32, bounds image.Rectangle, delayNumerator uint16, disposeOp byte, blendOp byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, sequence)
+	data = binary.BigEndian.AppendUint32(data, uint32(bounds.Dx()))
+	data = binary.BigEndian.AppendUint32(data, uint32(bounds.Dy()))
+	data = binary.BigEndian.AppendUint32(data, uint32(bounds.Min.X))
+	data = binary.BigEndian.AppendUint32(data, uint32(bounds.Min.Y))
+	data = binary.BigEndian.AppendUint16(data, delayNumerator)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	return append(data, disposeOp, blendOp)
+}
+
+func TestApng(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+
+	buffer := bytes.Buffer{}
+	buffer.Write(pngSignature)
+	header := binary.BigEndian.AppendUint32(nil, 4)
+	header = binary.BigEndian.AppendUint32(header, 4)
+	// 8 bit RGB, image/png leaves out the alpha for pictures without any transparency
+	header = append(header, 8, 2, 0, 0, 0)
+	writePngChunk(&buffer, "IHDR", header)
+	writePngChunk(&buffer, "acTL", []byte{0, 0, 0, 2, 0, 0, 0, 3})
+
+	// a red background, then a blue square in the corner that's cleared after it's shown
+	writePngChunk(&buffer, "fcTL", frameControl(0, image.Rect(0, 0, 4, 4), 10, apngDisposeNone, 0))
+	writePngChunk(&buffer, "IDAT", solidImageData(t, 4, 4, red))
+	writePngChunk(&buffer, "fcTL", frameControl(1, image.Rect(2, 2, 4, 4), 50, apngDisposeBackground, apngBlendOver))
+	writePngChunk(&buffer, "fdAT", append([]byte{0, 0, 0, 2}, solidImageData(t, 2, 2, blue)...))
+	writePngChunk(&buffer, "IEND", nil)
+
+	if !isApng(buffer.Bytes()) {
+		t.Fatal("Expected an APNG")
+	}
+	firstFrame, animation, err := loadApng(buffer.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("Not able to load the APNG: %s", err.Error())
+	}
+
+	if firstFrame.NRGBAAt(3, 3) != color.NRGBA(red) {
+		t.Errorf("Expected the first frame to be red, got %v", firstFrame.NRGBAAt(3, 3))
+	}
+	if animation.FrameCount() != 2 || animation.LoopCount != 3 {
+		t.Errorf("Expected 2 frames played 3 times, got %d frames and %d loops", animation.FrameCount(), animation.LoopCount)
+	}
+	if animation.Delays[0] != 100*time.Millisecond || animation.Delays[1] != 500*time.Millisecond {
+		t.Errorf("Expected delays of 100ms and 500ms, got %v", animation.Delays)
+	}
+	secondFrame := animation.Frame(1)
+	if secondFrame[0] != red || secondFrame[15] != blue {
+		t.Errorf("Expected the second frame to be red with a blue corner, got %v", secondFrame)
+	}
+
+	// 2 frames of 4x4 is 32 pixels
+	firstFrame, animation, err = loadApng(buffer.Bytes(), 31)
+	if err != nil {
+		t.Fatalf("Not able to load the APNG: %s", err.Error())
+	}
+	if firstFrame.NRGBAAt(3, 3) != color.NRGBA(red) || animation != nil {
+		t.Errorf("Expected only a red first frame past --max-pixels, got %v and an animation %v", firstFrame.NRGBAAt(3, 3), animation != nil)
+	}
+
+	stillPicture := bytes.Buffer{}
+	png.Encode(&stillPicture, firstFrame)
+	if isApng(stillPicture.Bytes()) {
+		t.Error("Expected a regular PNG to not be an APNG")
+	}
+}
+
+func TestApngTransparency(t *testing.T) {
+	// what raylib wants, half see through without the red being darkened
+	halfRed := color.RGBA{255, 0, 0, 128}
+	// not quite opaque, image/png would leave out the alpha otherwise
+	blue := color.RGBA{0, 0, 255, 254}
+
+	buffer := bytes.Buffer{}
+	buffer.Write(pngSignature)
+	header := binary.BigEndian.AppendUint32(nil, 2)
+	header = binary.BigEndian.AppendUint32(header, 2)
+	// 8 bit RGBA
+	header = append(header, 8, 6, 0, 0, 0)
+	writePngChunk(&buffer, "IHDR", header)
+	writePngChunk(&buffer, "acTL", []byte{0, 0, 0, 2, 0, 0, 0, 0})
+
+	// half transparent red, and then half transparent red over a blue corner
+	writePngChunk(&buffer, "fcTL", frameControl(0, image.Rect(0, 0, 2, 2), 10, apngDisposeNone, 0))
+	writePngChunk(&buffer, "IDAT", solidImageData(t, 2, 2, halfRed))
+	writePngChunk(&buffer, "fcTL", frameControl(1, image.Rect(1, 1, 2, 2), 10, apngDisposeNone, 0))
+	writePngChunk(&buffer, "fdAT", append([]byte{0, 0, 0, 2}, solidImageData(t, 1, 1, blue)...))
+	writePngChunk(&buffer, "fcTL", frameControl(3, image.Rect(1, 1, 2, 2), 10, apngDisposeNone, apngBlendOver))
+	writePngChunk(&buffer, "fdAT", append([]byte{0, 0, 0, 4}, solidImageData(t, 1, 1, halfRed)...))
+	writePngChunk(&buffer, "IEND", nil)
+
+	firstFrame, animation, err := loadApng(buffer.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("Not able to load the APNG: %s", err.Error())
+	}
+	if firstFrame.NRGBAAt(0, 0) != color.NRGBA(halfRed) {
+		t.Errorf("Expected the first frame to be half transparent red, got %v", firstFrame.NRGBAAt(0, 0))
+	}
+	if animation.Frame(0)[0] != halfRed {
+		t.Errorf("Expected the first frame of the animation to be half transparent red, got %v", animation.Frame(0)[0])
+	}
+	// blended half and half, and just about opaque like the blue was
+	if corner := animation.Frame(2)[3]; corner.A < 254 || corner.R < 126 || corner.R > 129 || corner.B < 126 || corner.B > 129 {
+		t.Errorf("Expected the corner to be a purple mix of red and blue, got %v", corner)
+	}
+}
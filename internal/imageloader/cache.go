@@ -0,0 +1,340 @@
+package imageloader
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/archive"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// cached pictures live in a folder of their own, so cleaning up never touches the state file or http downloads
+const cachePicturesFolder = "pictures"
+
+// qoi is lossless and keeps transparency, and it decodes a lot faster than a jpg. The files are bigger though
+const cacheExtension = ".qoi"
+
+// <original filename>.<hash of its modified time and size>.<screen width>x<screen height>.qoi
+// entries from before were .jpg, they're treated as stale so they get redone with their transparency
+var cacheFileRegex = regexp.MustCompile(`^(.+)\.([0-9a-f]{12})\.(\d+)x(\d+)\.(qoi|jpg)$`)
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// imageCache keeps downsized (and rotated) pictures around so they don't have to be decoded at full size every time.
+// Entries are keyed by the source's modified time and size, plus the screen resolution, so a replaced picture
+// or a different screen never gets a stale copy. Past maxSize the least recently used entries are removed.
+// It's used from the decode workers, so everything goes through the mutex
+type imageCache struct {
+	mutex     sync.Mutex
+	directory string
+	maxSize   int64
+	width     int32
+	height    int32
+	entries   map[string]cacheEntry
+	totalSize int64
+	// how many entries were removed to make room, `rayimg cache build` warns about it
+	evicted int
+	// the --output-profile the pictures were colour managed for, "" for sRGB, and the --tone-map for HDR pictures
+	outputProfile string
+	toneMap       string
+}
+
+func newImageCache(cacheDirectory string, maxSize int64, width int32, height int32, outputProfile string, toneMap string) *imageCache {
+	cache := &imageCache{
+		directory:     filepath.Join(cacheDirectory, cachePicturesFolder),
+		maxSize:       maxSize,
+		width:         width,
+		height:        height,
+		outputProfile: outputProfile,
+		toneMap:       toneMap,
+		entries:       make(map[string]cacheEntry),
+	}
+	return cache
+}
+
+// archive entries use the archive's modified time and size, so changing the archive redoes everything in it
+func sourceInfo(sourcePath string) (fs.FileInfo, error) {
+	if archivePath, _, inArchive := archive.Split(sourcePath); inArchive {
+		return os.Stat(archivePath)
+	}
+	return os.Stat(sourcePath)
+}
+
+// the output profile and tone mapping are in there too, a picture cached for one has the wrong colours for any other.
+// It also means entries from before colour management (and 16 bit pictures) get redone
+func (cache *imageCache) sourceHash(fileInfo fs.FileInfo) string {
+	outputProfile := cache.outputProfile
+	if outputProfile == "" {
+		outputProfile = "srgb"
+	}
+	hash := sha1.Sum([]byte(strconv.FormatInt(fileInfo.ModTime().UnixNano(), 10) + "-" + strconv.FormatInt(fileInfo.Size(), 10) + "-" + outputProfile + "-" + cache.toneMap))
+	return hex.EncodeToString(hash[:6])
+}
+
+// location is empty if the source can't be found, there's nothing to key it by
+func (cache *imageCache) location(sourcePath string) string {
+	fileInfo, err := sourceInfo(sourcePath)
+	if err != nil {
+		return ""
+	}
+	absolutePath, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return ""
+	}
+	resolution := strconv.Itoa(int(cache.width)) + "x" + strconv.Itoa(int(cache.height))
+	return filepath.Join(cache.directory, absolutePath+"."+cache.sourceHash(fileInfo)+"."+resolution+cacheExtension)
+}
+
+// cached images are saved after they've been turned upright, so they don't get oriented again
+func (cache *imageCache) load(sourcePath string) *rl.Image {
+	cacheFile := cache.location(sourcePath)
+	if cacheFile == "" {
+		return nil
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		return nil
+	}
+
+	// the modified time is the last used time, so the order survives a restart
+	now := time.Now()
+	os.Chtimes(cacheFile, now, now)
+	cache.mutex.Lock()
+	if entry, ok := cache.entries[cacheFile]; ok {
+		entry.lastUsed = now
+		cache.entries[cacheFile] = entry
+	}
+	cache.mutex.Unlock()
+
+	image := rl.LoadImage(cacheFile)
+	if image == nil || image.Data == nil || image.Width == 0 || image.Height == 0 {
+		// half written or otherwise broken, get rid of it and decode the source again
+		fmt.Println("WARNING: Unable to load cached image", cacheFile, "- removing it")
+		if image != nil && image.Data != nil {
+			rl.UnloadImage(image)
+		}
+		cache.remove(cacheFile)
+		return nil
+	}
+	return image
+}
+
+func (cache *imageCache) remove(cacheFile string) {
+	removeCacheFile(cacheFile)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.totalSize -= cache.entries[cacheFile].size
+	delete(cache.entries, cacheFile)
+}
+
+func (cache *imageCache) save(sourcePath string, image *rl.Image) {
+	cacheFile := cache.location(sourcePath)
+	if cacheFile == "" {
+		return
+	}
+	// raylib only writes qoi from 8 bit RGB(A). vips always gives back one of those, so this is only ever
+	// a grayscale png from raylib, and converting it in place is fine since raylib owns it
+	if image.Format != rl.UncompressedR8g8b8 && image.Format != rl.UncompressedR8g8b8a8 {
+		rl.ImageFormat(image, rl.UncompressedR8g8b8a8)
+	}
+	os.MkdirAll(filepath.Dir(cacheFile), 0755)
+	// raylib picks the format from the extension, so the temp file still ends in .qoi. It doesn't match
+	// cacheFileRegex, so scan cleans it up if rayimg dies before the rename
+	tempFile := strings.TrimSuffix(cacheFile, cacheExtension) + ".tmp" + cacheExtension
+	if !rl.ExportImage(*image, tempFile) {
+		fmt.Println("WARNING: Unable to save cached image", cacheFile)
+		os.Remove(tempFile)
+		return
+	}
+	if err := os.Rename(tempFile, cacheFile); err != nil {
+		fmt.Println("WARNING: Unable to save cached image", cacheFile, err)
+		os.Remove(tempFile)
+		return
+	}
+	fileInfo, err := os.Stat(cacheFile)
+	if err != nil {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.totalSize -= cache.entries[cacheFile].size
+	cache.entries[cacheFile] = cacheEntry{size: fileInfo.Size(), lastUsed: time.Now()}
+	cache.totalSize += fileInfo.Size()
+	cache.evict(cacheFile)
+}
+
+// has to be called with the mutex held. keep is the entry that was just saved, it's about to be used
+func (cache *imageCache) evict(keep string) {
+	if cache.totalSize <= cache.maxSize {
+		return
+	}
+
+	cacheFiles := []string{}
+	for cacheFile := range cache.entries {
+		cacheFiles = append(cacheFiles, cacheFile)
+	}
+	slices.SortFunc(cacheFiles, func(a string, b string) int {
+		return cache.entries[a].lastUsed.Compare(cache.entries[b].lastUsed)
+	})
+
+	for _, cacheFile := range cacheFiles {
+		if cache.totalSize <= cache.maxSize {
+			break
+		}
+		if cacheFile == keep {
+			continue
+		}
+		cache.totalSize -= cache.entries[cacheFile].size
+		delete(cache.entries, cacheFile)
+		removeCacheFile(cacheFile)
+		cache.evicted++
+	}
+}
+
+// also takes out the folder if that was the last thing in it, os.Remove won't remove a folder that isn't empty
+func removeCacheFile(cacheFile string) {
+	os.Remove(cacheFile)
+	os.Remove(filepath.Dir(cacheFile))
+}
+
+// the folder a picture (or the archive it's in) would be in
+func sourceFolder(sourcePath string) string {
+	folder := filepath.Dir(sourcePath)
+	for parent := folder; parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+		if archive.IsArchive(parent) {
+			folder = filepath.Dir(parent)
+		}
+	}
+	return folder
+}
+
+// walk calls found for everything in the cache, stale is the same as isStale
+func (cache *imageCache) walk(found func(cacheFile string, fileInfo fs.FileInfo, stale bool)) {
+	filepath.WalkDir(cache.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		found(path, fileInfo, cache.isStale(path))
+		return nil
+	})
+}
+
+// the http downloads live next to the cached pictures, see fileloader's httpsource.go
+const httpDownloadsFolder = "downloads"
+
+// before cached pictures had a folder of their own, they were saved right in CACHE_DIR as
+// <folder of the original>/<original filename>.jpg, ex: CACHE_DIR/home/pi/pictures/beach.png.jpg (or right in CACHE_DIR
+// for pictures in the folder rayimg was started from). Nothing uses those
+// anymore, so they're removed along with the folders they leave empty. Only files named like that are touched, since
+// CACHE_DIR could have anything else in it too
+func (cache *imageCache) removeOldLayout() int {
+	cacheDirectory := filepath.Dir(cache.directory)
+	extensions := FileExtensions()
+	folders := make(map[string]bool)
+	removed := 0
+	filepath.WalkDir(cacheDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if filepath.Dir(path) == cacheDirectory && (d.Name() == cachePicturesFolder || d.Name() == httpDownloadsFolder) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		original, isJpg := strings.CutSuffix(d.Name(), ".jpg")
+		if !isJpg || !slices.Contains(extensions, strings.ToLower(filepath.Ext(original))) {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			removed++
+			folders[filepath.Dir(path)] = true
+		}
+		return nil
+	})
+
+	// os.Remove leaves folders that still have something in them alone
+	for folder := range folders {
+		for ; folder != cacheDirectory && strings.HasPrefix(folder, cacheDirectory); folder = filepath.Dir(folder) {
+			if os.Remove(folder) != nil {
+				break
+			}
+		}
+	}
+	return removed
+}
+
+// scan picks up what's already in the cache from earlier runs, and removes anything that's stale:
+// the source was removed, or it's been changed since it was cached
+func (cache *imageCache) scan() {
+	if removed := cache.removeOldLayout(); removed > 0 {
+		fmt.Println("Removed", removed, "pictures cached by an older version of rayimg")
+	}
+
+	found := make(map[string]cacheEntry)
+	removed := 0
+	cache.walk(func(cacheFile string, fileInfo fs.FileInfo, stale bool) {
+		if stale {
+			removeCacheFile(cacheFile)
+			removed++
+			return
+		}
+		found[cacheFile] = cacheEntry{size: fileInfo.Size(), lastUsed: fileInfo.ModTime()}
+	})
+	if removed > 0 {
+		fmt.Println("Removed", removed, "stale pictures from the cache")
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for cacheFile, entry := range found {
+		// anything saved while this was running is already in there
+		if _, ok := cache.entries[cacheFile]; !ok {
+			cache.entries[cacheFile] = entry
+			cache.totalSize += entry.size
+		}
+	}
+	cache.evict("")
+}
+
+// entries for other screen resolutions aren't stale, the least recently used ones get evicted soon enough.
+// Neither are entries from a folder that's gone, it might be a usb drive or network share that isn't plugged in right now
+func (cache *imageCache) isStale(cacheFile string) bool {
+	relativePath, err := filepath.Rel(cache.directory, cacheFile)
+	if err != nil {
+		return false
+	}
+	matches := cacheFileRegex.FindStringSubmatch(filepath.Base(relativePath))
+	if matches == nil || "."+matches[5] != cacheExtension {
+		// not something this wrote, or a jpg that lost its transparency
+		return true
+	}
+	sourcePath := filepath.Join(string(filepath.Separator), filepath.Dir(relativePath), matches[1])
+	fileInfo, err := sourceInfo(sourcePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, err = os.Stat(sourceFolder(sourcePath))
+		return err == nil
+	}
+	if err != nil {
+		return false
+	}
+	return cache.sourceHash(fileInfo) != matches[2]
+}
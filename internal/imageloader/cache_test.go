@@ -0,0 +1,243 @@
+package imageloader
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+func TestCacheKeepsTransparency(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "logo.png")
+	os.WriteFile(sourcePath, []byte("picture"), 0644)
+	cache := newImageCache(t.TempDir(), 1024*1024, 1920, 1080, "", "reinhard")
+
+	image := rl.GenImageColor(4, 4, color.RGBA{255, 0, 0, 128})
+	defer rl.UnloadImage(image)
+	cache.save(sourcePath, image)
+
+	cachedImage := cache.load(sourcePath)
+	if cachedImage == nil {
+		t.Fatal("Expected the picture to be cached")
+	}
+	defer rl.UnloadImage(cachedImage)
+	colors := rl.LoadImageColors(cachedImage)
+	defer rl.UnloadImageColors(colors)
+	if colors[0] != (color.RGBA{255, 0, 0, 128}) {
+		t.Errorf("Expected the cached picture to come back exactly the same, got %v", colors[0])
+	}
+}
+
+func TestCacheBrokenFile(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "logo.png")
+	os.WriteFile(sourcePath, []byte("picture"), 0644)
+	cache := newImageCache(t.TempDir(), 1024*1024, 1920, 1080, "", "reinhard")
+
+	image := rl.GenImageColor(4, 4, color.RGBA{255, 0, 0, 255})
+	defer rl.UnloadImage(image)
+	cache.save(sourcePath, image)
+	cacheFile := cache.location(sourcePath)
+	if _, err := os.Stat(strings.TrimSuffix(cacheFile, cacheExtension) + ".tmp" + cacheExtension); err == nil {
+		t.Error("Expected the temp file to be renamed into place")
+	}
+
+	contents, _ := os.ReadFile(cacheFile)
+	os.WriteFile(cacheFile, contents[:4], 0644)
+	if cachedImage := cache.load(sourcePath); cachedImage != nil {
+		rl.UnloadImage(cachedImage)
+		t.Fatal("Expected a broken cached picture not to be loaded")
+	}
+	if _, err := os.Stat(cacheFile); err == nil {
+		t.Error("Expected the broken cached picture to be removed")
+	}
+	if len(cache.entries) != 0 || cache.totalSize != 0 {
+		t.Errorf("Expected the broken cached picture to be forgotten, got %d entries and %d bytes", len(cache.entries), cache.totalSize)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "beach.jpg")
+	os.WriteFile(sourcePath, []byte("picture"), 0644)
+	modified := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(sourcePath, modified, modified)
+	cacheDirectory := t.TempDir()
+	cache := newImageCache(cacheDirectory, 0, 1920, 1080, "", "reinhard")
+	location := cache.location(sourcePath)
+
+	if !strings.HasPrefix(location, filepath.Join(cacheDirectory, cachePicturesFolder, sourcePath)+".") || !strings.HasSuffix(location, ".1920x1080"+cacheExtension) {
+		t.Errorf("Expected the cached picture to be under the source's path with the resolution, got %s", location)
+	}
+	if again := newImageCache(cacheDirectory, 0, 1920, 1080, "", "reinhard").location(sourcePath); again != location {
+		t.Errorf("Expected the same source to always be cached in the same place, got %s and %s", location, again)
+	}
+
+	different := map[string]*imageCache{
+		"resolution":     newImageCache(cacheDirectory, 0, 1280, 720, "", "reinhard"),
+		"output profile": newImageCache(cacheDirectory, 0, 1920, 1080, "/some/display.icc", "reinhard"),
+		"tone map":       newImageCache(cacheDirectory, 0, 1920, 1080, "", "hable"),
+	}
+	for name, otherCache := range different {
+		if otherCache.location(sourcePath) == location {
+			t.Errorf("Expected a different %s to be cached somewhere else", name)
+		}
+	}
+
+	os.Chtimes(sourcePath, modified.Add(time.Second), modified.Add(time.Second))
+	if cache.location(sourcePath) == location {
+		t.Error("Expected a different modified time to be cached somewhere else")
+	}
+	os.Chtimes(sourcePath, modified, modified)
+	os.WriteFile(sourcePath, []byte("a different picture"), 0644)
+	os.Chtimes(sourcePath, modified, modified)
+	if cache.location(sourcePath) == location {
+		t.Error("Expected a different size to be cached somewhere else")
+	}
+
+	if cache.location(filepath.Join(t.TempDir(), "missing.jpg")) != "" {
+		t.Error("Expected nowhere to cache a picture that doesn't exist")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	sourceFolder := t.TempDir()
+	sourcePath := filepath.Join(sourceFolder, "beach.jpg")
+	os.WriteFile(sourcePath, []byte("picture"), 0644)
+	cache := newImageCache(t.TempDir(), 0, 1920, 1080, "", "reinhard")
+	cacheFile := cache.location(sourcePath)
+
+	if cache.isStale(cacheFile) {
+		t.Error("Expected a picture that was just cached to not be stale")
+	}
+	// from the same source, but some other screen
+	if cache.isStale(strings.Replace(cacheFile, ".1920x1080", ".1280x720", 1)) {
+		t.Error("Expected a picture cached for a different resolution to not be stale")
+	}
+	if !cache.isStale(strings.TrimSuffix(cacheFile, cacheExtension) + ".jpg") {
+		t.Error("Expected a picture cached as a jpg to be stale")
+	}
+	if !cache.isStale(filepath.Join(cache.directory, "something-else.txt")) {
+		t.Error("Expected a file the cache didn't write to be stale")
+	}
+
+	os.WriteFile(sourcePath, []byte("a different picture"), 0644)
+	if !cache.isStale(cacheFile) {
+		t.Error("Expected a picture to be stale once its source changed")
+	}
+
+	os.Remove(sourcePath)
+	if !cache.isStale(cacheFile) {
+		t.Error("Expected a picture to be stale once its source was removed")
+	}
+	// but not when the whole folder is gone, it could be an unplugged usb drive
+	os.Remove(sourceFolder)
+	if cache.isStale(cacheFile) {
+		t.Error("Expected a picture to not be stale when the folder it was in is gone")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := newImageCache(t.TempDir(), 250, 1920, 1080, "", "reinhard")
+	os.MkdirAll(cache.directory, 0755)
+	start := time.Now()
+	// a was used the longest time ago, and d the most recently
+	lastUsed := map[string]time.Duration{"a": 0, "b": time.Minute, "c": 2 * time.Minute, "d": 3 * time.Minute}
+	for name, used := range lastUsed {
+		cacheFile := filepath.Join(cache.directory, name)
+		os.WriteFile(cacheFile, []byte("picture"), 0644)
+		cache.entries[cacheFile] = cacheEntry{size: 100, lastUsed: start.Add(used)}
+		cache.totalSize += 100
+	}
+
+	// a would go first, but it's the one that was just saved
+	cache.evict(filepath.Join(cache.directory, "a"))
+	remaining := []string{}
+	for cacheFile := range cache.entries {
+		remaining = append(remaining, filepath.Base(cacheFile))
+	}
+	slices.Sort(remaining)
+	if !slices.Equal(remaining, []string{"a", "d"}) || cache.totalSize != 200 || cache.evicted != 2 {
+		t.Errorf("Expected b and c to be evicted, got %v (%d bytes, %d evicted)", remaining, cache.totalSize, cache.evicted)
+	}
+	for _, name := range []string{"b", "c"} {
+		if _, err := os.Stat(filepath.Join(cache.directory, name)); err == nil {
+			t.Errorf("Expected %s to be removed from the cache folder", name)
+		}
+	}
+
+	// under maxSize, nothing goes
+	cache.evict("")
+	if len(cache.entries) != 2 {
+		t.Errorf("Expected nothing to be evicted under the cache size, got %d entries", len(cache.entries))
+	}
+}
+
+func TestOldCacheLayoutRemoved(t *testing.T) {
+	cacheDirectory := t.TempDir()
+	files := map[string]bool{
+		// cached by older versions
+		"home/pi/pictures/beach.png.jpg":    false,
+		"home/pi/pictures/2024/dog.jpg.jpg": false,
+		"cat.jpeg.jpg":                      false,
+		// everything else is left alone
+		"home/pi/pictures/notes.txt":                       true,
+		"home/pi/pictures/photo.jpg":                       true,
+		"rayimg-state.json":                                true,
+		"downloads/0123456789ab/example.com/beach.png.jpg": true,
+	}
+	for file := range files {
+		os.MkdirAll(filepath.Join(cacheDirectory, filepath.Dir(file)), 0755)
+		os.WriteFile(filepath.Join(cacheDirectory, file), []byte("picture"), 0644)
+	}
+	cache := newImageCache(cacheDirectory, 1024*1024, 1920, 1080, "", "reinhard")
+	cached := cache.location(filepath.Join(cacheDirectory, "home/pi/pictures/photo.jpg"))
+	os.MkdirAll(filepath.Dir(cached), 0755)
+	os.WriteFile(cached, []byte("picture"), 0644)
+
+	cache.scan()
+	for file, kept := range files {
+		if _, err := os.Stat(filepath.Join(cacheDirectory, file)); (err == nil) != kept {
+			t.Errorf("Expected %s to be kept: %v", file, kept)
+		}
+	}
+	if _, err := os.Stat(cached); err != nil {
+		t.Error("Expected the picture in the new cache folder to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDirectory, "home/pi/pictures/2024")); err == nil {
+		t.Error("Expected the folder the old cached pictures were in to be removed once it was empty")
+	}
+}
+
+// go test -run none -bench CacheLoad ./internal/imageloader
+// compares loading a screen sized picture from the cache as a qoi to how it used to be as a jpg
+func benchmarkCacheLoad(b *testing.B, extension string) {
+	// noise is a lot closer to a photo than a gradient, which would make both formats look too good
+	image := rl.GenImagePerlinNoise(1920, 1080, 0, 0, 8)
+	defer rl.UnloadImage(image)
+	cacheFile := filepath.Join(b.TempDir(), "picture"+extension)
+	if !rl.ExportImage(*image, cacheFile) {
+		b.Fatal("Unable to save", cacheFile)
+	}
+	fileInfo, err := os.Stat(cacheFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(fileInfo.Size())/1024/1024, "MB/file")
+
+	b.ResetTimer()
+	for range b.N {
+		rl.UnloadImage(rl.LoadImage(cacheFile))
+	}
+}
+
+func BenchmarkCacheLoadJpg(b *testing.B) {
+	benchmarkCacheLoad(b, ".jpg")
+}
+
+func BenchmarkCacheLoadQoi(b *testing.B) {
+	benchmarkCacheLoad(b, cacheExtension)
+}
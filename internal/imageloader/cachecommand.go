@@ -0,0 +1,120 @@
+package imageloader
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/JarvyJ/rayimg/internal/archive"
+)
+
+// CacheStats are what `rayimg cache stats` shows
+type CacheStats struct {
+	Directory string
+	Pictures  int
+	Size      int64
+	// cached for a different screen resolution, they'll get evicted eventually if that screen isn't used anymore
+	OtherResolution int
+	// the source was removed or changed, `rayimg cache clean` (or the next slideshow) removes these
+	Stale     int
+	StaleSize int64
+}
+
+func ReadCacheStats(cacheDirectory string, screenWidth int32, screenHeight int32, outputProfile string, toneMap string) CacheStats {
+	cache := newImageCache(cacheDirectory, 0, screenWidth, screenHeight, outputProfile, toneMap)
+	stats := CacheStats{Directory: cache.directory}
+	resolution := strconv.Itoa(int(screenWidth)) + "x" + strconv.Itoa(int(screenHeight))
+
+	cache.walk(func(cacheFile string, fileInfo fs.FileInfo, stale bool) {
+		if stale {
+			stats.Stale++
+			stats.StaleSize += fileInfo.Size()
+			return
+		}
+		stats.Pictures++
+		stats.Size += fileInfo.Size()
+		if !strings.HasSuffix(cacheFile, "."+resolution+cacheExtension) {
+			stats.OtherResolution++
+		}
+	})
+	return stats
+}
+
+// CleanCache removes the stale entries, and then the least recently used ones until it's under maxSize
+func CleanCache(cacheDirectory string, maxSize int64, screenWidth int32, screenHeight int32, outputProfile string, toneMap string) {
+	cache := newImageCache(cacheDirectory, maxSize, screenWidth, screenHeight, outputProfile, toneMap)
+	cache.scan()
+	if cache.evicted > 0 {
+		fmt.Println("Removed", cache.evicted, "of the least recently shown pictures to get under the cache size")
+	}
+}
+
+// BuildCache decodes and downsizes everything in listOfFiles ahead of time, so the first pass of a slideshow
+// doesn't have to. It runs without a window, everything it uses from raylib is on the CPU
+func BuildCache(listOfFiles []string, cacheDirectory string, maxSize int64, screenWidth int32, screenHeight int32, outputProfile string, toneMap string, maxPixels int64, maxFileSize int64, workers int) {
+	imageLoader := ImageLoader{screenWidth: screenWidth, screenHeight: screenHeight, outputProfile: outputProfile, toneMap: toneMap, maxPixels: maxPixels, maxFileSize: maxFileSize}
+	imageLoader.cache = newImageCache(cacheDirectory, maxSize, screenWidth, screenHeight, outputProfile, toneMap)
+	imageLoader.cache.scan()
+	defer archive.Close()
+
+	var mutex sync.Mutex
+	finished := 0
+	counts := make(map[string]int)
+
+	jobs := make(chan string)
+	var waitGroup sync.WaitGroup
+	for range workers {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for path := range jobs {
+				result := imageLoader.buildCacheEntry(path)
+				mutex.Lock()
+				finished++
+				counts[result]++
+				fmt.Println("["+strconv.Itoa(finished)+"/"+strconv.Itoa(len(listOfFiles))+"]", result+":", path)
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, path := range listOfFiles {
+		jobs <- path
+	}
+	close(jobs)
+	waitGroup.Wait()
+
+	fmt.Println("Cached", counts["cached"], "pictures,", counts["already cached"], "were already cached,", counts["small enough"]+counts["animated"], "didn't need it, and", counts["failed"], "failed")
+	if imageLoader.cache.evicted > 0 {
+		fmt.Println("WARNING: The cache filled up and", imageLoader.cache.evicted, "pictures were removed from it to make room. It can be raised with --cache-size (currently "+strconv.FormatFloat(float64(maxSize)/1024/1024, 'g', -1, 64)+" MB)")
+	}
+}
+
+func (imageLoader *ImageLoader) buildCacheEntry(path string) string {
+	// gifs are shown frame by frame as they are, there's nothing to cache
+	if strings.ToLower(filepath.Ext(path)) == ".gif" {
+		return "animated"
+	}
+
+	cacheFile := imageLoader.cache.location(path)
+	if _, err := os.Stat(cacheFile); cacheFile != "" && err == nil {
+		return "already cached"
+	}
+
+	decoded := imageLoader.decodeImage(context.Background(), path)
+	if decoded.err != nil {
+		fmt.Println(decoded.err)
+		return "failed"
+	}
+	decoded.unload()
+
+	// only pictures that are bigger than the screen (or rotated) get cached
+	if _, err := os.Stat(cacheFile); cacheFile != "" && err == nil {
+		return "cached"
+	}
+	return "small enough"
+}
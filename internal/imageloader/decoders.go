@@ -0,0 +1,319 @@
+package imageloader
+
+import (
+	"bytes"
+	goimage "image"
+	_ "image/jpeg"
+	_ "image/png"
+	"slices"
+	"strings"
+
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// Capabilities are what a decoder can do besides getting the pixels out
+type Capabilities struct {
+	// can decode straight to the screen size, instead of decoding at full size and then shrinking it
+	ShrinkOnLoad bool
+}
+
+// Signature is what the start of a file looks like, Bytes starting Offset bytes in
+type Signature struct {
+	Offset int
+	Bytes  []byte
+}
+
+// AnyOffset is for text formats like svg that can start with whitespace, an xml declaration, or comments,
+// Bytes can be anywhere in the first anyOffsetLength bytes
+const AnyOffset = -1
+
+// the same as the header fileloader reads for --extensionless
+const anyOffsetLength = 512
+
+func (signature Signature) matches(header []byte) bool {
+	if signature.Offset == AnyOffset {
+		return bytes.Contains(header[:min(len(header), anyOffsetLength)], signature.Bytes)
+	}
+	return len(header) >= signature.Offset+len(signature.Bytes) && bytes.Equal(header[signature.Offset:signature.Offset+len(signature.Bytes)], signature.Bytes)
+}
+
+// DecodeRequest is a picture to decode, with the whole file already read into Data
+type DecodeRequest struct {
+	Path string
+	// lowercase, without the dot
+	Extension string
+	Data      []byte
+	// read from the header before anything is decoded, 0 when it couldn't be
+	Width  int
+	Height int
+	// anything bigger has to be shrunk down, textures bigger than the screen don't work on older pis
+	MaxWidth  int32
+	MaxHeight int32
+	// the built in decoders need the --output-profile/--tone-map settings
+	imageLoader *ImageLoader
+}
+
+// Decoded is what comes back from a decoder
+type Decoded struct {
+	Image *rl.Image
+	// only for pictures with more than one frame
+	Animation *Animation
+	// the pixels came from raylib (rl.LoadImage, rl.NewImageFromImage, etc) and need an rl.UnloadImage,
+	// otherwise they're go memory (like rl.NewImage on vips' bytes)
+	RaylibOwned bool
+	// it was shrunk, rotated, or colour managed, so it's worth keeping in the cache
+	Cache bool
+}
+
+// Decoder is one way of getting the pixels out of a picture. Finding pictures in folders and decoding them
+// both go off of the registered decoders, so a format only has to be added in one place
+type Decoder interface {
+	// Name shows up in warnings
+	Name() string
+	// Extensions are lowercase, without the dot
+	Extensions() []string
+	Signatures() []Signature
+	Capabilities() Capabilities
+	// decoders with a higher priority get first go at an extension they share
+	Priority() int
+	// Accepts can turn down a picture that matched, like a png that's really an APNG
+	Accepts(request *DecodeRequest) bool
+	Decode(request *DecodeRequest) (*Decoded, error)
+}
+
+var decoders []Decoder
+
+// RegisterDecoder adds a decoder, a pure Go one can be registered with a higher priority than vips or raylib
+// to be used instead of them. It has to happen before the pictures are found
+func RegisterDecoder(decoder Decoder) {
+	decoders = append(decoders, decoder)
+	slices.SortStableFunc(decoders, func(a Decoder, b Decoder) int {
+		return b.Priority() - a.Priority()
+	})
+}
+
+// FileExtensions is every extension there's a decoder for, with the dot, ex: ".jpg"
+func FileExtensions() []string {
+	extensions := []string{}
+	for _, decoder := range decoders {
+		for _, extension := range decoder.Extensions() {
+			if !slices.Contains(extensions, "."+extension) {
+				extensions = append(extensions, "."+extension)
+			}
+		}
+	}
+	return extensions
+}
+
+// AddVipsExtensions hands more extensions to vips, for the formats it can load that rayimg doesn't list itself
+// (psd, jp2, ppm, fits, etc). It has to happen before the pictures are found, same as RegisterDecoder
+func AddVipsExtensions(extensions []string) {
+	for _, extension := range extensions {
+		extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+		if extension != "" && !slices.Contains(vipsDecoder.extensions, extension) {
+			vipsDecoder.extensions = append(vipsDecoder.extensions, extension)
+		}
+	}
+}
+
+// IsPicture checks the start of a file against every decoder's signatures, it's how files without an extension are found
+func IsPicture(header []byte) bool {
+	for _, decoder := range decoders {
+		if signatureMatches(decoder, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodersFor is every decoder that takes the picture, in the order to try them. A decoder gets a go when the extension
+// is one of its own or its signature matches the file, and the ones whose signature matches go first.
+// That way a .jpg that's really HEIC (phones do this a lot) goes to vips, and files without an extension still work.
+// Pictures over --max-pixels only go to decoders that can shrink them while loading
+func decodersFor(request *DecodeRequest) []Decoder {
+	tooBig := request.imageLoader.tooManyPixels(request.Width, request.Height)
+	matching := []Decoder{}
+	for _, decoder := range decoders {
+		if tooBig && !decoder.Capabilities().ShrinkOnLoad {
+			continue
+		}
+		if (slices.Contains(decoder.Extensions(), request.Extension) || signatureMatches(decoder, request.Data)) && decoder.Accepts(request) {
+			matching = append(matching, decoder)
+		}
+	}
+	slices.SortStableFunc(matching, func(a Decoder, b Decoder) int {
+		aMatches, bMatches := signatureMatches(a, request.Data), signatureMatches(b, request.Data)
+		if aMatches == bMatches {
+			return 0
+		}
+		if aMatches {
+			return -1
+		}
+		return 1
+	})
+	return matching
+}
+
+func signatureMatches(decoder Decoder, header []byte) bool {
+	for _, signature := range decoder.Signatures() {
+		if signature.matches(header) {
+			return true
+		}
+	}
+	return false
+}
+
+// builtinDecoder covers the decoders rayimg comes with, they're all just a different decode function
+type builtinDecoder struct {
+	name         string
+	extensions   []string
+	signatures   []Signature
+	capabilities Capabilities
+	priority     int
+	accepts      func(request *DecodeRequest) bool
+	decode       func(request *DecodeRequest) (*Decoded, error)
+}
+
+func (decoder *builtinDecoder) Name() string               { return decoder.name }
+func (decoder *builtinDecoder) Extensions() []string       { return decoder.extensions }
+func (decoder *builtinDecoder) Signatures() []Signature    { return decoder.signatures }
+func (decoder *builtinDecoder) Capabilities() Capabilities { return decoder.capabilities }
+func (decoder *builtinDecoder) Priority() int              { return decoder.priority }
+
+func (decoder *builtinDecoder) Accepts(request *DecodeRequest) bool {
+	return decoder.accepts == nil || decoder.accepts(request)
+}
+
+func (decoder *builtinDecoder) Decode(request *DecodeRequest) (*Decoded, error) {
+	return decoder.decode(request)
+}
+
+var (
+	jpegSignature    = Signature{0, []byte{0xFF, 0xD8, 0xFF}}
+	pngFileSignature = Signature{0, pngSignature}
+	heifSignatures   = []Signature{
+		{4, []byte("ftypavif")}, {4, []byte("ftypavis")}, {4, []byte("ftypheic")}, {4, []byte("ftypheix")},
+		{4, []byte("ftyphevc")}, {4, []byte("ftypmif1")}, {4, []byte("ftypmsf1")},
+	}
+	webpSignature  = Signature{8, []byte("WEBP")}
+	jxlSignatures  = []Signature{{0, []byte{0xFF, 0x0A}}, {0, []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A")}}
+	tiffSignatures = []Signature{{0, []byte("II*\x00")}, {0, []byte("MM\x00*")}}
+	bmpSignature   = Signature{0, []byte("BM")}
+	qoiSignature   = Signature{0, []byte("qoif")}
+)
+
+var gifDecoder = &builtinDecoder{
+	name:       "gif",
+	extensions: []string{"gif"},
+	signatures: []Signature{{0, []byte("GIF87a")}, {0, []byte("GIF89a")}},
+	priority:   10,
+	decode: func(request *DecodeRequest) (*Decoded, error) {
+		// the first frame is the image, and every frame (including the first) is in the animation
+		image, animation, err := loadGif(request.Data, request.imageLoader.maxPixels)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoded{Image: image, Animation: animation, RaylibOwned: true}, nil
+	},
+}
+
+// an APNG looks like any other png to raylib and vips, so they'd only show the first frame
+var apngDecoder = &builtinDecoder{
+	name:       "apng",
+	extensions: []string{"png"},
+	signatures: []Signature{pngFileSignature},
+	priority:   20,
+	accepts: func(request *DecodeRequest) bool {
+		return isApng(request.Data)
+	},
+	decode: func(request *DecodeRequest) (*Decoded, error) {
+		firstFrame, animation, err := loadApng(request.Data, request.imageLoader.maxPixels)
+		if err != nil {
+			return nil, err
+		}
+		// rl.NewImageFromImage would premultiply the alpha, the pixels are already what raylib wants
+		image := rl.NewImage(firstFrame.Pix, int32(firstFrame.Rect.Dx()), int32(firstFrame.Rect.Dy()), 1, rl.UncompressedR8g8b8a8)
+		return &Decoded{Image: image, Animation: animation}, nil
+	},
+}
+
+// raylib is the quickest, but it doesn't know about colour profiles, CMYK, or anything past 8 bits.
+// It still turns pictures upright, but pictures with a colour profile are turned down instead of read
+var raylibDecoder = &builtinDecoder{
+	name:       "raylib",
+	extensions: []string{"jpg", "jpeg", "png", "bmp", "qoi"},
+	signatures: []Signature{jpegSignature, pngFileSignature, bmpSignature, qoiSignature},
+	priority:   10,
+	accepts: func(request *DecodeRequest) bool {
+		if bmpSignature.matches(request.Data) || qoiSignature.matches(request.Data) {
+			return true
+		}
+		return !needsColourManagement(request.Data, request.imageLoader.outputProfile != "") && !needsToneMapping(request.Data)
+	},
+	decode: func(request *DecodeRequest) (*Decoded, error) {
+		image, shouldCache, err := request.imageLoader.loadRaylib(request.Path, request.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoded{Image: image, RaylibOwned: true, Cache: shouldCache}, nil
+	},
+}
+
+// vips gets everything raylib doesn't, including the jpgs and pngs raylib would get the colours wrong on
+var vipsDecoder = &builtinDecoder{
+	name:         "vips",
+	extensions:   []string{"webp", "avif", "jxl", "heif", "heic", "tiff", "tif", "jpg", "jpeg", "png"},
+	signatures:   slices.Concat(heifSignatures, jxlSignatures, tiffSignatures, []Signature{webpSignature, jpegSignature, pngFileSignature}),
+	capabilities: Capabilities{ShrinkOnLoad: true},
+	priority:     0,
+	decode: func(request *DecodeRequest) (*Decoded, error) {
+		image, animation, shouldCache, err := request.imageLoader.loadVips(request.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoded{Image: image, Animation: animation, Cache: shouldCache}, nil
+	},
+}
+
+// an svg can start with an xml declaration, but going by "<?xml" would make every xml file without an extension a picture
+var svgDecoder = &builtinDecoder{
+	name:         "svg",
+	extensions:   []string{"svg"},
+	signatures:   []Signature{{AnyOffset, []byte("<svg")}},
+	capabilities: Capabilities{ShrinkOnLoad: true},
+	priority:     10,
+	decode: func(request *DecodeRequest) (*Decoded, error) {
+		image, shouldCache, err := request.imageLoader.loadSvg(request.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoded{Image: image, Cache: shouldCache}, nil
+	},
+}
+
+// Go's own decoders are the slowest, but they take some jpgs and pngs that stb and vips won't, so they go last.
+// Same as raylib, the pictures are turned upright but any colour profile is ignored
+var goDecoder = &builtinDecoder{
+	name:       "go",
+	extensions: []string{"jpg", "jpeg", "png"},
+	signatures: []Signature{jpegSignature, pngFileSignature},
+	priority:   -10,
+	decode: func(request *DecodeRequest) (*Decoded, error) {
+		decoded, _, err := goimage.Decode(bytes.NewReader(request.Data))
+		if err != nil {
+			return nil, err
+		}
+		image := rl.NewImageFromImage(decoded)
+		shouldCache := request.imageLoader.fitRaylibImage(image, request.Path, request.Data)
+		return &Decoded{Image: image, RaylibOwned: true, Cache: shouldCache}, nil
+	},
+}
+
+func init() {
+	RegisterDecoder(gifDecoder)
+	RegisterDecoder(apngDecoder)
+	RegisterDecoder(raylibDecoder)
+	RegisterDecoder(vipsDecoder)
+	RegisterDecoder(svgDecoder)
+	RegisterDecoder(goDecoder)
+}
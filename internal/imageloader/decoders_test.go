@@ -0,0 +1,74 @@
+package imageloader
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+func decoderNames(request *DecodeRequest) []string {
+	names := []string{}
+	for _, decoder := range decodersFor(request) {
+		names = append(names, decoder.Name())
+	}
+	return names
+}
+
+func TestDecodersFor(t *testing.T) {
+	imageLoader := &ImageLoader{}
+	plainPng := bytes.Buffer{}
+	png.Encode(&plainPng, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	svg := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"no\"?>\n<!-- Created with Inkscape (http://www.inkscape.org/) -->\n<svg width=\"10\" height=\"10\">")
+	xml := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<feed xmlns=\"http://www.w3.org/2005/Atom\">")
+
+	expected := []struct {
+		name      string
+		extension string
+		data      []byte
+		decoders  []string
+	}{
+		{"png", "png", plainPng.Bytes(), []string{"raylib", "vips", "go"}},
+		{"16 bit png", "png", highBitDepthPng(t, []uint16{0, 65535}, nil), []string{"vips", "go"}},
+		{"heic saved as a jpg", "jpg", heic, []string{"vips", "raylib", "go"}},
+		{"gif", "gif", []byte("GIF89a"), []string{"gif"}},
+		{"psd", "psd", []byte("8BPS"), []string{}},
+		{"png without an extension", "", plainPng.Bytes(), []string{"raylib", "vips", "go"}},
+		{"heic without an extension", "", heic, []string{"vips"}},
+		{"svg without an extension", "", svg, []string{"svg"}},
+		{"xml without an extension", "", xml, []string{}},
+		{"webp saved as a gif", "gif", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), []string{"vips", "gif"}},
+	}
+	for _, test := range expected {
+		request := &DecodeRequest{Extension: test.extension, Data: test.data, imageLoader: imageLoader}
+		if names := decoderNames(request); !slices.Equal(names, test.decoders) {
+			t.Errorf("Expected the %s to go to %v, got %v", test.name, test.decoders, names)
+		}
+	}
+
+	// too big for anything that can't shrink it while loading
+	request := &DecodeRequest{Extension: "png", Data: plainPng.Bytes(), Width: 30000, Height: 30000, imageLoader: &ImageLoader{maxPixels: 40 * 1000 * 1000}}
+	if names := decoderNames(request); !slices.Equal(names, []string{"vips"}) {
+		t.Errorf("Expected a 30000x30000 png to only go to vips, got %v", names)
+	}
+
+	if IsPicture([]byte("8BPS")) || IsPicture(xml) || !IsPicture(heic) || !IsPicture(svg) {
+		t.Error("Expected only the heic and svg to look like pictures")
+	}
+
+	vipsExtensions := vipsDecoder.extensions
+	defer func() { vipsDecoder.extensions = vipsExtensions }()
+	AddVipsExtensions([]string{".PSD", "jp2"})
+	if names := decoderNames(&DecodeRequest{Extension: "psd", Data: []byte("8BPS"), imageLoader: imageLoader}); !slices.Equal(names, []string{"vips"}) {
+		t.Errorf("Expected an extra extension to go to vips, got %v", names)
+	}
+
+	extensions := FileExtensions()
+	for _, extension := range []string{".jpg", ".gif", ".svg", ".heic", ".qoi", ".psd", ".jp2"} {
+		if !slices.Contains(extensions, extension) {
+			t.Errorf("Expected %s to be in %v", extension, extensions)
+		}
+	}
+}
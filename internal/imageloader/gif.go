@@ -1,117 +1,171 @@
 package imageloader
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/gif"
-	"os"
-	"unsafe"
+	"strconv"
+	"time"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
-const m = 1<<16 - 1
-
-type GifData struct {
-	ImagesData [][]color.RGBA
-	Delay      []int
-	rawFrames  []*image.Paletted
-	imgBounds  image.Rectangle
-}
-
-func newGifData(r *os.File, currentFile string, img *image.RGBA) *GifData {
-	gifData := GifData{}
-
-	r.Seek(0, 0)
-	gif, err := gif.DecodeAll(r)
+// the first frame comes back as an rl.Image, it gets turned into a texture on the main thread
+func loadGif(data []byte, maxPixels int64) (*rl.Image, *Animation, error) {
+	firstFrame, animation, err := decodeGif(data, maxPixels)
 	if err != nil {
-		fmt.Println("WARNING: Unable to decode gif", currentFile, ". Skipping for now - error: ", err.Error())
+		return nil, nil, err
 	}
-	gifData.ImagesData = make([][]color.RGBA, len(gif.Image))
-	gifData.rawFrames = gif.Image
-	gifData.imgBounds = img.Bounds()
-
-	// wild this saves like 4ms
-	gifData.ImagesData[0] = *(*[]color.RGBA)(unsafe.Pointer(&img.Pix))
-	// alternatively it would've been this:
-	// for i := 0; i < len(img.Pix); i += 4 {
-	// 	color := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
-	// 	gifData.ImagesData[0] = append(gifData.ImagesData[0], color)
-	// }
-
-	gifData.Delay = gif.Delay
-	return &gifData
+	return rl.NewImageFromImage(firstFrame), animation, nil
 }
 
-func loadGif(r *os.File, currentFile string, imageData *RayImgImage) error {
-	rawimg, _, err := image.Decode(r)
-	if err != nil {
-		return err
+// scanGif counts the frames and finds the size of the picture by walking over the blocks, without decompressing anything.
+// Some encoders leave the logical screen size at 0, so then it goes off of the first frame
+func scanGif(data []byte) (int, image.Rectangle) {
+	// the header, then the logical screen descriptor
+	if len(data) < 13 {
+		return 0, image.Rectangle{}
+	}
+	canvas := image.Rect(0, 0, int(binary.LittleEndian.Uint16(data[6:])), int(binary.LittleEndian.Uint16(data[8:])))
+	position := 13
+	if data[10]&0x80 != 0 {
+		position += 3 << (data[10]&0x07 + 1)
 	}
 
-	imgBounds := rawimg.Bounds()
-	img := image.NewRGBA(image.Rect(0, 0, imgBounds.Dx(), imgBounds.Dy()))
-	draw.Draw(img, img.Bounds(), rawimg, imgBounds.Min, draw.Src)
-
-	rlImage := rl.NewImageFromImage(img)
-	texture := rl.LoadTextureFromImage(rlImage)
-	rl.UnloadImage(rlImage)
-	imageData.ImageData = &texture
+	// the data in images and extensions is split up into sub-blocks, each starting with its length and ending with a 0
+	skipSubBlocks := func() bool {
+		for position < len(data) {
+			length := int(data[position])
+			position += 1 + length
+			if length == 0 {
+				return true
+			}
+		}
+		return false
+	}
 
-	imageData.GifData = newGifData(r, currentFile, img)
-	return nil
+	frames := 0
+	for position < len(data) {
+		switch data[position] {
+		case 0x21: // an extension, with its label
+			position += 2
+		case 0x2c: // an image descriptor
+			if position+10 > len(data) {
+				return frames, canvas
+			}
+			descriptor := data[position+1 : position+10]
+			if frames == 0 && canvas.Empty() {
+				x, y := int(binary.LittleEndian.Uint16(descriptor[0:])), int(binary.LittleEndian.Uint16(descriptor[2:]))
+				canvas = image.Rect(x, y, x+int(binary.LittleEndian.Uint16(descriptor[4:])), y+int(binary.LittleEndian.Uint16(descriptor[6:])))
+			}
+			frames++
+			position += 10
+			if descriptor[8]&0x80 != 0 {
+				position += 3 << (descriptor[8]&0x07 + 1)
+			}
+			// the minimum LZW code size
+			position++
+		default: // the trailer, or something that's broken, either way there's nothing else to count
+			return frames, canvas
+		}
+		if !skipSubBlocks() {
+			return frames, canvas
+		}
+	}
+	return frames, canvas
 }
 
-// use previous frame's value if outside rect and continue
-// if the new pixels are transparent, use the previous frame's value
-func (gifData *GifData) GetGifFrame(currentFrame int) []color.RGBA {
-	if len(gifData.ImagesData[currentFrame]) == 0 {
-		gifData.ImagesData[currentFrame] = make([]color.RGBA, len(gifData.ImagesData[currentFrame-1]))
-		copy(gifData.ImagesData[currentFrame], gifData.ImagesData[currentFrame-1])
-		rawFrame := gifData.rawFrames[currentFrame]
-		pixelCount := 0
-		for y := 0; y < gifData.imgBounds.Dy(); y++ {
-			for x := 0; x < gifData.imgBounds.Dx(); x++ {
-
-				if !(image.Point{x, y}.In(rawFrame.Rect)) {
-					pixelCount++
-					continue
-				}
-				pixIndex := rawFrame.PixOffset(x, y)
-				pixColor := rawFrame.Palette[rawFrame.Pix[pixIndex]]
+// decodeGif puts every frame together up front (it's on a decode worker, not the render thread)
+// following the GIF89a disposal methods. The animation is nil for a gif with only one frame, or when all of the frames
+// would be past maxPixels, then only the first frame is decoded. Each frame is only the part of the picture that changed,
+// and its disposal method says what to do with that part before the next frame is drawn
+func decodeGif(data []byte, maxPixels int64) (*image.RGBA, *Animation, error) {
+	// the frames are counted first so a huge animation never gets decoded all at once
+	frameCount, canvas := scanGif(data)
+	var decodedGif *gif.GIF
+	if animationTooBig(frameCount, canvas.Dx(), canvas.Dy(), maxPixels) {
+		fmt.Println("WARNING: A gif with", frameCount, "frames at", strconv.Itoa(canvas.Dx())+"x"+strconv.Itoa(canvas.Dy()), "is past --max-pixels, only showing the first frame")
+		// gif.Decode stops after the first frame
+		firstImage, err := gif.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		paletted, ok := firstImage.(*image.Paletted)
+		if !ok {
+			return nil, nil, errors.New("gif has no frames")
+		}
+		decodedGif = &gif.GIF{Image: []*image.Paletted{paletted}}
+	} else {
+		var err error
+		decodedGif, err = gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(decodedGif.Image) == 0 {
+		return nil, nil, errors.New("gif has no frames")
+	}
+	if canvas.Empty() {
+		canvas = decodedGif.Image[0].Bounds()
+	}
+	frameImages := decodedGif.Image
+	picture := image.NewRGBA(canvas)
+
+	var firstFrame *image.RGBA
+	frames := make([][]color.RGBA, len(frameImages))
+	delays := make([]time.Duration, len(frameImages))
+	for i, frame := range frameImages {
+		disposal := byte(gif.DisposalNone)
+		if i < len(decodedGif.Disposal) {
+			disposal = decodedGif.Disposal[i]
+		}
+		frameBounds := frame.Bounds().Intersect(canvas)
 
-				r32, g32, b32, a32 := pixColor.RGBA()
-				r, g, b, a := uint8(r32), uint8(g32), uint8(b32), uint8(a32)
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(frameBounds)
+			draw.Draw(previous, frameBounds, picture, frameBounds.Min, draw.Src)
+		}
 
-				if a == 0 {
-					pixelCount++
-					continue
-				}
+		// the transparent colour leaves whatever was already there
+		draw.Draw(picture, frameBounds, frame, frameBounds.Min, draw.Over)
 
-				sr := uint32(r) * 0x101
-				sg := uint32(g) * 0x101
-				sb := uint32(b) * 0x101
-				sa := uint32(a) * 0x101
+		framePixels := bytes.Clone(picture.Pix)
+		if i == 0 {
+			firstFrame = &image.RGBA{Pix: framePixels, Stride: picture.Stride, Rect: canvas}
+		}
+		frames[i] = rgbaPixels(framePixels)
+		// in hundredths of a second
+		if i < len(decodedGif.Delay) {
+			delays[i] = time.Duration(decodedGif.Delay[i]) * 10 * time.Millisecond
+		}
 
-				prgba := gifData.ImagesData[currentFrame-1][(y*gifData.imgBounds.Dx() + x)]
-				dr := prgba.R
-				dg := prgba.G
-				db := prgba.B
-				da := prgba.A
+		switch disposal {
+		case gif.DisposalBackground:
+			// browsers all clear to transparent instead of the background colour, so pictures look the same as there
+			draw.Draw(picture, frameBounds, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(picture, frameBounds, previous, frameBounds.Min, draw.Src)
+		}
+	}
 
-				alpha := (m - sa) * 0x101
-				nr := uint8((uint32(dr)*alpha/m + sr) >> 8)
-				ng := uint8((uint32(dg)*alpha/m + sg) >> 8)
-				nb := uint8((uint32(db)*alpha/m + sb) >> 8)
-				na := uint8((uint32(da)*alpha/m + sa) >> 8)
-				color := color.RGBA{nr, ng, nb, na}
-				gifData.ImagesData[currentFrame][pixelCount] = color
+	// a still picture, there's nothing to animate
+	if len(frames) == 1 {
+		return firstFrame, nil, nil
+	}
 
-				pixelCount++
-			}
-		}
+	// LoopCount is how many times to repeat after the first time through, -1 for just once
+	loopCount := 0
+	if decodedGif.LoopCount == -1 {
+		loopCount = 1
+	} else if decodedGif.LoopCount > 0 {
+		loopCount = decodedGif.LoopCount + 1
 	}
-	return gifData.ImagesData[currentFrame]
+
+	return firstFrame, newAnimation(frames, delays, loopCount), nil
 }
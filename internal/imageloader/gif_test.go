@@ -0,0 +1,128 @@
+package imageloader
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestGifDisposal(t *testing.T) {
+	transparent := color.RGBA{}
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	palette := color.Palette{transparent, red, blue, green, white}
+
+	frame := func(bounds image.Rectangle, fill color.Color) *image.Paletted {
+		paletted := image.NewPaletted(bounds, palette)
+		for i := range paletted.Pix {
+			paletted.Pix[i] = uint8(palette.Index(fill))
+		}
+		return paletted
+	}
+
+	// a red background, a blue corner that's cleared once it's been shown,
+	// a green corner that goes back to how it was before, and then a white pixel to see what's left
+	animatedGif := gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), red),
+			frame(image.Rect(0, 0, 2, 2), blue),
+			frame(image.Rect(2, 2, 4, 4), green),
+			frame(image.Rect(0, 3, 1, 4), white),
+		},
+		Delay:     []int{10, 20, 30, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone},
+		LoopCount: 2,
+		Config:    image.Config{Width: 4, Height: 4},
+	}
+	buffer := bytes.Buffer{}
+	err := gif.EncodeAll(&buffer, &animatedGif)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := buffer.Bytes()
+	firstFrame, animation, err := decodeGif(buffer.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("Not able to decode the gif: %s", err.Error())
+	}
+	if firstFrame.RGBAAt(0, 0) != red {
+		t.Errorf("Expected the first frame to be red, got %v", firstFrame.RGBAAt(0, 0))
+	}
+	// played once, and then repeated twice more
+	if animation.FrameCount() != 4 || animation.LoopCount != 3 {
+		t.Errorf("Expected 4 frames played 3 times, got %d frames and %d loops", animation.FrameCount(), animation.LoopCount)
+	}
+
+	pixel := func(frame int, x int, y int) color.RGBA {
+		return animation.Frame(frame)[y*4+x]
+	}
+	expected := []struct {
+		frame int
+		x, y  int
+		color color.RGBA
+	}{
+		{1, 0, 0, blue},
+		{1, 3, 3, red},
+		{2, 0, 0, transparent},
+		{2, 3, 3, green},
+		{3, 3, 3, red},
+		{3, 0, 3, white},
+		{3, 0, 0, transparent},
+	}
+	for _, pixelTest := range expected {
+		if got := pixel(pixelTest.frame, pixelTest.x, pixelTest.y); got != pixelTest.color {
+			t.Errorf("Expected %v at %d,%d in frame %d, got %v", pixelTest.color, pixelTest.x, pixelTest.y, pixelTest.frame, got)
+		}
+	}
+
+	// counted without decoding, so a huge animation doesn't get decoded just to find out it's too big
+	if frameCount, canvas := scanGif(encoded); frameCount != 4 || canvas != image.Rect(0, 0, 4, 4) {
+		t.Errorf("Expected to count 4 frames at 4x4, got %d frames at %v", frameCount, canvas)
+	}
+	if frameCount, _ := scanGif(encoded[:len(encoded)/2]); frameCount == 0 || frameCount > 4 {
+		t.Errorf("Expected to count some of the frames in a gif that's cut off, got %d", frameCount)
+	}
+
+	// 4 frames of 4x4 is 64 pixels, so past a --max-pixels of 63 it's only the first frame
+	firstFrame, animation, err = decodeGif(encoded, 63)
+	if err != nil {
+		t.Fatalf("Not able to decode the gif: %s", err.Error())
+	}
+	if firstFrame.RGBAAt(0, 0) != red || animation != nil {
+		t.Errorf("Expected only a red first frame past --max-pixels, got %v and an animation %v", firstFrame.RGBAAt(0, 0), animation != nil)
+	}
+	_, animation, _ = decodeGif(encoded, 64)
+	if animation == nil {
+		t.Error("Expected the gif to be animated right at --max-pixels")
+	}
+
+	_, _, err = decodeGif([]byte("GIF89a not really a gif"), 0)
+	if err == nil {
+		t.Error("Expected a broken gif to return an error")
+	}
+}
+
+func TestSingleFrameGif(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	still := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{red})
+	buffer := bytes.Buffer{}
+	err := gif.Encode(&buffer, still, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstFrame, animation, err := decodeGif(buffer.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("Not able to decode the gif: %s", err.Error())
+	}
+	if firstFrame.RGBAAt(1, 1) != red {
+		t.Errorf("Expected the picture to be red, got %v", firstFrame.RGBAAt(1, 1))
+	}
+	if animation != nil {
+		t.Errorf("Expected a gif with one frame to not be animated, got %d frames", animation.FrameCount())
+	}
+}
@@ -0,0 +1,195 @@
+package imageloader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// raylib doesn't know anything about ICC profiles or CMYK, it hands back the numbers in the file as if they were sRGB.
+// That's right for most pictures, but Display P3 phone pictures and Adobe RGB exports look dull and CMYK jpgs come
+// out with the wrong colours. Those go through vips instead, which maps the embedded profile to the output one
+
+// needsColourManagement is true for jpgs and pngs that raylib would get the colours wrong on, going off of what's in the
+// file rather than its extension. With a custom output profile every picture has to be transformed, even the plain sRGB ones
+func needsColourManagement(fileData []byte, customProfile bool) bool {
+	profile, cmyk := readJpegColours(fileData)
+	if cmyk {
+		return true
+	}
+	if profile == nil {
+		profile = readPngProfile(fileData)
+	}
+
+	if customProfile {
+		return true
+	}
+	// no profile means sRGB, and almost every camera tags its pictures as sRGB too
+	return profile != nil && !isSrgbProfile(profile)
+}
+
+// readJpegColours pulls the ICC profile out of the APP2 segments (split up when it's bigger than 64K),
+// and checks the frame header for 4 components (CMYK or YCCK)
+func readJpegColours(data []byte) (profile []byte, cmyk bool) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, false
+	}
+	iccPrefix := []byte("ICC_PROFILE\x00")
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return profile, cmyk
+		}
+		marker := data[offset+1]
+		// padding, and markers without anything after them
+		if marker == 0xFF {
+			offset++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			offset += 2
+			continue
+		}
+		// the pixels start at SOS, nothing about the colours comes after
+		if marker == 0xDA || marker == 0xD9 {
+			return profile, cmyk
+		}
+
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		end := offset + 2 + length
+		if length < 2 || end > len(data) {
+			return profile, cmyk
+		}
+		segment := data[offset+4 : end]
+
+		switch {
+		case marker == 0xE2 && bytes.HasPrefix(segment, iccPrefix) && len(segment) > len(iccPrefix)+2:
+			// skips the chunk number and count, they're always in order in practice
+			profile = append(profile, segment[len(iccPrefix)+2:]...)
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			// precision, height, width, and then the number of components
+			if len(segment) >= 6 {
+				cmyk = segment[5] == 4
+			}
+		}
+		offset = end
+	}
+	return profile, cmyk
+}
+
+// readPngProfile decompresses the profile in the iCCP chunk, if there is one
+func readPngProfile(data []byte) []byte {
+	chunks, err := readPngChunks(data)
+	if err != nil {
+		return nil
+	}
+	for _, chunk := range chunks {
+		if chunk.chunkType == "IDAT" {
+			return nil
+		}
+		if chunk.chunkType != "iCCP" {
+			continue
+		}
+		// a name, a null, and the compression method (always zlib)
+		nameEnd := bytes.IndexByte(chunk.data, 0)
+		if nameEnd == -1 || nameEnd+2 > len(chunk.data) {
+			return nil
+		}
+		reader, err := zlib.NewReader(bytes.NewReader(chunk.data[nameEnd+2:]))
+		if err != nil {
+			return nil
+		}
+		defer reader.Close()
+		profile, err := io.ReadAll(reader)
+		if err != nil {
+			return nil
+		}
+		return profile
+	}
+	return nil
+}
+
+// isSrgbProfile goes off of the profile's description, it's what every other viewer shows for its name.
+// Anything that can't be read is treated as something else, vips can sort it out
+func isSrgbProfile(profile []byte) bool {
+	return strings.Contains(iccDescription(profile), "sRGB")
+}
+
+// iccDescription finds the desc tag in the tag table after the 128 byte header. ICC v2 stores it as plain ASCII,
+// and v4 as UTF-16 in a multi-localized unicode (mluc) tag
+func iccDescription(profile []byte) string {
+	if len(profile) < 132 {
+		return ""
+	}
+	tagCount := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := range tagCount {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return ""
+		}
+		if string(profile[entry:entry+4]) != "desc" {
+			continue
+		}
+		// everything is checked as uint64, as an int these can go negative on 32 bit
+		start := uint64(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := uint64(binary.BigEndian.Uint32(profile[entry+8:]))
+		if size < 12 || start+size > uint64(len(profile)) {
+			return ""
+		}
+		tag := profile[start : start+size]
+
+		switch string(tag[0:4]) {
+		case "desc":
+			length := uint64(binary.BigEndian.Uint32(tag[8:]))
+			if length > uint64(len(tag)-12) {
+				return ""
+			}
+			return strings.TrimRight(string(tag[12:12+length]), "\x00")
+		case "mluc":
+			if len(tag) < 28 {
+				return ""
+			}
+			// just the first language, the name doesn't change much between them
+			length := uint64(binary.BigEndian.Uint32(tag[20:]))
+			textStart := uint64(binary.BigEndian.Uint32(tag[24:]))
+			if textStart+length > uint64(len(tag)) {
+				return ""
+			}
+			text := make([]uint16, length/2)
+			for j := range text {
+				text[j] = binary.BigEndian.Uint16(tag[textStart+uint64(j)*2:])
+			}
+			return string(utf16.Decode(text))
+		}
+		return ""
+	}
+	return ""
+}
+
+// toOutputProfile maps the picture's colours to sRGB, or to --output-profile when it's set
+func (imageLoader *ImageLoader) toOutputProfile(imageRef *vips.ImageRef) error {
+	outputProfile := imageLoader.outputProfile
+	if outputProfile == "" {
+		outputProfile = vips.SRGBIEC6196621ICCProfilePath
+	}
+
+	if imageRef.HasICCProfile() {
+		return imageRef.TransformICCProfile(outputProfile)
+	}
+	// without a profile vips already knows how to get to sRGB (CMYK included), and that's all an untagged picture is
+	if imageRef.ColorSpace() != vips.InterpretationSRGB {
+		err := imageRef.ToColorSpace(vips.InterpretationSRGB)
+		if err != nil {
+			return err
+		}
+	}
+	if imageLoader.outputProfile != "" {
+		return imageRef.TransformICCProfileWithFallback(imageLoader.outputProfile, vips.SRGBIEC6196621ICCProfilePath)
+	}
+	return nil
+}
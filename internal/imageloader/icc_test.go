@@ -0,0 +1,148 @@
+package imageloader
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// just enough of an ICC v2 profile to have a description
+func fakeProfile(description string) []byte {
+	descTag := []byte("desc\x00\x00\x00\x00")
+	descTag = binary.BigEndian.AppendUint32(descTag, uint32(len(description)+1))
+	descTag = append(descTag, description...)
+	descTag = append(descTag, 0)
+
+	profile := make([]byte, 128)
+	profile = binary.BigEndian.AppendUint32(profile, 1)
+	profile = append(profile, "desc"...)
+	profile = binary.BigEndian.AppendUint32(profile, 144)
+	profile = binary.BigEndian.AppendUint32(profile, uint32(len(descTag)))
+	profile = append(profile, descTag...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func jpegWithProfile(t *testing.T, profile []byte) []byte {
+	buffer := bytes.Buffer{}
+	err := jpeg.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile == nil {
+		return buffer.Bytes()
+	}
+	segment := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...)
+	app2 := []byte{0xFF, 0xE2}
+	app2 = binary.BigEndian.AppendUint16(app2, uint16(len(segment)+2))
+	app2 = append(app2, segment...)
+	return append(append([]byte{0xFF, 0xD8}, app2...), buffer.Bytes()[2:]...)
+}
+
+func pngWithProfile(t *testing.T, profile []byte) []byte {
+	buffer := bytes.Buffer{}
+	err := png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile == nil {
+		return buffer.Bytes()
+	}
+	compressed := bytes.Buffer{}
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(profile)
+	writer.Close()
+
+	// the iCCP chunk goes right after the IHDR
+	headerEnd := len(pngSignature) + 8 + 13 + 4
+	withProfile := bytes.Buffer{}
+	withProfile.Write(buffer.Bytes()[:headerEnd])
+	writePngChunk(&withProfile, "iCCP", append([]byte("icc\x00\x00"), compressed.Bytes()...))
+	withProfile.Write(buffer.Bytes()[headerEnd:])
+	return withProfile.Bytes()
+}
+
+func TestNeedsColourManagement(t *testing.T) {
+	srgb := fakeProfile("sRGB IEC61966-2.1")
+	displayP3 := fakeProfile("Display P3")
+
+	// SOI, and then a frame header with 4 components
+	cmykJpeg := []byte{0xFF, 0xD8, 0xFF, 0xC0, 0x00, 0x14, 8, 0, 4, 0, 4, 4, 1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0, 4, 0x11, 0, 0xFF, 0xDA}
+
+	expected := []struct {
+		name          string
+		data          []byte
+		customProfile bool
+		needed        bool
+	}{
+		{"untagged jpg", jpegWithProfile(t, nil), false, false},
+		{"sRGB jpg", jpegWithProfile(t, srgb), false, false},
+		{"Display P3 jpg", jpegWithProfile(t, displayP3), false, true},
+		{"CMYK jpg", cmykJpeg, false, true},
+		{"untagged png", pngWithProfile(t, nil), false, false},
+		{"sRGB png", pngWithProfile(t, srgb), false, false},
+		{"Display P3 png", pngWithProfile(t, displayP3), false, true},
+		{"untagged jpg with an output profile", jpegWithProfile(t, nil), true, true},
+	}
+	for _, test := range expected {
+		if needed := needsColourManagement(test.data, test.customProfile); needed != test.needed {
+			t.Errorf("Expected colour management for the %s to be %t", test.name, test.needed)
+		}
+	}
+
+	if description := iccDescription(displayP3); description != "Display P3" {
+		t.Errorf("Expected the profile to be called Display P3, got %q", description)
+	}
+}
+
+// a v4 profile with the description as UTF-16 in an mluc tag
+func fakeMlucProfile(description string) []byte {
+	mlucTag := []byte("mluc\x00\x00\x00\x00")
+	mlucTag = binary.BigEndian.AppendUint32(mlucTag, 1)
+	mlucTag = binary.BigEndian.AppendUint32(mlucTag, 12)
+	mlucTag = append(mlucTag, "enUS"...)
+	mlucTag = binary.BigEndian.AppendUint32(mlucTag, uint32(len(description)*2))
+	mlucTag = binary.BigEndian.AppendUint32(mlucTag, 28)
+	for _, character := range description {
+		mlucTag = binary.BigEndian.AppendUint16(mlucTag, uint16(character))
+	}
+
+	profile := make([]byte, 128)
+	profile = binary.BigEndian.AppendUint32(profile, 1)
+	profile = append(profile, "desc"...)
+	profile = binary.BigEndian.AppendUint32(profile, 144)
+	profile = binary.BigEndian.AppendUint32(profile, uint32(len(mlucTag)))
+	return append(profile, mlucTag...)
+}
+
+func TestIccDescriptionHugeFields(t *testing.T) {
+	if description := iccDescription(fakeMlucProfile("Display P3")); description != "Display P3" {
+		t.Errorf("Expected the v4 profile to be called Display P3, got %q", description)
+	}
+
+	// where the field is in the profile, both tags start at 144
+	fields := []struct {
+		name    string
+		profile []byte
+		offset  int
+	}{
+		{"tag start", fakeProfile("Display P3"), 136},
+		{"tag size", fakeProfile("Display P3"), 140},
+		{"desc length", fakeProfile("Display P3"), 144 + 8},
+		{"mluc length", fakeMlucProfile("Display P3"), 144 + 20},
+		{"mluc text start", fakeMlucProfile("Display P3"), 144 + 24},
+	}
+	for _, field := range fields {
+		for _, value := range []uint32{0x80000000, 0xFFFFFFF0, 0xFFFFFFFF} {
+			profile := bytes.Clone(field.profile)
+			binary.BigEndian.PutUint32(profile[field.offset:], value)
+			if description := iccDescription(profile); description != "" {
+				t.Errorf("Expected no description with the %s at %#x, got %q", field.name, value, description)
+			}
+		}
+	}
+}
@@ -2,71 +2,315 @@ package imageloader
 
 import (
 	"fmt"
+	"math/rand"
 
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/JarvyJ/rayimg/internal/archive"
+	"github.com/JarvyJ/rayimg/internal/arguments"
+	"github.com/JarvyJ/rayimg/internal/fileloader"
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 type ImageLoader struct {
 	listOfFiles    []string
+	playlistFiles  int // how many at the end of listOfFiles are from playlists, those stay in the playlist's order
 	currentIndex   int
 	screenHeight   int32
 	screenWidth    int32
-	cacheImages    bool
-	cacheDirectory string
+	sortBy         string
+	cache          *imageCache // nil when CACHE_DIR isn't set
+	outputProfile  string      // an ICC profile to colour manage to, "" for sRGB
+	toneMap        string      // how HDR pictures are squeezed into SDR, "reinhard", "hable", "aces", or "clip"
+	maxPixels      int64       // anything bigger is shrunk while it loads, 0 for no limit
+	maxFileSize    int64       // in bytes, anything bigger is skipped without reading it
+	settings       SlideSettings
+	slideOverrides map[string]fileloader.SlideOverrides
+	// the same ones the pictures were found with, for the slide_settings.ini files in sub folders
+	fileOptions fileloader.Options
+	// only used by the "shuffle" sort
+	nextCycleStart   string
+	shuffleStateFile string
+	stateFile        string
+	// what's on screen, and what was last written to stateFile
+	state        resumeState
+	savedState   resumeState
+	stateSavedAt time.Time
+	// decodes the pictures around the current one in the background
+	preloader     *preloader
+	preloadWindow int
+	// set by the memory watchdog, FreeMemoryIfLow does the freeing on the main thread
+	freeMemory atomic.Bool
+	// the picture on screen was overwritten, see CurrentImageOverwritten
+	currentOverwritten bool
+	// the picture on screen was removed, and the one after it slid into currentIndex. Moving forward lands on that one
+	currentRemoved bool
 }
 
-func New(listOfFiles []string, screenWidth int32, screenHeight int32) *ImageLoader {
+// SlideSettings are what the render loop should use for the current picture
+type SlideSettings struct {
+	Duration           float64
+	TransitionDuration float64
+	Display            string
+	AnimationPolicy    string
+	AnimationMaxLength float64
+}
+
+func New(listOfFiles []string, playlistFiles []string, slideOverrides map[string]fileloader.SlideOverrides, fileOptions fileloader.Options, args arguments.Arguments, screenWidth int32, screenHeight int32) *ImageLoader {
 	imageLoader := ImageLoader{}
-	imageLoader.listOfFiles = listOfFiles
+	imageLoader.listOfFiles = slices.Concat(listOfFiles, playlistFiles)
+	imageLoader.playlistFiles = len(playlistFiles)
 	imageLoader.currentIndex = 0
 	imageLoader.screenWidth = screenWidth
 	imageLoader.screenHeight = screenHeight
+	imageLoader.sortBy = args.Sort
+	imageLoader.settings = SlideSettings{
+		Duration:           args.Duration,
+		TransitionDuration: args.TransitionDuration,
+		Display:            args.Display,
+		AnimationPolicy:    args.AnimationPolicy,
+		AnimationMaxLength: args.AnimationMaxLength,
+	}
+	imageLoader.slideOverrides = slideOverrides
+	imageLoader.fileOptions = fileOptions
+	imageLoader.outputProfile = args.OutputProfile
+	imageLoader.toneMap = args.ToneMap
+	imageLoader.maxPixels = int64(args.MaxPixels * 1000 * 1000)
+	imageLoader.maxFileSize = int64(args.MaxFileSize * 1024 * 1024)
+
+	if cacheDirectory, ok := os.LookupEnv("CACHE_DIR"); ok {
+		imageLoader.cache = newImageCache(cacheDirectory, int64(args.CacheSize*1024*1024), screenWidth, screenHeight, args.OutputProfile, args.ToneMap)
+		// walking a big cache on an sd card takes a while, no need to hold up the first picture for it
+		go imageLoader.cache.scan()
+	}
+	imageLoader.preloadWindow = args.Preload
+
+	imageLoader.stateFile = args.StateFile
+	state := imageLoader.readResumeState()
+	imageLoader.savedState = state
+	if imageLoader.sortBy == "shuffle" && args.ShuffleState != "" {
+		imageLoader.shuffleStateFile = args.ShuffleState
+		imageLoader.loadShuffleState(state.Path)
+	}
+	imageLoader.resume(state)
+	// only written if it's a different picture than last time
+	imageLoader.saveState()
 
-	imageLoader.cacheDirectory, imageLoader.cacheImages = os.LookupEnv("CACHE_DIR")
+	imageLoader.preloader = newPreloader(imageLoader.decodeSlide, int64(args.PreloadMemory*1024*1024))
+	imageLoader.preload()
+	imageLoader.watchMemory(int64(args.MemoryLimit * 1024 * 1024))
 
 	return &imageLoader
 }
 
-// a little hacky, but it should work for now.
-// if I ever support more than just animated gifs, might need to do something different
+// Close stops decoding and frees anything that was decoded ahead of time. The slideshow position is saved right away
+func (imageLoader *ImageLoader) Close() {
+	imageLoader.writeState(true)
+	imageLoader.preloader.close()
+	archive.Close()
+}
+
+// Animation is only set for pictures with more than one frame (gif, apng, webp, etc).
+// Caption is from the playlist or the .txt file next to the picture, "" if there isn't one
 type RayImgImage struct {
+	Path        string
 	ImageData   *rl.Texture2D
 	ImageFormat string
-	GifData     *GifData
+	Animation   *Animation
+	Caption     string
+	clock       *animationClock
 }
 
-func (imageLoader *ImageLoader) deleteImageAtIndex(index int) {
+// Animate puts the right frame of an animation in the texture for now, it does nothing for still pictures.
+// The clock starts the first time it's called, so a picture that's loaded early starts from its first frame
+func (img *RayImgImage) Animate(now time.Time) {
+	if img.Animation == nil {
+		return
+	}
+	if img.clock == nil {
+		img.clock = &animationClock{animation: img.Animation}
+	}
+	if img.clock.advance(now) {
+		rl.UpdateTexture(*img.ImageData, img.Animation.Frame(img.clock.frame))
+	}
+}
+
+// AnimationLoops is how many times the animation has played all the way through since it was first on screen
+func (img *RayImgImage) AnimationLoops() int {
+	if img.clock == nil {
+		return 0
+	}
+	return img.clock.loops
+}
+
+// AnimationFinished is true once an animation that only plays a few times is stopped on its last frame
+func (img *RayImgImage) AnimationFinished() bool {
+	return img.clock != nil && img.clock.finished()
+}
+
+// AnimationCanEnd is whether the slideshow can move on from img once --duration has run out. With --animation-policy,
+// an animation holds on past the duration until it's played through (or runs into --animation-max-length).
+// shownFor is how many seconds it's been on screen, and loopsAtDuration is how many times it had played when the
+// duration ran out. Still pictures can always end
+func AnimationCanEnd(img *RayImgImage, settings SlideSettings, shownFor float64, loopsAtDuration int) bool {
+	if img.Animation == nil || settings.AnimationPolicy == "cut" || img.AnimationFinished() {
+		return true
+	}
+	if shownFor >= settings.AnimationMaxLength {
+		return true
+	}
+
+	if settings.AnimationPolicy == "once" {
+		return img.AnimationLoops() >= 1
+	}
+	return img.AnimationLoops() > loopsAtDuration
+}
+
+// Empty is true once every picture was removed (or failed to decode) while running, the slideshow waits for new ones
+func (imageLoader *ImageLoader) Empty() bool {
+	return len(imageLoader.listOfFiles) == 0
+}
+
+// sortedFiles is everything in the slideshow except the playlist entries at the end
+func (imageLoader *ImageLoader) sortedFiles() []string {
+	return imageLoader.listOfFiles[:len(imageLoader.listOfFiles)-imageLoader.playlistFiles]
+}
+
+func (imageLoader *ImageLoader) deleteFromList(index int) {
+	if index >= len(imageLoader.sortedFiles()) {
+		imageLoader.playlistFiles--
+	}
 	imageLoader.listOfFiles = slices.Delete(imageLoader.listOfFiles, index, index+1)
+}
+
+func (imageLoader *ImageLoader) deleteImageAtIndex(index int) {
+	imageLoader.deleteFromList(index)
 	numberOfFiles := len(imageLoader.listOfFiles)
 	if numberOfFiles == 0 {
-		panic("Could not open any of the found files. See above in log for details. Images potentially corrupt or incompatible formats")
+		imageLoader.currentIndex = 0
+		imageLoader.currentRemoved = false
+		imageLoader.preload()
+		return
+	}
+	// the picture on screen has to stay the current one, so it's what gets saved to the state file.
+	// Deleting the current picture moves on to the one after it
+	if index < imageLoader.currentIndex {
+		imageLoader.currentIndex = imageLoader.currentIndex - 1
+	} else if imageLoader.currentIndex >= numberOfFiles {
+		imageLoader.currentIndex = 0
 	}
-	imageLoader.currentIndex = imageLoader.currentIndex - 1
-	imageLoader.IncreaseCurrentIndex()
+	imageLoader.preload()
 }
 
+// GetCurrentImage waits for the current picture if it isn't decoded yet, CurrentImageReady can check first
 func (imageLoader *ImageLoader) GetCurrentImage() *RayImgImage {
-	start := time.Now()
-	rayimage := imageLoader.getImage(imageLoader.currentIndex)
-	fmt.Println("Time to decode: ", time.Now().Sub(start), imageLoader.listOfFiles[imageLoader.currentIndex])
-	return rayimage
+	// whatever slid into the removed picture's place is on screen now
+	imageLoader.currentRemoved = false
+	return imageLoader.getImage(imageLoader.currentIndex)
 }
 
-func (imageLoader *ImageLoader) GetCurrentFilename() string {
-	filePath := imageLoader.listOfFiles[imageLoader.currentIndex]
+// CurrentImageReady also skips past anything that failed to decode, so it can change what the current picture is
+func (imageLoader *ImageLoader) CurrentImageReady() bool {
+	imageLoader.dropFailedImages()
+	if imageLoader.Empty() {
+		return false
+	}
+	return imageLoader.preloader.ready(imageLoader.listOfFiles[imageLoader.currentIndex])
+}
+
+func (imageLoader *ImageLoader) NextImageReady() bool {
+	imageLoader.dropFailedImages()
+	if imageLoader.Empty() {
+		return false
+	}
+	nextImageIndex, _ := imageLoader.nextImageIndex()
+	return imageLoader.preloader.ready(imageLoader.listOfFiles[nextImageIndex])
+}
+
+// preload points the preloader at the current picture, then the next and previous ones out to preloadWindow
+func (imageLoader *ImageLoader) preload() {
+	numberOfFiles := len(imageLoader.listOfFiles)
+	if numberOfFiles == 0 {
+		imageLoader.preloader.want(nil)
+		return
+	}
+	nextImageIndex, _ := imageLoader.nextImageIndex()
+	paths := []string{imageLoader.listOfFiles[imageLoader.currentIndex], imageLoader.listOfFiles[nextImageIndex]}
+
+	for distance := 1; distance <= imageLoader.preloadWindow; distance++ {
+		nextIndex := (imageLoader.currentIndex + distance) % numberOfFiles
+		previousIndex := ((imageLoader.currentIndex-distance)%numberOfFiles + numberOfFiles) % numberOfFiles
+		paths = append(paths, imageLoader.listOfFiles[nextIndex], imageLoader.listOfFiles[previousIndex])
+	}
+
+	wanted := []string{}
+	for _, path := range paths {
+		if !slices.Contains(wanted, path) {
+			wanted = append(wanted, path)
+		}
+	}
+	imageLoader.preloader.want(wanted)
+}
+
+// takes the path of the picture on screen, which lags behind the current index while the next one decodes
+func (imageLoader *ImageLoader) GetFilename(filePath string) string {
 	splitPath := strings.Split(filePath, "/")
 	return splitPath[len(splitPath)-1]
 }
 
-func (imageLoader *ImageLoader) GetCurrentCaption() string {
+// GetCurrentSettings starts with the commandline/ini settings, then the slide_settings.ini files in sub folders,
+// and then the playlist (if the picture came from one)
+func (imageLoader *ImageLoader) GetCurrentSettings() SlideSettings {
+	settings := imageLoader.settings
+	if imageLoader.Empty() {
+		return settings
+	}
 	filePath := imageLoader.listOfFiles[imageLoader.currentIndex]
+
+	folderSettings := imageLoader.fileOptions.FolderSettings(filePath)
+	if folderSettings.Duration != nil {
+		settings.Duration = *folderSettings.Duration
+	}
+	if folderSettings.TransitionDuration != nil {
+		settings.TransitionDuration = *folderSettings.TransitionDuration
+	}
+	if folderSettings.Display != nil {
+		settings.Display = *folderSettings.Display
+	}
+
+	overrides, ok := imageLoader.slideOverrides[filePath]
+	if !ok {
+		return settings
+	}
+
+	if overrides.Duration != nil {
+		settings.Duration = *overrides.Duration
+	}
+	if overrides.TransitionDuration != nil {
+		settings.TransitionDuration = *overrides.TransitionDuration
+	}
+	return settings
+}
+
+// readCaption runs on the preloader's workers, it's RayImgImage.Caption by the time it's on screen
+func (imageLoader *ImageLoader) readCaption(filePath string) string {
+	// a caption from a playlist wins over the .txt file
+	if overrides, ok := imageLoader.slideOverrides[filePath]; ok && overrides.Caption != nil {
+		return *overrides.Caption
+	}
 	captionPath := filePath + ".txt"
-	captionData, err := os.ReadFile(captionPath)
+	var captionData []byte
+	var err error
+	if archivePath, entry, inArchive := archive.Split(filePath); inArchive {
+		captionData, err = archive.ReadFile(archivePath, entry+".txt")
+	} else {
+		captionData, err = os.ReadFile(captionPath)
+	}
 	if err != nil {
 		return ""
 	}
@@ -74,31 +318,68 @@ func (imageLoader *ImageLoader) GetCurrentCaption() string {
 }
 
 func (imageLoader *ImageLoader) IncreaseCurrentIndex() {
+	if imageLoader.Empty() {
+		return
+	}
 	numberOfFiles := len(imageLoader.listOfFiles)
-	if imageLoader.currentIndex+1 >= numberOfFiles {
-		imageLoader.currentIndex = 0
+	if imageLoader.currentRemoved {
+		// it's already on the one after the picture that was removed
+		imageLoader.currentRemoved = false
+	} else if imageLoader.currentIndex+1 >= numberOfFiles {
+		if imageLoader.sortBy == "shuffle" {
+			imageLoader.startNewCycle()
+		} else {
+			imageLoader.currentIndex = 0
+		}
 	} else {
 		imageLoader.currentIndex = imageLoader.currentIndex + 1
 	}
+	imageLoader.saveState()
+	imageLoader.preload()
 }
 
 func (imageLoader *ImageLoader) DecreaseCurrentIndex() {
+	if imageLoader.Empty() {
+		return
+	}
+	imageLoader.currentRemoved = false
 	if imageLoader.currentIndex <= 0 {
 		imageLoader.currentIndex = len(imageLoader.listOfFiles) - 1
 	} else {
 		imageLoader.currentIndex = imageLoader.currentIndex - 1
 	}
+	imageLoader.saveState()
+	imageLoader.preload()
 }
 
-func (imageLoader *ImageLoader) PeekNextImage() *RayImgImage {
+// in "shuffle" the next picture after the end of a cycle is the first one of the next cycle
+func (imageLoader *ImageLoader) nextImageIndex() (int, bool) {
+	if imageLoader.currentRemoved {
+		return imageLoader.currentIndex, false
+	}
 	nextImageIndex := imageLoader.currentIndex + 1
 	numberOfFiles := len(imageLoader.listOfFiles)
+	startsNewCycle := nextImageIndex >= numberOfFiles && imageLoader.sortBy == "shuffle"
 	if nextImageIndex >= numberOfFiles {
 		nextImageIndex = 0
 	}
-	start := time.Now()
+	if startsNewCycle {
+		if !slices.Contains(imageLoader.listOfFiles, imageLoader.nextCycleStart) {
+			imageLoader.nextCycleStart = imageLoader.pickNextCycleStart()
+		}
+		nextImageIndex = slices.Index(imageLoader.listOfFiles, imageLoader.nextCycleStart)
+	}
+	return nextImageIndex, startsNewCycle
+}
+
+// PeekNextImage waits for the next picture if it isn't decoded yet, NextImageReady can check first
+func (imageLoader *ImageLoader) PeekNextImage() *RayImgImage {
+	nextImageIndex, startsNewCycle := imageLoader.nextImageIndex()
 	img := imageLoader.getImage(nextImageIndex)
-	fmt.Println("Time to decode: ", time.Now().Sub(start), imageLoader.listOfFiles[imageLoader.currentIndex])
+	// getImage skips over anything it can't open, so go with whatever it actually loaded
+	if startsNewCycle {
+		imageLoader.nextCycleStart = img.Path
+	}
 	return img
 }
 
@@ -109,3 +390,106 @@ func (imageLoader *ImageLoader) PeekPreviousImage() *RayImgImage {
 	}
 	return imageLoader.getImage(previousImageIndex)
 }
+
+// ApplyFileChanges splices in any files the watcher found since the last call
+// returns true if the list changed or a picture in it was overwritten, so anything peeked ahead might be stale
+func (imageLoader *ImageLoader) ApplyFileChanges(changes <-chan fileloader.FileChange) bool {
+	applied := false
+	for {
+		select {
+		case change, ok := <-changes:
+			// a nil channel never has anything on it, so this ends up in default
+			if !ok {
+				changes = nil
+				continue
+			}
+			switch change.Type {
+			case fileloader.FileAdded:
+				applied = imageLoader.addFile(change.Path) || applied
+			case fileloader.FileRemoved:
+				applied = imageLoader.removeFile(change.Path) || applied
+			case fileloader.DirectoryRemoved:
+				applied = imageLoader.removeDirectory(change.Path) || applied
+			}
+		default:
+			if applied {
+				imageLoader.preload()
+			}
+			return applied
+		}
+	}
+}
+
+// CurrentImageOverwritten is true once after the picture on screen was overwritten, so it can be shown again
+func (imageLoader *ImageLoader) CurrentImageOverwritten() bool {
+	overwritten := imageLoader.currentOverwritten
+	imageLoader.currentOverwritten = false
+	return overwritten
+}
+
+func (imageLoader *ImageLoader) addFile(path string) bool {
+	// overwriting a file that's already in the slideshow also shows up as an add, it needs decoding again
+	if index := slices.Index(imageLoader.listOfFiles, path); index != -1 {
+		imageLoader.preloader.forget(path)
+		if index == imageLoader.currentIndex {
+			imageLoader.currentOverwritten = true
+		}
+		fmt.Println("Reloading overwritten picture: ", path)
+		return true
+	}
+
+	var index int
+	if imageLoader.sortBy == "shuffle" && !imageLoader.Empty() {
+		// somewhere in what's left of this cycle, so it shows up before the next reshuffle
+		index = imageLoader.currentIndex + 1 + rand.Intn(len(imageLoader.listOfFiles)-imageLoader.currentIndex)
+		imageLoader.listOfFiles = slices.Insert(imageLoader.listOfFiles, index, path)
+	} else {
+		// in with the sorted pictures, the playlist entries stay at the end
+		playlistFiles := imageLoader.listOfFiles[len(imageLoader.sortedFiles()):]
+		var sortedFiles []string
+		sortedFiles, index = fileloader.InsertSorted(imageLoader.sortBy, slices.Clone(imageLoader.sortedFiles()), path)
+		imageLoader.listOfFiles = append(sortedFiles, playlistFiles...)
+	}
+	if index <= imageLoader.currentIndex && len(imageLoader.listOfFiles) > 1 {
+		imageLoader.currentIndex = imageLoader.currentIndex + 1
+	}
+	fmt.Println("Added picture to slideshow: ", path)
+	return true
+}
+
+func (imageLoader *ImageLoader) removeFile(path string) bool {
+	index := slices.Index(imageLoader.listOfFiles, path)
+	if index == -1 {
+		return false
+	}
+
+	imageLoader.deleteFromList(index)
+	numberOfFiles := len(imageLoader.listOfFiles)
+	// if the current image was removed it stays on screen, and moving forward lands on the one that slid into its place.
+	// When it was the last one, moving forward goes back around (or starts the next shuffle cycle) like it would have
+	switch {
+	case index < imageLoader.currentIndex:
+		imageLoader.currentIndex = imageLoader.currentIndex - 1
+	case index == imageLoader.currentIndex && index < numberOfFiles:
+		imageLoader.currentRemoved = true
+	case index == imageLoader.currentIndex:
+		imageLoader.currentIndex = max(numberOfFiles-1, 0)
+		imageLoader.currentRemoved = false
+	}
+	fmt.Println("Removed picture from slideshow: ", path)
+	if numberOfFiles == 0 {
+		fmt.Println("WARNING: Every picture in the slideshow was removed, waiting for new ones")
+	}
+	return true
+}
+
+func (imageLoader *ImageLoader) removeDirectory(directory string) bool {
+	removed := false
+	prefix := directory + string(filepath.Separator)
+	for _, path := range slices.Clone(imageLoader.listOfFiles) {
+		if strings.HasPrefix(path, prefix) {
+			removed = imageLoader.removeFile(path) || removed
+		}
+	}
+	return removed
+}
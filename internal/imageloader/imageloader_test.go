@@ -0,0 +1,240 @@
+package imageloader
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/fileloader"
+)
+
+// nothing really gets decoded, it's only for moving around the list. The failing pictures come back with an error
+func testImageLoader(failing []string, files ...string) *ImageLoader {
+	imageLoader := &ImageLoader{listOfFiles: files, sortBy: "filename"}
+	imageLoader.preloader = newPreloader(func(ctx context.Context, path string) *decodedImage {
+		if slices.Contains(failing, path) {
+			return &decodedImage{err: errors.New("WARNING: Unable to open image " + path)}
+		}
+		return &decodedImage{}
+	}, 0)
+	return imageLoader
+}
+
+func TestDeleteImageAtIndex(t *testing.T) {
+	imageLoader := testImageLoader(nil, "a.jpg", "b.jpg", "c.jpg", "d.jpg")
+	defer imageLoader.Close()
+	imageLoader.currentIndex = 2
+
+	current := func() string {
+		return imageLoader.listOfFiles[imageLoader.currentIndex]
+	}
+
+	// a picture before the current one, like the previous picture failing to decode
+	imageLoader.deleteImageAtIndex(0)
+	if current() != "c.jpg" {
+		t.Errorf("Expected c.jpg to still be current after removing one before it, got %s", current())
+	}
+	// one after it
+	imageLoader.deleteImageAtIndex(2)
+	if current() != "c.jpg" {
+		t.Errorf("Expected c.jpg to still be current after removing one after it, got %s", current())
+	}
+	// the current one, which wraps back around since it was the last one
+	imageLoader.deleteImageAtIndex(1)
+	if current() != "b.jpg" {
+		t.Errorf("Expected to wrap around to b.jpg after removing the last picture, got %s", current())
+	}
+}
+
+func removeFiles(imageLoader *ImageLoader, paths ...string) {
+	changes := make(chan fileloader.FileChange, len(paths))
+	for _, path := range paths {
+		changes <- fileloader.FileChange{Type: fileloader.FileRemoved, Path: path}
+	}
+	close(changes)
+	imageLoader.ApplyFileChanges(changes)
+}
+
+func TestRemoveCurrentImage(t *testing.T) {
+	imageLoader := testImageLoader(nil, "a.jpg", "b.jpg", "c.jpg")
+	defer imageLoader.Close()
+	imageLoader.sortBy = "shuffle"
+
+	// the one that slid into its place is next, not the start of a new cycle
+	removeFiles(imageLoader, "a.jpg")
+	if nextImageIndex, startsNewCycle := imageLoader.nextImageIndex(); imageLoader.listOfFiles[nextImageIndex] != "b.jpg" || startsNewCycle {
+		t.Errorf("Expected b.jpg to be next after removing the current picture, got %s (new cycle %t)", imageLoader.listOfFiles[nextImageIndex], startsNewCycle)
+	}
+	imageLoader.IncreaseCurrentIndex()
+	if current := imageLoader.listOfFiles[imageLoader.currentIndex]; current != "b.jpg" || !slices.Equal(imageLoader.listOfFiles, []string{"b.jpg", "c.jpg"}) {
+		t.Errorf("Expected to move on to b.jpg in the same cycle, got %s in %v", current, imageLoader.listOfFiles)
+	}
+	imageLoader.IncreaseCurrentIndex()
+	if current := imageLoader.listOfFiles[imageLoader.currentIndex]; current != "c.jpg" {
+		t.Errorf("Expected c.jpg after b.jpg, got %s", current)
+	}
+}
+
+func TestRemoveEveryImage(t *testing.T) {
+	imageLoader := testImageLoader([]string{"c.jpg"}, "a.jpg", "b.jpg", "c.jpg")
+	defer imageLoader.Close()
+	imageLoader.preload()
+
+	removeFiles(imageLoader, "a.jpg", "b.jpg")
+	// c.jpg is about to fail to decode, which takes the slideshow down to nothing
+	deadline := time.Now().Add(5 * time.Second)
+	for !imageLoader.Empty() {
+		if imageLoader.CurrentImageReady() || time.Now().After(deadline) {
+			t.Fatalf("Expected the broken c.jpg to be dropped, got %v", imageLoader.listOfFiles)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if imageLoader.CurrentImageReady() || imageLoader.NextImageReady() {
+		t.Error("Expected nothing to be ready without any pictures")
+	}
+	imageLoader.IncreaseCurrentIndex()
+	imageLoader.DecreaseCurrentIndex()
+	imageLoader.GetCurrentSettings()
+
+	changes := make(chan fileloader.FileChange, 1)
+	changes <- fileloader.FileChange{Type: fileloader.FileAdded, Path: "d.jpg"}
+	close(changes)
+	imageLoader.ApplyFileChanges(changes)
+	imageLoader.preloader.wait("d.jpg")
+	if !imageLoader.CurrentImageReady() || imageLoader.listOfFiles[imageLoader.currentIndex] != "d.jpg" {
+		t.Errorf("Expected d.jpg to be shown once it was added, got %v", imageLoader.listOfFiles)
+	}
+}
+
+func TestFailedImagesAreSkipped(t *testing.T) {
+	imageLoader := testImageLoader([]string{"b.jpg", "c.jpg"}, "a.jpg", "b.jpg", "c.jpg", "d.jpg")
+	defer imageLoader.Close()
+	imageLoader.currentIndex = 1
+	imageLoader.preload()
+
+	// the render loop keeps checking without ever waiting, and moves past both broken pictures
+	deadline := time.Now().Add(5 * time.Second)
+	for !imageLoader.CurrentImageReady() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the current picture to be ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if current := imageLoader.listOfFiles[imageLoader.currentIndex]; current != "d.jpg" {
+		t.Errorf("Expected d.jpg to be current after skipping the broken pictures, got %s", current)
+	}
+	if !slices.Equal(imageLoader.listOfFiles, []string{"a.jpg", "d.jpg"}) {
+		t.Errorf("Expected the broken pictures to be removed, got %v", imageLoader.listOfFiles)
+	}
+}
+
+func TestOverwrittenImageIsDecodedAgain(t *testing.T) {
+	var mutex sync.Mutex
+	decodes := 0
+	imageLoader := &ImageLoader{listOfFiles: []string{"a.jpg", "b.jpg"}, sortBy: "filename"}
+	imageLoader.preloader = newPreloader(func(ctx context.Context, path string) *decodedImage {
+		mutex.Lock()
+		defer mutex.Unlock()
+		decodes++
+		return &decodedImage{format: path + strconv.Itoa(decodes)}
+	}, 0)
+	defer imageLoader.Close()
+	imageLoader.preload()
+	imageLoader.preloader.wait("a.jpg")
+	imageLoader.preloader.wait("b.jpg")
+
+	changes := make(chan fileloader.FileChange, 1)
+	changes <- fileloader.FileChange{Type: fileloader.FileAdded, Path: "a.jpg"}
+	close(changes)
+	if !imageLoader.ApplyFileChanges(changes) {
+		t.Error("Expected overwriting a picture to count as a change")
+	}
+	if !slices.Equal(imageLoader.listOfFiles, []string{"a.jpg", "b.jpg"}) {
+		t.Errorf("Expected the overwritten picture to stay listed once, got %v", imageLoader.listOfFiles)
+	}
+	if !imageLoader.CurrentImageOverwritten() {
+		t.Error("Expected the picture on screen to be overwritten")
+	}
+	if imageLoader.CurrentImageOverwritten() {
+		t.Error("Expected CurrentImageOverwritten to only be true once")
+	}
+	if decoded := imageLoader.preloader.wait("a.jpg"); decoded.format != "a.jpg3" {
+		t.Errorf("Expected a.jpg to be decoded again, got %s", decoded.format)
+	}
+}
+
+func TestSkippedDecodeIsCancelled(t *testing.T) {
+	started := make(chan string, 4)
+	cancelled := make(chan string, 4)
+	preloader := newPreloader(func(ctx context.Context, path string) *decodedImage {
+		started <- path
+		if path == "slow.jpg" {
+			// stands in for a long decode, that checks its context between stages
+			select {
+			case <-ctx.Done():
+				cancelled <- path
+				return &decodedImage{err: ctx.Err()}
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return &decodedImage{format: path}
+	}, 0)
+	defer preloader.close()
+
+	preloader.want([]string{"slow.jpg"})
+	<-started
+	preloader.want([]string{"b.jpg"})
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the decode to be cancelled once the picture was skipped past")
+	}
+	preloader.wait("b.jpg")
+
+	// coming back to it decodes it again, a cancelled decode isn't a broken picture
+	preloader.want([]string{"b.jpg", "slow.jpg"})
+	if failed := preloader.takeFailed(); len(failed) != 0 {
+		t.Errorf("Expected nothing to fail, got %v", failed)
+	}
+	for path := <-started; path != "slow.jpg"; path = <-started {
+	}
+	preloader.forget("slow.jpg")
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the decode to be cancelled once the file was overwritten")
+	}
+}
+
+func TestPlaylistFilesStayAtTheEnd(t *testing.T) {
+	imageLoader := testImageLoader(nil, "b.jpg", "d.jpg", "z.jpg", "a.jpg")
+	defer imageLoader.Close()
+	imageLoader.playlistFiles = 2
+
+	changes := make(chan fileloader.FileChange, 2)
+	changes <- fileloader.FileChange{Type: fileloader.FileAdded, Path: "c.jpg"}
+	changes <- fileloader.FileChange{Type: fileloader.FileAdded, Path: "e.jpg"}
+	close(changes)
+	imageLoader.ApplyFileChanges(changes)
+	expected := []string{"b.jpg", "c.jpg", "d.jpg", "e.jpg", "z.jpg", "a.jpg"}
+	if !slices.Equal(imageLoader.listOfFiles, expected) {
+		t.Errorf("Expected %v, got %v", expected, imageLoader.listOfFiles)
+	}
+
+	removeFiles(imageLoader, "z.jpg")
+	if imageLoader.playlistFiles != 1 {
+		t.Errorf("Expected 1 playlist file left, got %d", imageLoader.playlistFiles)
+	}
+	changes = make(chan fileloader.FileChange, 1)
+	changes <- fileloader.FileChange{Type: fileloader.FileAdded, Path: "f.jpg"}
+	close(changes)
+	imageLoader.ApplyFileChanges(changes)
+	expected = []string{"b.jpg", "c.jpg", "d.jpg", "e.jpg", "f.jpg", "a.jpg"}
+	if !slices.Equal(imageLoader.listOfFiles, expected) {
+		t.Errorf("Expected %v, got %v", expected, imageLoader.listOfFiles)
+	}
+}
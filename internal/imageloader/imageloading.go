@@ -1,118 +1,229 @@
 package imageloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"image/color"
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/JarvyJ/rayimg/internal/archive"
 	"github.com/davidbyttow/govips/v2/vips"
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
+// getImage only has to wait when CurrentImageReady/NextImageReady weren't checked first, which is just the very first
+// picture. Those take anything that failed out of the list as it comes in, so the render loop never waits on a picture
+// that's going to be skipped
 func (imageLoader *ImageLoader) getImage(index int) *RayImgImage {
+	// only the very first picture is waited on without checking, at runtime the render loop checks Empty first
+	if imageLoader.Empty() {
+		panic("Could not open any of the found files. See above in log for details. Images potentially corrupt or incompatible formats")
+	}
 	// unlikely, but could happen if there are a lot of corrupt images...
 	if index >= len(imageLoader.listOfFiles) {
 		index = 0
 	}
-	imageData := &RayImgImage{}
 
 	currentFile := imageLoader.listOfFiles[index]
-	if _, err := os.Stat(currentFile); errors.Is(err, os.ErrNotExist) {
-		fmt.Println("WARNING: File does not exist", currentFile, ". Skipping for now - error: ", err.Error())
-		imageLoader.deleteImageAtIndex(index)
+	decoded := imageLoader.preloader.wait(currentFile)
+	if decoded.err != nil {
+		imageLoader.dropFailedImages()
 		return imageLoader.getImage(index)
 	}
+	return uploadImage(currentFile, decoded)
+}
 
-	extension := strings.ToLower(currentFile[strings.LastIndex(currentFile, ".")+1:])
-	imageData.ImageFormat = extension
-
-	// GIFs are a little hacked in, but currently modify the imageData fields `ImageData` and `GifData` directly
-	if extension == "gif" {
-		r, err := os.Open(currentFile)
-		if err != nil {
-			fmt.Println("WARNING: Unable to open file", currentFile, ". Skipping for now - error: ", err.Error())
+// dropFailedImages removes the pictures that couldn't be decoded from the slideshow, as soon as the preloader is done with them
+func (imageLoader *ImageLoader) dropFailedImages() {
+	for path, err := range imageLoader.preloader.takeFailed() {
+		fmt.Println(err)
+		if index := slices.Index(imageLoader.listOfFiles, path); index != -1 {
 			imageLoader.deleteImageAtIndex(index)
-			return imageLoader.getImage(index)
 		}
-		defer r.Close()
+	}
+}
+
+// uploadImage is the only part of loading a picture that has to be on the main raylib thread
+// the decoded pixels stay with the preloader, so going back to a picture doesn't decode it again
+func uploadImage(path string, decoded *decodedImage) *RayImgImage {
+	texture := rl.LoadTextureFromImage(decoded.image)
+	return &RayImgImage{
+		Path:        path,
+		ImageData:   &texture,
+		ImageFormat: decoded.format,
+		Animation:   decoded.animation,
+		Caption:     decoded.caption,
+	}
+}
 
-		err = loadGif(r, currentFile, imageData)
+// decodeImage runs on the preloader's workers, so it can't touch anything on the GPU.
+// When ctx is cancelled it stops before the next stage, with ctx.Err() as the error
+func (imageLoader *ImageLoader) decodeImage(ctx context.Context, currentFile string) *decodedImage {
+	decoded := &decodedImage{}
+
+	// pictures inside of an archive get read into memory and decoded from there
+	var fileData []byte
+	archivePath, entry, inArchive := archive.Split(currentFile)
+	if inArchive {
+		data, err := archive.ReadFileUpTo(archivePath, entry, imageLoader.maxFileSize)
+		if errors.Is(err, archive.ErrTooBig) {
+			decoded.err = errors.New("WARNING: " + entry + " in archive " + archivePath + " is bigger than --max-file-size. Skipping for now")
+			return decoded
+		}
+		if err == nil && len(data) == 0 {
+			err = errors.New("file is empty")
+		}
 		if err != nil {
-			fmt.Println("WARNING: Unable to decode image", currentFile, ". Skipping for now - error: ", err.Error())
-			imageLoader.deleteImageAtIndex(index)
-			return imageLoader.getImage(index)
+			decoded.err = errors.New("WARNING: Unable to read " + entry + " from archive " + archivePath + ". Skipping for now - error: " + err.Error())
+			return decoded
 		}
+		fileData = data
 	} else {
-		texture, err := imageLoader.loadImageByType(currentFile, extension)
+		// checked before it's read, every decoder works from memory so the whole file ends up in there
+		if fileInfo, err := os.Stat(currentFile); err == nil && imageLoader.maxFileSize > 0 && fileInfo.Size() > imageLoader.maxFileSize {
+			decoded.err = errors.New("WARNING: " + currentFile + " is " + strconv.FormatInt(fileInfo.Size()/1024/1024, 10) + " MB, which is bigger than --max-file-size. Skipping for now")
+			return decoded
+		}
+		// every decoder works from memory, it's read in one go instead of each of them opening it their own way
+		data, err := os.ReadFile(currentFile)
+		if errors.Is(err, os.ErrNotExist) {
+			decoded.err = errors.New("WARNING: File does not exist " + currentFile + ". Skipping for now - error: " + err.Error())
+			return decoded
+		}
 		if err != nil {
-			fmt.Println(err)
-			imageLoader.deleteImageAtIndex(index)
-			return imageLoader.getImage(index)
+			decoded.err = errors.New("WARNING: Unable to open file " + currentFile + ". Skipping for now - error: " + err.Error())
+			return decoded
 		}
-		imageData.ImageData = texture
+		fileData = data
+	}
+	if ctx.Err() != nil {
+		decoded.err = ctx.Err()
+		return decoded
 	}
 
-	return imageData
+	// empty for files without one, the decoders go off of what's in the file for those
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(currentFile), "."))
+	decoded.format = extension
+
+	image, animation, raylibOwned, err := imageLoader.loadImageByType(ctx, currentFile, extension, fileData)
+	if err != nil {
+		decoded.err = err
+		return decoded
+	}
+	decoded.image = image
+	decoded.animation = animation
+	decoded.raylibOwned = raylibOwned
+
+	return decoded
+}
+
+// decodeSlide is decodeImage plus the caption, which is read once here instead of by the render loop every frame
+func (imageLoader *ImageLoader) decodeSlide(ctx context.Context, currentFile string) *decodedImage {
+	decoded := imageLoader.decodeImage(ctx, currentFile)
+	if decoded.err == nil && ctx.Err() != nil {
+		decoded.unload()
+		decoded.err = ctx.Err()
+	}
+	if decoded.err == nil {
+		decoded.caption = imageLoader.readCaption(currentFile)
+	}
+	return decoded
 }
 
-func (imageLoader *ImageLoader) loadImageByType(currentFile string, extension string) (*rl.Texture2D, error) {
+// loadImageByType hands the picture to the first registered decoder that takes it.
+// raylibOwned is true when the pixels need an rl.UnloadImage once they're on the GPU.
+// animation is only set for pictures with more than one frame, and those never get cached
+func (imageLoader *ImageLoader) loadImageByType(ctx context.Context, currentFile string, extension string, fileData []byte) (image *rl.Image, animation *Animation, raylibOwned bool, err error) {
 
-	if imageLoader.cacheImages {
-		_, cacheFile := getCacheFileLocation(imageLoader.cacheDirectory, currentFile)
-		cachedImage := loadCachedImage(cacheFile)
+	if imageLoader.cache != nil {
+		cachedImage := imageLoader.cache.load(currentFile)
 		if cachedImage != nil {
-			return cachedImage, nil
+			return cachedImage, nil, true, nil
 		}
 	}
+	// the cache is quick, the decoders aren't
+	if ctx.Err() != nil {
+		return nil, nil, false, ctx.Err()
+	}
 
-	var image *rl.Image
-	var shouldCache bool
-	var err error
+	width, height, _ := probeDimensions(fileData)
+	request := &DecodeRequest{
+		Path:        currentFile,
+		Extension:   extension,
+		Data:        fileData,
+		Width:       width,
+		Height:      height,
+		MaxWidth:    imageLoader.screenWidth,
+		MaxHeight:   imageLoader.screenHeight,
+		imageLoader: imageLoader,
+	}
+	matchingDecoders := decodersFor(request)
+	if len(matchingDecoders) == 0 && imageLoader.tooManyPixels(width, height) {
+		return nil, nil, false, errors.New("WARNING: " + currentFile + " is " + strconv.Itoa(width) + "x" + strconv.Itoa(height) + ", which is over --max-pixels and nothing can shrink it while loading. Skipping for now")
+	}
+	if len(matchingDecoders) == 0 {
+		return nil, nil, false, errors.New("WARNING: Nothing can decode " + currentFile + ". Skipping for now")
+	}
 
-	loadedViaRaylib := false
-
-	switch strings.ToLower(extension) {
-	case "jpg":
-		fallthrough
-	case "jpeg":
-		fallthrough
-	case "png":
-		fallthrough
-	case "bmp":
-		fallthrough
-	case "qoi":
-		image, shouldCache = imageLoader.loadRaylib(currentFile)
-		loadedViaRaylib = true
-		// TODO: get raylib error?
-
-	case "svg":
-		image, shouldCache, err = imageLoader.loadSvg(currentFile)
-
-	default:
-		image, shouldCache, err = imageLoader.loadVips(currentFile)
+	// when one decoder can't do it the next one gets a go, it's only skipped once they've all failed
+	failures := []string{}
+	for _, decoder := range matchingDecoders {
+		if ctx.Err() != nil {
+			return nil, nil, false, ctx.Err()
+		}
+		decoded, err := decoder.Decode(request)
 		if err != nil {
-			errorString := "WARNING: Unable to open image " + currentFile + ". Skipping for now - error: " + err.Error()
-			return nil, errors.New(errorString)
+			failures = append(failures, decoder.Name()+": "+err.Error())
+			continue
 		}
+		if len(failures) > 0 {
+			fmt.Println("Decoded " + currentFile + " with " + decoder.Name() + " instead (" + strings.Join(failures, ", ") + ")")
+		}
+
+		if imageLoader.cache != nil && decoded.Cache {
+			imageLoader.cache.save(currentFile, decoded.Image)
+		}
+		return decoded.Image, decoded.Animation, decoded.RaylibOwned, nil
 	}
 
-	texture := rl.LoadTextureFromImage(image)
-	if imageLoader.cacheImages && shouldCache {
-		cacheDirectory, cacheFile := getCacheFileLocation(imageLoader.cacheDirectory, currentFile)
-		cacheImage(image, cacheDirectory, cacheFile)
+	errorString := "WARNING: Unable to open image " + currentFile + ". Skipping for now - error: " + strings.Join(failures, ", ")
+	return nil, nil, false, errors.New(errorString)
+}
+
+func (imageLoader *ImageLoader) loadRaylib(filename string, fileData []byte) (*rl.Image, bool, error) {
+	// raylib only uses the file type to pick between stb and its own qoi loader, stb works out the rest from the file itself.
+	// The extension could be wrong or missing, so it's not used
+	fileType := ".png"
+	if qoiSignature.matches(fileData) {
+		fileType = ".qoi"
 	}
-	// govips unloads its file in memory, but raylib needs the explicit call
-	if loadedViaRaylib {
-		rl.UnloadImage(image)
+	image := rl.LoadImageFromMemory(fileType, fileData, int32(len(fileData)))
+	// stb gives up on some progressive and unusual files, and raylib hands back an empty image instead of an error
+	if image == nil || image.Data == nil || image.Width == 0 || image.Height == 0 {
+		if image != nil && image.Data != nil {
+			rl.UnloadImage(image)
+		}
+		return nil, false, errors.New("raylib was not able to load it")
 	}
-	return &texture, nil
+
+	return image, imageLoader.fitRaylibImage(image, filename, fileData), nil
 }
 
-func (imageLoader *ImageLoader) loadRaylib(filename string) (*rl.Image, bool) {
-	image := rl.LoadImage(filename)
+// fitRaylibImage turns the picture upright and shrinks it down to the screen, it's true if either happened.
+// The pixels have to be raylib's, they get reallocated
+func (imageLoader *ImageLoader) fitRaylibImage(image *rl.Image, filename string, fileData []byte) bool {
+	// turned upright before the size check, a sideways picture has its width and height swapped
+	orientation := readOrientation(filename, fileData)
+	orientRaylibImage(image, orientation)
+	saveCachedImage := needsOrienting(orientation)
+
 	width := image.Width
 	height := image.Height
 	maxWidth := imageLoader.screenWidth
@@ -122,16 +233,57 @@ func (imageLoader *ImageLoader) loadRaylib(filename string) (*rl.Image, bool) {
 		newWidth := math.Min(float64(maxWidth), scale*float64(width))
 		newHeight := math.Min(float64(maxHeight), scale*float64(height))
 		rl.ImageResize(image, int32(newWidth), int32(newHeight))
-		return image, true
+		saveCachedImage = true
 	}
 
-	return image, false
+	return saveCachedImage
 }
 
-func (imageLoader *ImageLoader) loadVips(filename string) (*rl.Image, bool, error) {
-	imageRef, err := vips.NewImageFromFile(filename)
+// vips can load every frame of these, anything else (like a multi page tiff) only shows the first page
+var animatedVipsSignatures = slices.Concat(heifSignatures, jxlSignatures, []Signature{webpSignature})
+
+func (imageLoader *ImageLoader) loadVips(fileData []byte) (*rl.Image, *Animation, bool, error) {
+	importParams := vips.NewImportParams()
+	if slices.ContainsFunc(animatedVipsSignatures, func(signature Signature) bool { return signature.matches(fileData) }) {
+		importParams.NumPages.Set(-1)
+	}
+	imageRef, err := vips.LoadImageFromBuffer(fileData, importParams)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, false, err
+	}
+	// for the error paths, closing it again once it's been turned into an rl.Image is fine
+	defer imageRef.Close()
+
+	colours := readDynamicRange(fileData, imageRef.GetICCProfile())
+
+	// vips has only read the header so far. Anything over --max-pixels (every frame together, for an animation) is shrunk
+	// while it loads instead. jpgs and webps decode straight to a fraction of their size and everything else a few lines
+	// at a time, so the full size picture is never in memory
+	if imageLoader.tooManyPixels(imageRef.Width(), imageRef.Height()) {
+		imageRef.Close()
+		fmt.Println("Shrinking while loading, it's over --max-pixels")
+		// only the first frame of an animation, and it comes out already upright
+		thumbnail, err := vips.NewThumbnailWithSizeFromBuffer(fileData, int(imageLoader.screenWidth), int(imageLoader.screenHeight), vips.InterestingNone, vips.SizeDown)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		defer thumbnail.Close()
+		image, err := imageLoader.vipsToRlImage(thumbnail, colours)
+		return image, nil, true, err
+	}
+
+	// Pages is how many are in the file even when only the first one was loaded (like a multi page tiff), so it goes
+	// off of how many frames are actually stacked up in the image
+	if pages := imageRef.Height() / imageRef.PageHeight(); pages > 1 {
+		image, animation, err := imageLoader.loadVipsAnimation(imageRef, pages, colours)
+		return image, animation, false, err
+	}
+
+	// HEIF/AVIF come out of vips already upright with the orientation reset to 1
+	orientation := imageRef.Orientation()
+	err = orientVipsImage(imageRef, orientation)
+	if err != nil {
+		return nil, nil, false, err
 	}
 
 	// needed for rpi < 4 mostly. Not sure what texture size an RPI 4 can technically support,
@@ -140,7 +292,7 @@ func (imageLoader *ImageLoader) loadVips(filename string) (*rl.Image, bool, erro
 	height := imageRef.Height()
 	maxWidth := imageLoader.screenWidth
 	maxHeight := imageLoader.screenHeight
-	saveCachedImage := false
+	saveCachedImage := needsOrienting(orientation)
 
 	if width > int(maxWidth) || height > int(maxHeight) {
 		scale := math.Min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
@@ -149,14 +301,124 @@ func (imageLoader *ImageLoader) loadVips(filename string) (*rl.Image, bool, erro
 		saveCachedImage = true
 	}
 
-	image, err := imageRefToRlImage(imageRef)
+	// after the resize so there's less of it to transform, and worth caching since it's not quick either
+	if imageRef.HasICCProfile() || imageLoader.outputProfile != "" || needsEightBit(imageRef, colours) {
+		saveCachedImage = true
+	}
+
+	image, err := imageLoader.vipsToRlImage(imageRef, colours)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, false, err
 	}
-	return image, saveCachedImage, nil
+	return image, nil, saveCachedImage, nil
 
 }
 
+// vipsToRlImage gets a still picture that's already the right size and upright out of vips, as 8 bit sRGB
+// (or --output-profile) pixels
+func (imageLoader *ImageLoader) vipsToRlImage(imageRef *vips.ImageRef, colours dynamicRange) (*rl.Image, error) {
+	// HDR profiles don't go through the ICC transform, the tone mapping takes care of their colours
+	if !colours.isHdr() {
+		err := imageLoader.toOutputProfile(imageRef)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if needsEightBit(imageRef, colours) {
+		return imageLoader.toneMappedImage(imageRef, colours)
+	}
+	return imageRefToRlImage(imageRef)
+}
+
+// vips loads every frame stacked on top of each other in one tall image, pageHeight apart
+func (imageLoader *ImageLoader) loadVipsAnimation(imageRef *vips.ImageRef, pages int, colours dynamicRange) (*rl.Image, *Animation, error) {
+	defer imageRef.Close()
+
+	width := imageRef.Width()
+	pageHeight := imageRef.PageHeight()
+	maxWidth := imageLoader.screenWidth
+	maxHeight := imageLoader.screenHeight
+	if width > int(maxWidth) || pageHeight > int(maxHeight) {
+		scale := math.Min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(pageHeight))
+		// scaled so every frame is still exactly the same height, otherwise they'd slowly drift into each other
+		verticalScale := float64(max(1, int(float64(pageHeight)*scale))) / float64(pageHeight)
+		fmt.Println("Downsizing by ", scale)
+		err := imageRef.ResizeWithVScale(scale, verticalScale, vips.KernelLanczos3)
+		if err != nil {
+			return nil, nil, err
+		}
+		width = imageRef.Width()
+		pageHeight = imageRef.PageHeight()
+	}
+
+	// in milliseconds, and a loop of 0 is forever, same as an Animation
+	vipsDelays, _ := imageRef.PageDelay()
+	loopCount := imageRef.GetInt("loop")
+
+	// every frame gets handed straight to rl.UpdateTexture, so they all have to be 8 bit RGBA
+	if !colours.isHdr() {
+		err := imageLoader.toOutputProfile(imageRef)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var imageBytes []byte
+	var err error
+	if needsEightBit(imageRef, colours) {
+		imageBytes, _, err = imageLoader.toEightBit(imageRef, colours, true)
+	} else {
+		imageBytes, err = rgbaBytes(imageRef)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	frameSize := width * pageHeight * 4
+	if len(imageBytes) < frameSize*pages {
+		return nil, nil, errors.New("expected " + strconv.Itoa(pages) + " frames, but only got " + strconv.Itoa(len(imageBytes)/frameSize))
+	}
+
+	frames := make([][]color.RGBA, pages)
+	delays := make([]time.Duration, pages)
+	for i := range pages {
+		frames[i] = rgbaPixels(imageBytes[i*frameSize : (i+1)*frameSize])
+		// a sequence without any timing (like a HEIF burst) gets a tenth of a second a frame
+		delays[i] = 100 * time.Millisecond
+		if i < len(vipsDelays) {
+			delays[i] = time.Duration(vipsDelays[i]) * time.Millisecond
+		}
+	}
+
+	image := rl.NewImage(imageBytes[:frameSize], int32(width), int32(pageHeight), 1, rl.UncompressedR8g8b8a8)
+	return image, newAnimation(frames, delays, loopCount), nil
+}
+
+func rgbaBytes(imageRef *vips.ImageRef) ([]byte, error) {
+	if imageRef.ColorSpace() != vips.InterpretationSRGB {
+		err := imageRef.ToColorSpace(vips.InterpretationSRGB)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := imageRef.AddAlpha()
+	if err != nil {
+		return nil, err
+	}
+	return imageRef.ToBytes()
+}
+
+func (imageLoader *ImageLoader) toneMappedImage(imageRef *vips.ImageRef, colours dynamicRange) (*rl.Image, error) {
+	defer imageRef.Close()
+	imageBytes, hasAlpha, err := imageLoader.toEightBit(imageRef, colours, false)
+	if err != nil {
+		return nil, err
+	}
+	if hasAlpha {
+		return rl.NewImage(imageBytes, int32(imageRef.Width()), int32(imageRef.Height()), 1, rl.UncompressedR8g8b8a8), nil
+	}
+	return rl.NewImage(imageBytes, int32(imageRef.Width()), int32(imageRef.Height()), 1, rl.UncompressedR8g8b8), nil
+}
+
 func imageRefToRlImage(imageRef *vips.ImageRef) (*rl.Image, error) {
 	if imageRef.ColorSpace() != vips.InterpretationSRGB {
 		err := imageRef.ToColorSpace(vips.InterpretationSRGB)
@@ -181,13 +443,14 @@ func imageRefToRlImage(imageRef *vips.ImageRef) (*rl.Image, error) {
 	return image, nil
 }
 
-func (imageLoader *ImageLoader) loadSvg(filename string) (*rl.Image, bool, error) {
-	imageRef, err := vips.NewThumbnailFromFile(filename, int(imageLoader.screenWidth), int(imageLoader.screenHeight), vips.InterestingNone)
-	if imageRef.ColorSpace() != vips.InterpretationSRGB {
-		err = imageRef.ToColorSpace(vips.InterpretationSRGB)
-		if err != nil {
-			return nil, false, err
-		}
+func (imageLoader *ImageLoader) loadSvg(fileData []byte) (*rl.Image, bool, error) {
+	imageRef, err := vips.NewThumbnailFromBuffer(fileData, int(imageLoader.screenWidth), int(imageLoader.screenHeight), vips.InterestingNone)
+	if err != nil {
+		return nil, false, err
+	}
+	err = imageLoader.toOutputProfile(imageRef)
+	if err != nil {
+		return nil, false, err
 	}
 
 	image, err := imageRefToRlImage(imageRef)
@@ -196,23 +459,3 @@ func (imageLoader *ImageLoader) loadSvg(filename string) (*rl.Image, bool, error
 	}
 	return image, false, nil
 }
-
-func getCacheFileLocation(cacheDirectory string, filename string) (string, string) {
-	originalDirectory := filepath.Dir(filename)
-	cachedDirectory := filepath.Join(cacheDirectory, originalDirectory)
-	cachedFile := filepath.Join(cachedDirectory, filepath.Base(filename)+".jpg")
-	return cachedDirectory, cachedFile
-}
-
-func loadCachedImage(cachedFilename string) *rl.Texture2D {
-	if _, err := os.Stat(cachedFilename); err == nil {
-		texture := rl.LoadTexture(cachedFilename)
-		return &texture
-	}
-	return nil
-}
-
-func cacheImage(image *rl.Image, cacheDirectory string, cacheFilename string) {
-	os.MkdirAll(cacheDirectory, 0755)
-	rl.ExportImage(*image, cacheFilename)
-}
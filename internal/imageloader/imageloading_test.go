@@ -0,0 +1,65 @@
+package imageloader
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// multiPageTiff is an uncompressed 8 bit grey tiff with every page a different shade
+func multiPageTiff(width int, height int, pages int) []byte {
+	data := []byte("II*\x00\x00\x00\x00\x00")
+	nextOffset := 4
+	for page := range pages {
+		pixelOffset := len(data)
+		for range width * height {
+			data = append(data, byte(page*100))
+		}
+		binary.LittleEndian.PutUint32(data[nextOffset:], uint32(len(data)))
+
+		entries := [][3]uint32{
+			// tag, type (3 is a short, 4 is a long), value
+			{256, 4, uint32(width)},
+			{257, 4, uint32(height)},
+			{258, 3, 8},
+			{259, 3, 1},
+			{262, 3, 1},
+			{273, 4, uint32(pixelOffset)},
+			{277, 3, 1},
+			{278, 4, uint32(height)},
+			{279, 4, uint32(width * height)},
+		}
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(entries)))
+		for _, entry := range entries {
+			data = binary.LittleEndian.AppendUint16(data, uint16(entry[0]))
+			data = binary.LittleEndian.AppendUint16(data, uint16(entry[1]))
+			data = binary.LittleEndian.AppendUint32(data, 1)
+			data = binary.LittleEndian.AppendUint32(data, entry[2])
+		}
+		nextOffset = len(data)
+		data = binary.LittleEndian.AppendUint32(data, 0)
+	}
+	return data
+}
+
+func TestMultiPageTiff(t *testing.T) {
+	vips.Startup(nil)
+	imageLoader := &ImageLoader{screenWidth: 1920, screenHeight: 1080, toneMap: "reinhard"}
+
+	// vips says there are 2 pages, but only the first one gets loaded
+	image, animation, _, err := imageLoader.loadVips(multiPageTiff(4, 3, 2))
+	if err != nil {
+		t.Fatalf("Not able to load a 2 page tiff: %s", err.Error())
+	}
+	if animation != nil {
+		t.Errorf("Expected a multi page tiff to be a still picture, got %d frames", animation.FrameCount())
+	}
+	if image.Width != 4 || image.Height != 3 {
+		t.Errorf("Expected only the first 4x3 page, got %dx%d", image.Width, image.Height)
+	}
+	if pixel := rl.GetImageColor(*image, 0, 0); pixel.R != 0 {
+		t.Errorf("Expected the first page to be black, got %v", pixel)
+	}
+}
@@ -0,0 +1,105 @@
+package imageloader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rayimg has been OOM-killed on Pi Zeros before. The watchdog keeps an eye on how much memory the whole process has
+// (raylib's and vips' included, which Go's runtime doesn't know about), and once it's past --memory-limit the pictures
+// decoded ahead of time are dropped. Only the current and next picture get decoded until it's back under
+
+const memoryCheckInterval = time.Second
+
+// readRss is how much of the process is in RAM, /proc/self/statm has it in pages
+func readRss() (int64, error) {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, errors.New("unexpected /proc/self/statm: " + string(statm))
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// totalMemory is all of the RAM in the system, from /proc/meminfo
+func totalMemory() (int64, error) {
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kilobytes, err := strconv.ParseInt(fields[1], 10, 64)
+			return kilobytes * 1024, err
+		}
+	}
+	return 0, errors.New("MemTotal is not in /proc/meminfo")
+}
+
+// watchMemory checks the process every memoryCheckInterval, limit is in bytes (0 for three quarters of the RAM)
+func (imageLoader *ImageLoader) watchMemory(limit int64) {
+	if limit == 0 {
+		total, err := totalMemory()
+		if err != nil {
+			fmt.Println("WARNING: Unable to read how much memory there is, the memory watchdog is off. It can be turned back on with --memory-limit - error: ", err.Error())
+			return
+		}
+		limit = total / 4 * 3
+	}
+	if _, err := readRss(); err != nil {
+		fmt.Println("WARNING: Unable to read how much memory rayimg is using, the memory watchdog is off - error: ", err.Error())
+		return
+	}
+
+	go func() {
+		lowMemory := false
+		for range time.Tick(memoryCheckInterval) {
+			rss, err := readRss()
+			if err != nil {
+				continue
+			}
+			if rss > limit && !lowMemory {
+				fmt.Println("WARNING: Using", strconv.FormatInt(rss/1024/1024, 10), "MB of memory, which is past --memory-limit ("+strconv.FormatInt(limit/1024/1024, 10)+" MB). Dropping pictures decoded ahead of time")
+				lowMemory = true
+				imageLoader.preloader.setLowMemory(true)
+				imageLoader.freeMemory.Store(true)
+			}
+			// a bit under the limit before decoding ahead again, so it doesn't flip back and forth
+			if rss < limit/10*9 && lowMemory {
+				fmt.Println("Back under --memory-limit, decoding ahead again")
+				lowMemory = false
+				imageLoader.preloader.setLowMemory(false)
+			}
+		}
+	}()
+}
+
+// FreeMemoryIfLow drops the pictures decoded ahead of time once the memory watchdog finds rayimg past --memory-limit.
+// It's true when it did, so anything else being held on to (like the next picture's texture) can be let go of too
+func (imageLoader *ImageLoader) FreeMemoryIfLow() bool {
+	if !imageLoader.freeMemory.Swap(false) {
+		return false
+	}
+	imageLoader.preloader.dropPrefetched()
+	// hands what Go was holding on to back to the OS, raylib's pixels are freed right away
+	debug.FreeOSMemory()
+	return true
+}
+
+// LowOnMemory is true while the watchdog has rayimg past --memory-limit
+func (imageLoader *ImageLoader) LowOnMemory() bool {
+	return imageLoader.preloader.isLowMemory()
+}
@@ -0,0 +1,80 @@
+package imageloader
+
+import (
+	"github.com/JarvyJ/rayimg/internal/exif"
+	"github.com/davidbyttow/govips/v2/vips"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// EXIF orientations are a mirror and/or a rotation away from upright:
+// 1 upright, 2 mirrored, 3 upside down, 4 upside down and mirrored,
+// 5 transposed, 6 needs 90° clockwise, 7 transverse, 8 needs 90° counter-clockwise.
+// 0 is what the exif package gives back when there's no tag, and that's upright too
+
+func needsOrienting(orientation int) bool {
+	return orientation >= 2 && orientation <= 8
+}
+
+// rl.LoadImage doesn't look at EXIF at all, so read it from the file (or archive data) separately
+func readOrientation(filename string, fileData []byte) int {
+	if fileData != nil {
+		return exif.Parse(fileData).Orientation
+	}
+	metadata, err := exif.Read(filename)
+	if err != nil {
+		return 0
+	}
+	return metadata.Orientation
+}
+
+// only for images raylib allocated, the rotations swap out the pixel buffer with RL_FREE
+func orientRaylibImage(image *rl.Image, orientation int) {
+	switch orientation {
+	case 2:
+		rl.ImageFlipHorizontal(image)
+	case 3:
+		rl.ImageFlipHorizontal(image)
+		rl.ImageFlipVertical(image)
+	case 4:
+		rl.ImageFlipVertical(image)
+	case 5:
+		rl.ImageRotateCW(image)
+		rl.ImageFlipHorizontal(image)
+	case 6:
+		rl.ImageRotateCW(image)
+	case 7:
+		rl.ImageRotateCW(image)
+		rl.ImageFlipVertical(image)
+	case 8:
+		rl.ImageRotateCCW(image)
+	}
+}
+
+// vips' AutoRotate skips the mirrored ones (2, 4, 5, and 7), so do all of them by hand the same way as raylib.
+// vips' angles are clockwise
+func orientVipsImage(imageRef *vips.ImageRef, orientation int) error {
+	var err error
+	switch orientation {
+	case 2:
+		err = imageRef.Flip(vips.DirectionHorizontal)
+	case 3:
+		err = imageRef.Rotate(vips.Angle180)
+	case 4:
+		err = imageRef.Flip(vips.DirectionVertical)
+	case 5:
+		err = imageRef.Rotate(vips.Angle90)
+		if err == nil {
+			err = imageRef.Flip(vips.DirectionHorizontal)
+		}
+	case 6:
+		err = imageRef.Rotate(vips.Angle90)
+	case 7:
+		err = imageRef.Rotate(vips.Angle90)
+		if err == nil {
+			err = imageRef.Flip(vips.DirectionVertical)
+		}
+	case 8:
+		err = imageRef.Rotate(vips.Angle270)
+	}
+	return err
+}
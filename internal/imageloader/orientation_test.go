@@ -0,0 +1,105 @@
+package imageloader
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// every pixel of the stored picture is a different shade of red, so it's easy to tell where each one ended up
+func pixelColor(x int, y int) color.RGBA {
+	return color.RGBA{uint8(10*x + y + 1), 0, 0, 255}
+}
+
+// the upright picture for each orientation, going by what the EXIF spec says the first row and column of the
+// stored picture are. width and height are the stored picture's, upright returns which stored pixel goes at x,y
+var orientationTests = []struct {
+	orientation int
+	upright     func(x, y, width, height int) (int, int)
+}{
+	{1, func(x, y, width, height int) (int, int) { return x, y }},
+	{2, func(x, y, width, height int) (int, int) { return width - 1 - x, y }},
+	{3, func(x, y, width, height int) (int, int) { return width - 1 - x, height - 1 - y }},
+	{4, func(x, y, width, height int) (int, int) { return x, height - 1 - y }},
+	// the first row is on the left and the first column is at the top
+	{5, func(x, y, width, height int) (int, int) { return y, x }},
+	// the first row is on the right and the first column is at the top
+	{6, func(x, y, width, height int) (int, int) { return y, height - 1 - x }},
+	// the first row is on the right and the first column is at the bottom
+	{7, func(x, y, width, height int) (int, int) { return width - 1 - y, height - 1 - x }},
+	// the first row is on the left and the first column is at the bottom
+	{8, func(x, y, width, height int) (int, int) { return width - 1 - y, x }},
+}
+
+func TestOrientations(t *testing.T) {
+	vips.Startup(nil)
+	// not square, so the rotations that should swap the width and height have to
+	width, height := 3, 2
+	stored := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			stored.SetRGBA(x, y, pixelColor(x, y))
+		}
+	}
+	encoded := bytes.Buffer{}
+	err := png.Encode(&encoded, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range orientationTests {
+		uprightWidth, uprightHeight := width, height
+		if test.orientation >= 5 {
+			uprightWidth, uprightHeight = height, width
+		}
+
+		// the rotations free raylib's pixels, so it has to be an image raylib allocated
+		raylibImage := rl.NewImageFromImage(stored)
+		orientRaylibImage(raylibImage, test.orientation)
+		if int(raylibImage.Width) != uprightWidth || int(raylibImage.Height) != uprightHeight {
+			t.Errorf("Expected orientation %d to be %dx%d with raylib, got %dx%d", test.orientation, uprightWidth, uprightHeight, raylibImage.Width, raylibImage.Height)
+		} else {
+			for y := range uprightHeight {
+				for x := range uprightWidth {
+					storedX, storedY := test.upright(x, y, width, height)
+					if got := rl.GetImageColor(*raylibImage, int32(x), int32(y)); got != pixelColor(storedX, storedY) {
+						t.Errorf("Expected %v at %d,%d for orientation %d with raylib, got %v", pixelColor(storedX, storedY), x, y, test.orientation, got)
+					}
+				}
+			}
+		}
+		rl.UnloadImage(raylibImage)
+
+		imageRef, err := vips.LoadImageFromBuffer(encoded.Bytes(), vips.NewImportParams())
+		if err != nil {
+			t.Fatalf("Not able to load the picture with vips: %s", err.Error())
+		}
+		err = orientVipsImage(imageRef, test.orientation)
+		if err != nil {
+			t.Fatalf("Not able to orient the picture with vips: %s", err.Error())
+		}
+		pixels, err := imageRef.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bands := imageRef.Bands()
+		if imageRef.Width() != uprightWidth || imageRef.Height() != uprightHeight {
+			t.Errorf("Expected orientation %d to be %dx%d with vips, got %dx%d", test.orientation, uprightWidth, uprightHeight, imageRef.Width(), imageRef.Height())
+		} else {
+			for y := range uprightHeight {
+				for x := range uprightWidth {
+					storedX, storedY := test.upright(x, y, width, height)
+					if got := pixels[(y*uprightWidth+x)*bands]; got != pixelColor(storedX, storedY).R {
+						t.Errorf("Expected a red of %d at %d,%d for orientation %d with vips, got %d", pixelColor(storedX, storedY).R, x, y, test.orientation, got)
+					}
+				}
+			}
+		}
+		imageRef.Close()
+	}
+}
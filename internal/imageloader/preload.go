@@ -0,0 +1,275 @@
+package imageloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	rl "github.com/gen2brain/raylib-go/raylib"
+)
+
+// vips already spreads a single decode over every core, so two is mostly about not waiting on the disk
+const decodeWorkers = 2
+
+// decodedImage is everything about a picture that can be done off of the render thread.
+// Only uploading it to the GPU (uploadImage) has to happen on the main thread
+type decodedImage struct {
+	image *rl.Image
+	// raylib allocated the pixels and they need rl.UnloadImage, vips pixels are go memory
+	raylibOwned bool
+	format      string
+	animation   *Animation
+	caption     string
+	err         error
+}
+
+func (decoded *decodedImage) size() int64 {
+	if decoded.image == nil {
+		return 0
+	}
+	// close enough, everything ends up as 8 bit RGB(A)
+	size := int64(decoded.image.Width) * int64(decoded.image.Height) * 4
+	if decoded.animation != nil {
+		size = size * int64(decoded.animation.FrameCount())
+	}
+	return size
+}
+
+func (decoded *decodedImage) unload() {
+	if decoded.raylibOwned && decoded.image != nil {
+		rl.UnloadImage(decoded.image)
+	}
+	decoded.image = nil
+}
+
+// preloader decodes the pictures around the current one on worker goroutines.
+// Pictures that fall out of the window are dropped as soon as the window moves. Anything still being decoded for them
+// is cancelled, decode checks its context between reading, decoding, and the caption, and whatever it got done is thrown away
+type preloader struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	decode func(ctx context.Context, path string) *decodedImage
+	// most important first. The first two (the current and next picture) are always decoded, even when over the memory limit
+	wanted []string
+	// cancels what's being decoded for each path
+	decoding map[string]context.CancelFunc
+	// overwritten while they were being decoded, what's being decoded is already out of date
+	outdated    map[string]bool
+	results     map[string]*decodedImage
+	memoryUsed  int64
+	memoryLimit int64
+	// from the memory watchdog, only the current and next picture are decoded until it's cleared
+	lowMemory bool
+	closed    bool
+}
+
+func newPreloader(decode func(ctx context.Context, path string) *decodedImage, memoryLimit int64) *preloader {
+	preloader := &preloader{
+		decode:      decode,
+		decoding:    make(map[string]context.CancelFunc),
+		outdated:    make(map[string]bool),
+		results:     make(map[string]*decodedImage),
+		memoryLimit: memoryLimit,
+	}
+	preloader.cond = sync.NewCond(&preloader.mutex)
+
+	for range decodeWorkers {
+		go preloader.work()
+	}
+	return preloader
+}
+
+// has to be called with the mutex held
+func (preloader *preloader) nextJob() (string, bool) {
+	for i, path := range preloader.wanted {
+		if _, decoding := preloader.decoding[path]; decoding {
+			continue
+		}
+		if _, done := preloader.results[path]; done {
+			continue
+		}
+		if i > 1 && (preloader.memoryUsed >= preloader.memoryLimit || preloader.lowMemory) {
+			return "", false
+		}
+		return path, true
+	}
+	return "", false
+}
+
+func (preloader *preloader) work() {
+	for {
+		preloader.mutex.Lock()
+		path, ok := preloader.nextJob()
+		for !ok && !preloader.closed {
+			preloader.cond.Wait()
+			path, ok = preloader.nextJob()
+		}
+		if preloader.closed {
+			preloader.mutex.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		preloader.decoding[path] = cancel
+		preloader.mutex.Unlock()
+
+		start := time.Now()
+		decoded := preloader.decode(ctx, path)
+		cancelled := errors.Is(decoded.err, context.Canceled)
+		if !cancelled {
+			fmt.Println("Time to decode: ", time.Now().Sub(start), path)
+		}
+		cancel()
+
+		preloader.mutex.Lock()
+		delete(preloader.decoding, path)
+		if preloader.outdated[path] {
+			// the file changed while it was decoding, it gets picked back up as a new job
+			delete(preloader.outdated, path)
+			decoded.unload()
+		} else if cancelled || preloader.closed || !slices.Contains(preloader.wanted, path) {
+			// skipped past while it was decoding. If it was wanted again in the meantime, it gets picked back up as a new job
+			decoded.unload()
+		} else {
+			preloader.results[path] = decoded
+			preloader.memoryUsed += decoded.size()
+		}
+		preloader.cond.Broadcast()
+		preloader.mutex.Unlock()
+	}
+}
+
+// want replaces the window of pictures to keep decoded, and drops anything that isn't in it anymore
+func (preloader *preloader) want(paths []string) {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	preloader.wanted = paths
+	for path, cancel := range preloader.decoding {
+		if !slices.Contains(paths, path) {
+			cancel()
+		}
+	}
+	for path, decoded := range preloader.results {
+		if !slices.Contains(paths, path) {
+			preloader.memoryUsed -= decoded.size()
+			decoded.unload()
+			delete(preloader.results, path)
+		}
+	}
+	preloader.cond.Broadcast()
+}
+
+func (preloader *preloader) setLowMemory(lowMemory bool) {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	preloader.lowMemory = lowMemory
+	preloader.cond.Broadcast()
+}
+
+func (preloader *preloader) isLowMemory() bool {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+	return preloader.lowMemory
+}
+
+// dropPrefetched frees everything decoded ahead of time except the current and next picture. It has to be called from the
+// main thread, the current picture could be getting uploaded to the GPU otherwise
+func (preloader *preloader) dropPrefetched() {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	keep := preloader.wanted[:min(2, len(preloader.wanted))]
+	for path, decoded := range preloader.results {
+		if !slices.Contains(keep, path) {
+			preloader.memoryUsed -= decoded.size()
+			decoded.unload()
+			delete(preloader.results, path)
+		}
+	}
+}
+
+// forget throws away what was decoded for path so it's decoded again, for when the file is overwritten. It has to be
+// called from the main thread, same as dropPrefetched
+func (preloader *preloader) forget(path string) {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	if decoded, ok := preloader.results[path]; ok {
+		preloader.memoryUsed -= decoded.size()
+		decoded.unload()
+		delete(preloader.results, path)
+	}
+	if cancel, ok := preloader.decoding[path]; ok {
+		preloader.outdated[path] = true
+		cancel()
+	}
+	preloader.cond.Broadcast()
+}
+
+// takeFailed hands back (and forgets about) every picture that couldn't be decoded, with why
+func (preloader *preloader) takeFailed() map[string]error {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	failed := make(map[string]error)
+	for path, decoded := range preloader.results {
+		if decoded.err == nil {
+			continue
+		}
+		failed[path] = decoded.err
+		delete(preloader.results, path)
+		// otherwise a worker could pick it back up before the window is moved
+		preloader.wanted = slices.DeleteFunc(slices.Clone(preloader.wanted), func(wanted string) bool {
+			return wanted == path
+		})
+	}
+	return failed
+}
+
+func (preloader *preloader) ready(path string) bool {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+	// anything that failed isn't ready, it's waiting on takeFailed to be skipped
+	decoded, ok := preloader.results[path]
+	return ok && decoded.err == nil
+}
+
+// wait blocks until path is decoded, jumping it to the front of the line if it has to
+func (preloader *preloader) wait(path string) *decodedImage {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	if index := slices.Index(preloader.wanted, path); index != 0 {
+		if index > 0 {
+			preloader.wanted = slices.Delete(slices.Clone(preloader.wanted), index, index+1)
+		}
+		preloader.wanted = append([]string{path}, preloader.wanted...)
+		preloader.cond.Broadcast()
+	}
+	for {
+		if decoded, ok := preloader.results[path]; ok {
+			return decoded
+		}
+		preloader.cond.Wait()
+	}
+}
+
+func (preloader *preloader) close() {
+	preloader.mutex.Lock()
+	defer preloader.mutex.Unlock()
+
+	preloader.closed = true
+	for _, cancel := range preloader.decoding {
+		cancel()
+	}
+	for path, decoded := range preloader.results {
+		decoded.unload()
+		delete(preloader.results, path)
+	}
+	preloader.cond.Broadcast()
+}
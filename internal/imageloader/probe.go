@@ -0,0 +1,54 @@
+package imageloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	goimage "image"
+	"math"
+)
+
+// a 30000x30000 png is only a few megabytes on disk, but it's 3.6GB once raylib has decoded it. Checking the size in
+// the header first means pictures like that only go to decoders that can shrink them down while they load
+
+// probeDimensions reads the width and height out of the header without decoding anything. It covers everything a decoder
+// without ShrinkOnLoad takes (jpg, png, gif, bmp, and qoi), vips reads the size of everything else before decoding it
+func probeDimensions(fileData []byte) (int, int, bool) {
+	switch {
+	case qoiSignature.matches(fileData) && len(fileData) >= 12:
+		return dimension(int64(binary.BigEndian.Uint32(fileData[4:]))), dimension(int64(binary.BigEndian.Uint32(fileData[8:]))), true
+
+	case bmpSignature.matches(fileData) && len(fileData) >= 26:
+		// really old (OS/2) bmps have a smaller header, with 16 bit sizes
+		if binary.LittleEndian.Uint32(fileData[14:]) == 12 {
+			return int(binary.LittleEndian.Uint16(fileData[18:])), int(binary.LittleEndian.Uint16(fileData[20:])), true
+		}
+		width := int64(int32(binary.LittleEndian.Uint32(fileData[18:])))
+		// negative for pictures stored top to bottom
+		height := int64(int32(binary.LittleEndian.Uint32(fileData[22:])))
+		return dimension(max(width, -width)), dimension(max(height, -height)), true
+	}
+
+	// jpg, png, and gif are all registered with Go's image package
+	config, _, err := goimage.DecodeConfig(bytes.NewReader(fileData))
+	if err != nil {
+		return 0, 0, false
+	}
+	return config.Width, config.Height, true
+}
+
+// dimension keeps a size from the header from going negative in an int on 32 bit. Anything that big is way over
+// --max-pixels either way
+func dimension(size int64) int {
+	return int(min(size, math.MaxInt32))
+}
+
+// tooManyPixels is true for pictures over --max-pixels
+func (imageLoader *ImageLoader) tooManyPixels(width int, height int) bool {
+	return imageLoader.maxPixels > 0 && int64(width)*int64(height) > imageLoader.maxPixels
+}
+
+// animationTooBig is true when every frame of an animation put together would be past --max-pixels, each one is a
+// full copy of the picture
+func animationTooBig(frames int, width int, height int, maxPixels int64) bool {
+	return maxPixels > 0 && int64(frames)*int64(width)*int64(height) > maxPixels
+}
@@ -0,0 +1,59 @@
+package imageloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math"
+	"testing"
+)
+
+func TestProbeDimensions(t *testing.T) {
+	pngData := bytes.Buffer{}
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 30, 20)))
+	gifData := bytes.Buffer{}
+	gif.Encode(&gifData, image.NewPaletted(image.Rect(0, 0, 7, 5), []color.Color{color.Black}), nil)
+
+	// only the headers, there's no need for any pixels
+	qoi := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32([]byte("qoif"), 30000), 30000)
+	bmp := make([]byte, 26)
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[14:], 40)
+	binary.LittleEndian.PutUint32(bmp[18:], 640)
+	binary.LittleEndian.PutUint32(bmp[22:], uint32(0xFFFFFFFF-480+1))
+	hugeQoi := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32([]byte("qoif"), 0xFFFFFFFF), 0x80000000)
+	hugeBmp := bytes.Clone(bmp)
+	binary.LittleEndian.PutUint32(hugeBmp[18:], 0x80000000)
+
+	expected := []struct {
+		name          string
+		data          []byte
+		width, height int
+		ok            bool
+	}{
+		{"png", pngData.Bytes(), 30, 20, true},
+		{"gif", gifData.Bytes(), 7, 5, true},
+		{"qoi", qoi, 30000, 30000, true},
+		{"top down bmp", bmp, 640, 480, true},
+		{"huge qoi", hugeQoi, math.MaxInt32, math.MaxInt32, true},
+		{"huge bmp", hugeBmp, math.MaxInt32, 480, true},
+		{"heic", []byte("\x00\x00\x00\x18ftypheic"), 0, 0, false},
+	}
+	for _, test := range expected {
+		width, height, ok := probeDimensions(test.data)
+		if width != test.width || height != test.height || ok != test.ok {
+			t.Errorf("Expected the %s to be %dx%d (%t), got %dx%d (%t)", test.name, test.width, test.height, test.ok, width, height, ok)
+		}
+	}
+
+	imageLoader := &ImageLoader{maxPixels: 40 * 1000 * 1000}
+	if imageLoader.tooManyPixels(640, 480) || !imageLoader.tooManyPixels(30000, 30000) {
+		t.Error("Expected only the 30000x30000 picture to be over 40 megapixels")
+	}
+	if width, height, _ := probeDimensions(hugeQoi); !imageLoader.tooManyPixels(width, height) {
+		t.Error("Expected a qoi with a 4294967295 pixel width to be over 40 megapixels")
+	}
+}
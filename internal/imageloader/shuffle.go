@@ -0,0 +1,151 @@
+package imageloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+)
+
+// how many pictures from the end of one cycle are kept out of the start of the next one
+const shuffleMemory = 5
+
+// only the order is saved here, and only once per cycle.
+// The current picture is in the resume state, since that gets rewritten every slide
+type shuffleState struct {
+	Cycle []string
+}
+
+func (imageLoader *ImageLoader) avoidCount() int {
+	return min(shuffleMemory, len(imageLoader.listOfFiles)/2)
+}
+
+func (imageLoader *ImageLoader) recentlyShown() map[string]bool {
+	recent := make(map[string]bool)
+	for _, path := range imageLoader.listOfFiles[len(imageLoader.listOfFiles)-imageLoader.avoidCount():] {
+		recent[path] = true
+	}
+	return recent
+}
+
+// the next cycle's first picture gets picked early, so it can be peeked for the crossfade
+func (imageLoader *ImageLoader) pickNextCycleStart() string {
+	recent := imageLoader.recentlyShown()
+	candidates := []string{}
+	for _, path := range imageLoader.listOfFiles {
+		if !recent[path] {
+			candidates = append(candidates, path)
+		}
+	}
+	if len(candidates) == 0 {
+		return imageLoader.listOfFiles[0]
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// shuffleCycle makes a new order where none of the last `avoid` pictures of files are in the first `avoid` spots
+func shuffleCycle(files []string, avoid int, first string) []string {
+	recent := []string{}
+	others := []string{}
+	for i, path := range files {
+		if i >= len(files)-avoid {
+			recent = append(recent, path)
+		} else {
+			others = append(others, path)
+		}
+	}
+
+	rand.Shuffle(len(others), func(i, j int) {
+		others[i], others[j] = others[j], others[i]
+	})
+	tail := append(slices.Clone(others[avoid:]), recent...)
+	rand.Shuffle(len(tail), func(i, j int) {
+		tail[i], tail[j] = tail[j], tail[i]
+	})
+	cycle := append(others[:avoid], tail...)
+
+	if index := slices.Index(cycle, first); index > 0 {
+		cycle = slices.Delete(cycle, index, index+1)
+		cycle = slices.Insert(cycle, 0, first)
+	}
+	return cycle
+}
+
+func (imageLoader *ImageLoader) startNewCycle() {
+	first := imageLoader.nextCycleStart
+	if !slices.Contains(imageLoader.listOfFiles, first) {
+		first = ""
+	}
+	imageLoader.listOfFiles = shuffleCycle(imageLoader.listOfFiles, imageLoader.avoidCount(), first)
+	imageLoader.currentIndex = 0
+	imageLoader.nextCycleStart = ""
+	imageLoader.saveShuffleState()
+}
+
+// picks up the saved cycle where it left off. Removed pictures are dropped,
+// and new ones get shuffled into what's left of the cycle (after currentPath) so they still show up in it
+func (imageLoader *ImageLoader) loadShuffleState(currentPath string) {
+	data, err := os.ReadFile(imageLoader.shuffleStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		imageLoader.saveShuffleState()
+		return
+	}
+	if err != nil {
+		fmt.Println("WARNING: Unable to read shuffle state", imageLoader.shuffleStateFile, ". Starting a new cycle - error: ", err.Error())
+		imageLoader.saveShuffleState()
+		return
+	}
+
+	state := shuffleState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		fmt.Println("WARNING: Unable to parse shuffle state", imageLoader.shuffleStateFile, ". Starting a new cycle - error: ", err.Error())
+		imageLoader.saveShuffleState()
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, path := range imageLoader.listOfFiles {
+		present[path] = true
+	}
+	cycle := []string{}
+	inCycle := make(map[string]bool)
+	for _, path := range state.Cycle {
+		if present[path] && !inCycle[path] {
+			cycle = append(cycle, path)
+			inCycle[path] = true
+		}
+	}
+
+	currentIndex := max(slices.Index(cycle, currentPath), 0)
+
+	for _, path := range imageLoader.listOfFiles {
+		if !inCycle[path] {
+			index := 0
+			if len(cycle) > 0 {
+				index = currentIndex + 1 + rand.Intn(len(cycle)-currentIndex)
+			}
+			cycle = slices.Insert(cycle, index, path)
+		}
+	}
+
+	imageLoader.listOfFiles = cycle
+	fmt.Println("Continuing shuffle from", imageLoader.shuffleStateFile)
+	imageLoader.saveShuffleState()
+}
+
+func (imageLoader *ImageLoader) saveShuffleState() {
+	if imageLoader.shuffleStateFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(shuffleState{Cycle: imageLoader.listOfFiles})
+	if err == nil {
+		err = writeFileAtomic(imageLoader.shuffleStateFile, data)
+	}
+	if err != nil {
+		fmt.Println("WARNING: Unable to save shuffle state - error: ", err.Error())
+	}
+}
@@ -0,0 +1,124 @@
+package imageloader
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func numberedFiles(count int) []string {
+	files := []string{}
+	for i := range count {
+		files = append(files, strconv.Itoa(i)+".jpg")
+	}
+	return files
+}
+
+// playCycles goes through the slideshow the same way the render loop does, and returns what was shown in each cycle
+func playCycles(t *testing.T, imageLoader *ImageLoader, cycles int) [][]string {
+	shown := [][]string{}
+	for range cycles {
+		cycle := []string{}
+		for range len(imageLoader.listOfFiles) {
+			cycle = append(cycle, imageLoader.listOfFiles[imageLoader.currentIndex])
+			// peeking for the crossfade is what picks the next cycle's first picture
+			nextImageIndex, _ := imageLoader.nextImageIndex()
+			next := imageLoader.listOfFiles[nextImageIndex]
+			imageLoader.IncreaseCurrentIndex()
+			if current := imageLoader.listOfFiles[imageLoader.currentIndex]; current != next {
+				t.Fatalf("Expected %s after moving forward, got %s", next, current)
+			}
+		}
+		shown = append(shown, cycle)
+	}
+	return shown
+}
+
+func TestShuffleShowsEveryPictureOncePerCycle(t *testing.T) {
+	files := numberedFiles(20)
+	imageLoader := testImageLoader(nil, slices.Clone(files)...)
+	defer imageLoader.Close()
+	imageLoader.sortBy = "shuffle"
+
+	for i, cycle := range playCycles(t, imageLoader, 10) {
+		slices.Sort(cycle)
+		sorted := slices.Clone(files)
+		slices.Sort(sorted)
+		if !slices.Equal(cycle, sorted) {
+			t.Errorf("Expected every picture once in cycle %d, got %v", i, cycle)
+		}
+	}
+}
+
+func TestShuffleDoesNotRepeatAcrossCycles(t *testing.T) {
+	imageLoader := testImageLoader(nil, numberedFiles(12)...)
+	defer imageLoader.Close()
+	imageLoader.sortBy = "shuffle"
+
+	cycles := playCycles(t, imageLoader, 50)
+	for i := 1; i < len(cycles); i++ {
+		endOfLast := cycles[i-1][len(cycles[i-1])-shuffleMemory:]
+		for _, path := range cycles[i][:shuffleMemory] {
+			if slices.Contains(endOfLast, path) {
+				t.Errorf("Expected %s to not be at the start of cycle %d, it was at the end of the one before: %v then %v", path, i, cycles[i-1], cycles[i])
+			}
+		}
+	}
+
+	// with only a couple pictures there's nothing to keep apart, it still has to go through all of them
+	imageLoader = testImageLoader(nil, "a.jpg", "b.jpg")
+	defer imageLoader.Close()
+	imageLoader.sortBy = "shuffle"
+	for _, cycle := range playCycles(t, imageLoader, 5) {
+		slices.Sort(cycle)
+		if !slices.Equal(cycle, []string{"a.jpg", "b.jpg"}) {
+			t.Errorf("Expected both pictures in every cycle, got %v", cycle)
+		}
+	}
+}
+
+func TestShuffleStateWithChangedFiles(t *testing.T) {
+	shuffleStateFile := filepath.Join(t.TempDir(), "shuffle.json")
+	imageLoader := testImageLoader(nil, "a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg")
+	defer imageLoader.Close()
+	imageLoader.sortBy = "shuffle"
+	imageLoader.shuffleStateFile = shuffleStateFile
+	imageLoader.listOfFiles = []string{"d.jpg", "b.jpg", "e.jpg", "a.jpg", "c.jpg"}
+	imageLoader.saveShuffleState()
+
+	// the same pictures come back in the saved order
+	imageLoader.listOfFiles = []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg", "e.jpg"}
+	imageLoader.loadShuffleState("e.jpg")
+	if !slices.Equal(imageLoader.listOfFiles, []string{"d.jpg", "b.jpg", "e.jpg", "a.jpg", "c.jpg"}) {
+		t.Errorf("Expected the saved cycle, got %v", imageLoader.listOfFiles)
+	}
+
+	// b.jpg is gone and f.jpg and g.jpg are new, the new ones go in what's left of the cycle after e.jpg
+	imageLoader.listOfFiles = []string{"a.jpg", "c.jpg", "d.jpg", "e.jpg", "f.jpg", "g.jpg"}
+	imageLoader.loadShuffleState("e.jpg")
+	cycle := imageLoader.listOfFiles
+	if len(cycle) != 6 || slices.Contains(cycle, "b.jpg") {
+		t.Fatalf("Expected b.jpg to be dropped and the rest kept, got %v", cycle)
+	}
+	if !slices.Equal(slices.DeleteFunc(slices.Clone(cycle), func(path string) bool { return path == "f.jpg" || path == "g.jpg" }), []string{"d.jpg", "e.jpg", "a.jpg", "c.jpg"}) {
+		t.Errorf("Expected what was left of the saved cycle to stay in order, got %v", cycle)
+	}
+	for _, path := range []string{"f.jpg", "g.jpg"} {
+		if slices.Index(cycle, path) <= slices.Index(cycle, "e.jpg") {
+			t.Errorf("Expected %s to be after the current picture, got %v", path, cycle)
+		}
+	}
+
+	// and it's saved with the changes
+	data, err := os.ReadFile(shuffleStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageLoader.listOfFiles = []string{"c.jpg", "d.jpg"}
+	imageLoader.loadShuffleState("c.jpg")
+	if !slices.Equal(imageLoader.listOfFiles, []string{"d.jpg", "c.jpg"}) {
+		t.Errorf("Expected only d.jpg and c.jpg in the saved order, got %v from %s", imageLoader.listOfFiles, data)
+	}
+}
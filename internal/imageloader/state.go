@@ -0,0 +1,134 @@
+package imageloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/JarvyJ/rayimg/internal/fileloader"
+)
+
+// the state file is usually on a Pi's SD card, which wears out from being written every slide.
+// It's only written when the picture changed, and at most this often (or when rayimg quits)
+const stateSaveInterval = 30 * time.Second
+
+// what was on screen last, so a power cycle doesn't start over at the first picture every time
+type resumeState struct {
+	Path     string
+	Position int
+}
+
+// write then rename, so losing power halfway through doesn't leave a half written file behind.
+// The sync makes sure what was written is on disk before the rename can be, otherwise it can still end up empty
+func writeFileAtomic(filename string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	temporaryFile := filename + ".tmp"
+	file, err := os.Create(temporaryFile)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(temporaryFile, filename)
+}
+
+func (imageLoader *ImageLoader) readResumeState() resumeState {
+	state := resumeState{}
+	if imageLoader.stateFile == "" {
+		return state
+	}
+
+	data, err := os.ReadFile(imageLoader.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state
+	}
+	if err != nil {
+		fmt.Println("WARNING: Unable to read", imageLoader.stateFile, ". Starting from the beginning - error: ", err.Error())
+		return state
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		fmt.Println("WARNING: Unable to parse", imageLoader.stateFile, ". Starting from the beginning - error: ", err.Error())
+		return resumeState{}
+	}
+	return state
+}
+
+func (imageLoader *ImageLoader) resume(state resumeState) {
+	if state.Path == "" {
+		return
+	}
+
+	if index := slices.Index(imageLoader.listOfFiles, state.Path); index != -1 {
+		imageLoader.currentIndex = index
+		fmt.Println("Resuming slideshow from: ", state.Path)
+		return
+	}
+
+	// the picture is gone, so go with whatever would've come after it
+	index, ok := fileloader.NeighbourIndex(imageLoader.sortBy, imageLoader.sortedFiles(), state.Path)
+	if !ok {
+		index = state.Position
+	}
+	if index < 0 || index >= len(imageLoader.listOfFiles) {
+		index = 0
+	}
+	imageLoader.currentIndex = index
+	fmt.Println("Last shown picture", state.Path, "is gone. Resuming slideshow from: ", imageLoader.listOfFiles[index])
+}
+
+// saveState keeps track of where the slideshow is, it's written out by writeState
+func (imageLoader *ImageLoader) saveState() {
+	if imageLoader.stateFile == "" {
+		return
+	}
+	imageLoader.state = resumeState{
+		Path:     imageLoader.listOfFiles[imageLoader.currentIndex],
+		Position: imageLoader.currentIndex,
+	}
+	imageLoader.writeState(false)
+}
+
+// SaveStateIfDue writes out the slideshow position once stateSaveInterval has passed, if it changed since the last time.
+// It's cheap enough to call every frame
+func (imageLoader *ImageLoader) SaveStateIfDue() {
+	imageLoader.writeState(false)
+}
+
+// force skips waiting for stateSaveInterval, for when rayimg quits
+func (imageLoader *ImageLoader) writeState(force bool) {
+	if imageLoader.stateFile == "" || imageLoader.state == imageLoader.savedState {
+		return
+	}
+	if !force && time.Since(imageLoader.stateSavedAt) < stateSaveInterval {
+		return
+	}
+
+	data, err := json.Marshal(imageLoader.state)
+	if err == nil {
+		err = writeFileAtomic(imageLoader.stateFile, data)
+	}
+	if err != nil {
+		fmt.Println("WARNING: Unable to save slideshow position to", imageLoader.stateFile, "- error: ", err.Error())
+	}
+	// tried either way, so a broken state file doesn't get retried every frame
+	imageLoader.savedState = imageLoader.state
+	imageLoader.stateSavedAt = time.Now()
+}
@@ -0,0 +1,98 @@
+package imageloader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeFromRemovedFile(t *testing.T) {
+	tests := []struct {
+		sortBy   string
+		files    []string
+		state    resumeState
+		expected int
+	}{
+		{"filename", []string{"a.jpg", "b.jpg", "d.jpg", "e.jpg"}, resumeState{"a.jpg", 0}, 0},
+		// whatever came after it
+		{"filename", []string{"a.jpg", "b.jpg", "d.jpg", "e.jpg"}, resumeState{"c.jpg", 0}, 2},
+		{"natural", []string{"img1.jpg", "img3.jpg", "img10.jpg"}, resumeState{"img2.jpg", 0}, 1},
+		{"natural", []string{"img1.jpg", "img3.jpg", "img10.jpg"}, resumeState{"img4.jpg", 0}, 2},
+		// the last one was removed, so it's back around to the start
+		{"filename", []string{"a.jpg", "b.jpg"}, resumeState{"c.jpg", 1}, 0},
+		// there's no telling where it would've been, so it goes by where it was
+		{"random", []string{"d.jpg", "a.jpg", "b.jpg"}, resumeState{"c.jpg", 1}, 1},
+		{"random", []string{"d.jpg", "a.jpg", "b.jpg"}, resumeState{"c.jpg", 5}, 0},
+	}
+
+	for _, test := range tests {
+		imageLoader := &ImageLoader{listOfFiles: test.files, sortBy: test.sortBy}
+		imageLoader.resume(test.state)
+		if imageLoader.currentIndex != test.expected {
+			t.Errorf("Expected to resume %s from %d (%s) in %s sort, got %d", test.state.Path, test.expected, test.files[test.expected], test.sortBy, imageLoader.currentIndex)
+		}
+	}
+}
+
+func TestResumeWithPlaylistFiles(t *testing.T) {
+	// a.jpg came from a playlist, so it's not part of the sorted pictures
+	imageLoader := &ImageLoader{listOfFiles: []string{"b.jpg", "d.jpg", "a.jpg"}, playlistFiles: 1, sortBy: "filename"}
+	imageLoader.resume(resumeState{"c.jpg", 0})
+	if imageLoader.currentIndex != 1 {
+		t.Errorf("Expected to resume c.jpg from 1 (d.jpg), got %d", imageLoader.currentIndex)
+	}
+}
+
+func TestSaveStateOnlyWhenChanged(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	imageLoader := testImageLoader(nil, "a.jpg", "b.jpg", "c.jpg")
+	imageLoader.stateFile = stateFile
+
+	savedPath := func() string {
+		data, err := os.ReadFile(stateFile)
+		if err != nil {
+			return ""
+		}
+		state := resumeState{}
+		json.Unmarshal(data, &state)
+		return state.Path
+	}
+
+	// the first one is written right away
+	imageLoader.IncreaseCurrentIndex()
+	if savedPath() != "b.jpg" {
+		t.Errorf("Expected b.jpg to be saved, got %q", savedPath())
+	}
+
+	// but not again until stateSaveInterval has gone by
+	imageLoader.IncreaseCurrentIndex()
+	imageLoader.SaveStateIfDue()
+	if savedPath() != "b.jpg" {
+		t.Errorf("Expected b.jpg to still be saved, got %q", savedPath())
+	}
+	imageLoader.stateSavedAt = time.Now().Add(-stateSaveInterval)
+	imageLoader.SaveStateIfDue()
+	if savedPath() != "c.jpg" {
+		t.Errorf("Expected c.jpg to be saved once stateSaveInterval went by, got %q", savedPath())
+	}
+
+	// nothing changed, so nothing's written
+	os.Remove(stateFile)
+	imageLoader.stateSavedAt = time.Now().Add(-stateSaveInterval)
+	imageLoader.SaveStateIfDue()
+	if _, err := os.Stat(stateFile); err == nil {
+		t.Error("Expected the state to not be written again when the picture didn't change")
+	}
+
+	// quitting doesn't wait
+	imageLoader.IncreaseCurrentIndex()
+	imageLoader.Close()
+	if savedPath() != "a.jpg" {
+		t.Errorf("Expected a.jpg to be saved on close, got %q", savedPath())
+	}
+	if _, err := os.Stat(stateFile + ".tmp"); err == nil {
+		t.Error("Expected the temporary file to be renamed")
+	}
+}
@@ -0,0 +1,307 @@
+package imageloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// the screen (and raylib) only does 8 bit SDR, so anything with more bits than that or HDR brightness gets turned into
+// 8 bit sRGB here instead of handing vips' 16 bit or float pixels to rl.NewImage. HDR gets tone mapped so the highlights
+// roll off instead of clipping, and the BT.2020 colours most of it uses are mapped to sRGB
+
+type transferFunction int
+
+const (
+	transferSrgb transferFunction = iota
+	transferLinear
+	transferPQ
+	transferHLG
+)
+
+// brightness that SDR white is mapped to in HDR, from ITU-R BT.2408
+const sdrWhiteNits = 203
+
+type dynamicRange struct {
+	transfer transferFunction
+	bt2020   bool
+}
+
+func (colours dynamicRange) isHdr() bool {
+	return colours.transfer == transferPQ || colours.transfer == transferHLG
+}
+
+// coding-independent code points (ITU-T H.273), the same numbers in png, avif, and heif
+func cicpDynamicRange(primaries byte, transfer byte) dynamicRange {
+	colours := dynamicRange{bt2020: primaries == 9}
+	switch transfer {
+	case 8:
+		colours.transfer = transferLinear
+	case 16:
+		colours.transfer = transferPQ
+	case 18:
+		colours.transfer = transferHLG
+	}
+	return colours
+}
+
+// readDynamicRange works out how the pixel values map to brightness, from the cICP chunk in a png, the nclx colour box
+// in an avif/heif, or otherwise the name of the ICC profile (which is how libjxl and most editors mark HDR)
+func readDynamicRange(fileData []byte, iccProfile []byte) dynamicRange {
+	chunks, err := readPngChunks(fileData)
+	if err == nil {
+		for _, chunk := range chunks {
+			if chunk.chunkType == "IDAT" {
+				break
+			}
+			if chunk.chunkType == "cICP" && len(chunk.data) >= 2 {
+				return cicpDynamicRange(chunk.data[0], chunk.data[1])
+			}
+		}
+	}
+
+	// the meta box is right at the start of the file, before all the image data
+	header := fileData[:min(len(fileData), 64*1024)]
+	if nclx := bytes.Index(header, []byte("colrnclx")); nclx != -1 && nclx+12 <= len(header) {
+		primaries := binary.BigEndian.Uint16(header[nclx+8:])
+		transfer := binary.BigEndian.Uint16(header[nclx+10:])
+		if primaries < 256 && transfer < 256 {
+			return cicpDynamicRange(byte(primaries), byte(transfer))
+		}
+	}
+
+	description := iccDescription(iccProfile)
+	colours := dynamicRange{bt2020: strings.Contains(description, "2020") || strings.Contains(description, "2100") || strings.Contains(description, "_202_")}
+	// libjxl calls PQ "PeQ"
+	if strings.Contains(description, "PQ") || strings.Contains(description, "PeQ") {
+		colours.transfer = transferPQ
+	} else if strings.Contains(description, "HLG") {
+		colours.transfer = transferHLG
+	}
+	return colours
+}
+
+// isHighBitDepthPng checks the bit depth in the IHDR, raylib would hand those back as 16 bit pixels
+func isHighBitDepthPng(fileData []byte) bool {
+	return bytes.HasPrefix(fileData, pngSignature) && len(fileData) > 24 && fileData[24] == 16
+}
+
+// pqToNits is the SMPTE ST 2084 EOTF
+func pqToNits(signal float64) float64 {
+	const m1 = 2610.0 / 16384
+	const m2 = 2523.0 / 4096 * 128
+	const c1 = 3424.0 / 4096
+	const c2 = 2413.0 / 4096 * 32
+	const c3 = 2392.0 / 4096 * 32
+	power := math.Pow(max(signal, 0), 1/m2)
+	return 10000 * math.Pow(max(power-c1, 0)/(c2-c3*power), 1/m1)
+}
+
+// hlgToScene is the inverse of the ARIB STD-B67 OETF, 0-1 of the scene light
+func hlgToScene(signal float64) float64 {
+	const a = 0.17883277
+	const b = 1 - 4*a
+	const c = 0.55991073
+	if signal <= 0.5 {
+		return signal * signal / 3
+	}
+	return (math.Exp((signal-c)/a) + b) / 12
+}
+
+func srgbToLinear(value float64) float64 {
+	if value <= 0.04045 {
+		return value / 12.92
+	}
+	return math.Pow((value+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) float64 {
+	if value <= 0.0031308 {
+		return value * 12.92
+	}
+	return 1.055*math.Pow(value, 1/2.4) - 0.055
+}
+
+// hable is John Hable's filmic curve from Uncharted 2
+func hable(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
+
+// toneMapValue squeezes value (1 is SDR white) into 0-1, peak being the brightest value in the picture
+func toneMapValue(value float64, peak float64, operator string) float64 {
+	switch operator {
+	case "reinhard":
+		// extended Reinhard, the peak ends up at exactly 1 and anything at SDR brightness barely changes
+		return value * (1 + value/(peak*peak)) / (1 + value)
+	case "hable":
+		const exposureBias = 2
+		return hable(value*exposureBias) / hable(peak*exposureBias)
+	case "aces":
+		// Krzysztof Narkowicz's fit of the ACES filmic curve
+		value = value * 0.6
+		return min(1, value*(2.51*value+0.03)/(value*(2.43*value+0.59)+0.14))
+	}
+	return min(1, value)
+}
+
+// toneMapPixels turns 1-4 bands of 0-1 samples (past 1 for linear HDR) into 8 bit sRGB, RGBA if there was alpha
+// (or forceAlpha is set) and RGB otherwise. SDR pictures are only converted, the operator is only for pictures
+// brighter than SDR white
+func toneMapPixels(sample func(i int) float64, pixelCount int, bands int, colours dynamicRange, operator string, forceAlpha bool) []byte {
+	colourBands := 3
+	if bands < 3 {
+		colourBands = 1
+	}
+	hasAlpha := bands == 2 || bands == 4
+
+	// linear light where 1 is SDR white. Samples are at most 16 bits, so a table saves a math.Pow for every one of them
+	var toLinear func(value float64) float64
+	if colours.transfer == transferLinear {
+		toLinear = func(value float64) float64 {
+			return value
+		}
+	} else {
+		linearTable := make([]float64, 65536)
+		for i := range linearTable {
+			value := float64(i) / 65535
+			switch colours.transfer {
+			case transferPQ:
+				linearTable[i] = pqToNits(value) / sdrWhiteNits
+			case transferHLG:
+				// HLG is scene light, the system gamma is handled per pixel below
+				linearTable[i] = hlgToScene(value)
+			default:
+				linearTable[i] = srgbToLinear(value)
+			}
+		}
+		toLinear = func(value float64) float64 {
+			return linearTable[int(math.Round(min(max(value, 0), 1)*65535))]
+		}
+	}
+
+	linear := make([]float32, pixelCount*3)
+	peak := 1.0
+	for pixel := range pixelCount {
+		var red, green, blue float64
+		if colourBands == 1 {
+			red = toLinear(sample(pixel * bands))
+			green, blue = red, red
+		} else {
+			red = toLinear(sample(pixel * bands))
+			green = toLinear(sample(pixel*bands + 1))
+			blue = toLinear(sample(pixel*bands + 2))
+		}
+
+		if colours.transfer == transferHLG {
+			// the HLG OOTF for a 1000 nit reference display, a system gamma of 1.2
+			luminance := 0.2627*red + 0.6780*green + 0.0593*blue
+			scale := 1000 * math.Pow(max(luminance, 1e-6), 0.2) / sdrWhiteNits
+			red, green, blue = red*scale, green*scale, blue*scale
+		}
+		if colours.bt2020 {
+			red, green, blue = 1.6605*red-0.5876*green-0.0728*blue,
+				-0.1246*red+1.1329*green-0.0083*blue,
+				-0.0182*red-0.1006*green+1.1187*blue
+		}
+		red, green, blue = max(red, 0), max(green, 0), max(blue, 0)
+
+		peak = max(peak, red, green, blue)
+		linear[pixel*3], linear[pixel*3+1], linear[pixel*3+2] = float32(red), float32(green), float32(blue)
+	}
+
+	if peak <= 1 {
+		operator = "clip"
+	}
+
+	// every value gets rounded to 8 bits in the end, so there's no point in working out linearToSrgb for more than this
+	const tableSize = 65535
+	srgbTable := make([]byte, tableSize+1)
+	for i := range srgbTable {
+		srgbTable[i] = byte(math.Round(linearToSrgb(float64(i)/tableSize) * 255))
+	}
+
+	outputBands := 3
+	if hasAlpha || forceAlpha {
+		outputBands = 4
+	}
+	output := make([]byte, pixelCount*outputBands)
+	for pixel := range pixelCount {
+		red, green, blue := float64(linear[pixel*3]), float64(linear[pixel*3+1]), float64(linear[pixel*3+2])
+		// scaled by the brightest channel, so colours keep their hue instead of washing out to white
+		brightest := max(red, green, blue)
+		if brightest > 0 {
+			scale := toneMapValue(brightest, peak, operator) / brightest
+			red, green, blue = red*scale, green*scale, blue*scale
+		}
+
+		out := output[pixel*outputBands:]
+		out[0] = srgbTable[int(min(red, 1)*tableSize+0.5)]
+		out[1] = srgbTable[int(min(green, 1)*tableSize+0.5)]
+		out[2] = srgbTable[int(min(blue, 1)*tableSize+0.5)]
+		if hasAlpha {
+			out[3] = byte(math.Round(min(max(sample(pixel*bands+bands-1), 0), 1) * 255))
+		} else if forceAlpha {
+			out[3] = 255
+		}
+	}
+	return output
+}
+
+// needsToneMapping is for the pngs raylib would otherwise load, it doesn't know about 16 bit or HDR
+func needsToneMapping(fileData []byte) bool {
+	return isHighBitDepthPng(fileData) || readDynamicRange(fileData, readPngProfile(fileData)).isHdr()
+}
+
+func needsEightBit(imageRef *vips.ImageRef, colours dynamicRange) bool {
+	return colours.isHdr() || imageRef.BandFormat() != vips.BandFormatUchar
+}
+
+// toEightBit gets the pixels out of vips as 8 bit sRGB, tone mapping them when they're HDR.
+// Anything that's already 8 bit SDR doesn't need this, vips' own ToBytes is a lot quicker
+func (imageLoader *ImageLoader) toEightBit(imageRef *vips.ImageRef, colours dynamicRange, forceAlpha bool) ([]byte, bool, error) {
+	switch {
+	case imageRef.BandFormat() == vips.BandFormatUshort || imageRef.BandFormat() == vips.BandFormatUchar:
+	case imageRef.ColorSpace() == vips.InterpretationScRGB:
+		// floats that are already linear, where 1 is SDR white
+		colours.transfer = transferLinear
+		err := imageRef.Cast(vips.BandFormatFloat)
+		if err != nil {
+			return nil, false, err
+		}
+	default:
+		err := imageRef.ToColorSpace(vips.InterpretationRGB16)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	imageBytes, err := imageRef.ToBytes()
+	if err != nil {
+		return nil, false, err
+	}
+	bands := imageRef.Bands()
+	pixelCount := imageRef.Width() * imageRef.Height()
+
+	var sample func(i int) float64
+	switch imageRef.BandFormat() {
+	case vips.BandFormatUchar:
+		sample = func(i int) float64 {
+			return float64(imageBytes[i]) / 255
+		}
+	case vips.BandFormatUshort:
+		sample = func(i int) float64 {
+			return float64(binary.NativeEndian.Uint16(imageBytes[i*2:])) / 65535
+		}
+	default:
+		sample = func(i int) float64 {
+			return float64(math.Float32frombits(binary.NativeEndian.Uint32(imageBytes[i*4:])))
+		}
+	}
+
+	pixels := toneMapPixels(sample, pixelCount, bands, colours, imageLoader.toneMap, forceAlpha)
+	return pixels, forceAlpha || bands == 2 || bands == 4, nil
+}
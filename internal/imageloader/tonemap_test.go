@@ -0,0 +1,109 @@
+package imageloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// a 16 bit png with the given pixels in a row, and a cICP chunk when it's HDR
+func highBitDepthPng(t *testing.T, pixels []uint16, cicp []byte) []byte {
+	picture := image.NewRGBA64(image.Rect(0, 0, len(pixels), 1))
+	for x, value := range pixels {
+		picture.SetRGBA64(x, 0, color.RGBA64{value, value, value, 65535})
+	}
+	buffer := bytes.Buffer{}
+	err := png.Encode(&buffer, picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cicp == nil {
+		return buffer.Bytes()
+	}
+	headerEnd := len(pngSignature) + 8 + 13 + 4
+	withCicp := bytes.Buffer{}
+	withCicp.Write(buffer.Bytes()[:headerEnd])
+	writePngChunk(&withCicp, "cICP", cicp)
+	withCicp.Write(buffer.Bytes()[headerEnd:])
+	return withCicp.Bytes()
+}
+
+// decodes the png the same way vips hands over 16 bit pixels, and tone maps them
+func toneMapPng(t *testing.T, data []byte, operator string) []byte {
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	picture, ok := decoded.(*image.RGBA64)
+	if !ok {
+		t.Fatalf("Expected a 16 bit picture, got %T", decoded)
+	}
+	sample := func(i int) float64 {
+		return float64(binary.BigEndian.Uint16(picture.Pix[i*2:])) / 65535
+	}
+	return toneMapPixels(sample, picture.Rect.Dx(), 4, readDynamicRange(data, nil), operator, false)
+}
+
+func TestSixteenBitPng(t *testing.T) {
+	// 0x0100 would come out as 0 if only its low byte was read as an 8 bit value
+	data := highBitDepthPng(t, []uint16{0, 0x0100, 0x8080, 65535}, nil)
+	if !isHighBitDepthPng(data) || !needsToneMapping(data) {
+		t.Fatal("Expected a 16 bit png to skip raylib")
+	}
+	if colours := readDynamicRange(data, nil); colours.isHdr() {
+		t.Error("Expected a png without a cICP chunk to be SDR")
+	}
+
+	pixels := toneMapPng(t, data, "hable")
+	expected := []byte{0, 1, 128, 255}
+	for i, value := range expected {
+		if pixels[i*4] != value || pixels[i*4+3] != 255 {
+			t.Errorf("Expected pixel %d to be %d, got %v", i, value, pixels[i*4:i*4+4])
+		}
+	}
+}
+
+func TestHdrPng(t *testing.T) {
+	// PQ signal values for 0, 100, 203 (SDR white), 1000, and 4000 nits
+	nits := []float64{0, 100, 203, 1000, 4000}
+	signals := []uint16{0, 33297, 38055, 49271, 59150}
+	for i, signal := range signals {
+		if got := pqToNits(float64(signal) / 65535); got < nits[i]*0.99 || got > nits[i]*1.01 {
+			t.Errorf("Expected a PQ signal of %d to be %v nits, got %v", signal, nits[i], got)
+		}
+	}
+
+	// BT.2020 primaries, PQ transfer, RGB, full range
+	data := highBitDepthPng(t, signals, []byte{9, 16, 0, 1})
+	colours := readDynamicRange(data, nil)
+	if colours.transfer != transferPQ || !colours.bt2020 {
+		t.Fatalf("Expected BT.2020 PQ, got %+v", colours)
+	}
+
+	clipped := toneMapPng(t, data, "clip")
+	if clipped[2*4] != 255 || clipped[3*4] != 255 || clipped[1*4] >= 255 {
+		t.Errorf("Expected clipping to make everything at SDR white or brighter 255, got %v", clipped)
+	}
+
+	for _, operator := range []string{"reinhard", "hable", "aces"} {
+		pixels := toneMapPng(t, data, operator)
+		for i := 1; i < len(signals); i++ {
+			if pixels[i*4] <= pixels[(i-1)*4] {
+				t.Errorf("Expected %s to keep brighter pixels brighter, got %v", operator, pixels)
+				break
+			}
+		}
+		if pixels[0] != 0 {
+			t.Errorf("Expected %s to keep black black, got %d", operator, pixels[0])
+		}
+	}
+
+	// the nclx colour box from an avif/heif, BT.2020 and HLG
+	heifHeader := append([]byte("\x00\x00\x00\x13colrnclx"), 0, 9, 0, 18, 0, 9, 0x80)
+	if colours := readDynamicRange(heifHeader, nil); colours.transfer != transferHLG || !colours.bt2020 {
+		t.Errorf("Expected BT.2020 HLG from the nclx box, got %+v", colours)
+	}
+}